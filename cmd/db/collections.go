@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+)
+
+// collections is implemented by stores with list, set and hash values.
+type collections interface {
+	LPush(key string, values ...string) (int, error)
+	RPush(key string, values ...string) (int, error)
+	LPop(key string) (string, error)
+	RPop(key string) (string, error)
+	LRange(key string, start, stop int) ([]string, error)
+	SAdd(key string, members ...string) (int, error)
+	SRem(key string, members ...string) (int, error)
+	SMembers(key string) ([]string, error)
+	SIsMember(key, member string) (bool, error)
+	HSet(key, field, value string) (bool, error)
+	HGet(key, field string) (string, error)
+	HGetAll(key string) (map[string]string, error)
+	HDel(key string, fields ...string) (int, error)
+}
+
+// handleCollection resolves the store and the path below /list/, /set/ or
+// /hash/ into a key and an optional item.
+func handleCollection(store datastore.Store, prefix string, w http.ResponseWriter, r *http.Request,
+	serve func(c collections, key, item string, w http.ResponseWriter, r *http.Request)) {
+	c, ok := store.(collections)
+	if !ok {
+		http.Error(w, "collections are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	key, item, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	serve(c, key, item, w, r)
+}
+
+// collectionFailed maps the errors of a collection operation to a status.
+// A key holding another type is a conflict, like Redis' WRONGTYPE.
+func collectionFailed(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		http.Error(w, "", http.StatusNotFound)
+	case errors.Is(err, datastore.ErrTypeMismatch):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeFailed(w, err, "collection error")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// handleList serves GET /list/{key}?start=&stop= ranges, pushes with POST
+// /list/{key} and a {"values": [...]} body, and pops with POST
+// /list/{key}/pop. ?side=left or right picks the end; pushes go right and
+// pops left by default, so a list works as a queue.
+func handleList(c collections, key, item string, w http.ResponseWriter, r *http.Request) {
+	side := r.URL.Query().Get("side")
+	if side != "" && side != "left" && side != "right" {
+		http.Error(w, "invalid side", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case item == "" && r.Method == http.MethodGet:
+		start, stop := 0, -1
+		var err error
+		if s := r.URL.Query().Get("start"); s != "" {
+			if start, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "invalid start", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.URL.Query().Get("stop"); s != "" {
+			if stop, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "invalid stop", http.StatusBadRequest)
+				return
+			}
+		}
+		values, err := c.LRange(key, start, stop)
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "values": values})
+
+	case item == "" && r.Method == http.MethodPost:
+		var data struct {
+			Values []string `json:"values"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || len(data.Values) == 0 {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		push := c.RPush
+		if side == "left" {
+			push = c.LPush
+		}
+		n, err := push(key, data.Values...)
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "length": n})
+
+	case item == "pop" && r.Method == http.MethodPost:
+		pop := c.LPop
+		if side == "right" {
+			pop = c.RPop
+		}
+		value, err := pop(key)
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "value": value})
+
+	case item != "" && item != "pop":
+		http.Error(w, "", http.StatusNotFound)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSet serves GET /set/{key} with the members, adds members with POST
+// /set/{key} and a {"members": [...]} body, and checks or removes a single
+// member with GET or DELETE /set/{key}/{member}.
+func handleSet(c collections, key, member string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case member == "" && r.Method == http.MethodGet:
+		members, err := c.SMembers(key)
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "members": members})
+
+	case member == "" && r.Method == http.MethodPost:
+		var data struct {
+			Members []string `json:"members"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || len(data.Members) == 0 {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		added, err := c.SAdd(key, data.Members...)
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "added": added})
+
+	case member != "" && r.Method == http.MethodGet:
+		ok, err := c.SIsMember(key, member)
+		if err == nil && !ok {
+			err = datastore.ErrNotFound
+		}
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case member != "" && r.Method == http.MethodDelete:
+		removed, err := c.SRem(key, member)
+		if err == nil && removed == 0 {
+			err = datastore.ErrNotFound
+		}
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleHash serves GET /hash/{key} with every field, and GET, POST and
+// DELETE /hash/{key}/{field} for a single field. POST takes a
+// {"value": "..."} body and answers 201 for a new field.
+func handleHash(c collections, key, field string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case field == "" && r.Method == http.MethodGet:
+		fields, err := c.HGetAll(key)
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "fields": fields})
+
+	case field == "":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	case r.Method == http.MethodGet:
+		value, err := c.HGet(key, field)
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "field": field, "value": value})
+
+	case r.Method == http.MethodPost:
+		var data struct {
+			Value *string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Value == nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		created, err := c.HSet(key, field, *data.Value)
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+
+	case r.Method == http.MethodDelete:
+		removed, err := c.HDel(key, field)
+		if err == nil && removed == 0 {
+			err = datastore.ErrNotFound
+		}
+		if err != nil {
+			collectionFailed(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
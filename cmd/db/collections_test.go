@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openCollectionStore(t *testing.T) http.Handler {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return newHandler(db)
+}
+
+func TestHandleList(t *testing.T) {
+	h := openCollectionStore(t)
+
+	rec := doRequest(h, http.MethodPost, "/list/jobs", `{"values": ["a", "b"]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "jobs", "length": 2}`, rec.Body.String())
+	rec = doRequest(h, http.MethodPost, "/list/jobs?side=left", `{"values": ["first"]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(h, http.MethodGet, "/list/jobs?start=0&stop=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "jobs", "values": ["first", "a"]}`, rec.Body.String())
+
+	rec = doRequest(h, http.MethodPost, "/list/jobs/pop", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "jobs", "value": "first"}`, rec.Body.String())
+	rec = doRequest(h, http.MethodPost, "/list/jobs/pop?side=right", "")
+	assert.JSONEq(t, `{"key": "jobs", "value": "b"}`, rec.Body.String())
+	doRequest(h, http.MethodPost, "/list/jobs/pop", "")
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodPost, "/list/jobs/pop", "").Code)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/list/jobs", `{"values": []}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodGet, "/list/jobs?side=up", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodGet, "/list/", "").Code)
+}
+
+func TestHandleSetAndHash(t *testing.T) {
+	h := openCollectionStore(t)
+
+	rec := doRequest(h, http.MethodPost, "/set/tags", `{"members": ["go", "db", "go"]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "tags", "added": 2}`, rec.Body.String())
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodGet, "/set/tags/go", "").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodDelete, "/set/tags/go", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodGet, "/set/tags/go", "").Code)
+	rec = doRequest(h, http.MethodGet, "/set/tags", "")
+	assert.JSONEq(t, `{"key": "tags", "members": ["db"]}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusCreated, doRequest(h, http.MethodPost, "/hash/user/name", `{"value": "Ann"}`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(h, http.MethodPost, "/hash/user/name", `{"value": "Bob"}`).Code)
+	assert.Equal(t, http.StatusCreated, doRequest(h, http.MethodPost, "/hash/user/city", `{"value": "Kyiv"}`).Code)
+	rec = doRequest(h, http.MethodGet, "/hash/user/name", "")
+	assert.JSONEq(t, `{"key": "user", "field": "name", "value": "Bob"}`, rec.Body.String())
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodDelete, "/hash/user/city", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodDelete, "/hash/user/city", "").Code)
+	rec = doRequest(h, http.MethodGet, "/hash/user", "")
+	assert.JSONEq(t, `{"key": "user", "fields": {"name": "Bob"}}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusConflict, doRequest(h, http.MethodGet, "/list/user", "").Code)
+}
+
+func TestHandleCollectionsUnsupported(t *testing.T) {
+	h := newHandler(datastore.NewMemStore())
+	assert.Equal(t, http.StatusNotImplemented, doRequest(h, http.MethodGet, "/set/tags", "").Code)
+}
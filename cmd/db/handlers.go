@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+)
+
+func newHandler(db datastore.Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
+		handleDB(db, w, r)
+	})
+	mux.HandleFunc("/api/v1/some-data", func(w http.ResponseWriter, r *http.Request) {
+		handleSomeData(db, w, r)
+	})
+	mux.HandleFunc("/list/", func(w http.ResponseWriter, r *http.Request) {
+		handleCollection(db, "/list/", w, r, handleList)
+	})
+	mux.HandleFunc("/set/", func(w http.ResponseWriter, r *http.Request) {
+		handleCollection(db, "/set/", w, r, handleSet)
+	})
+	mux.HandleFunc("/hash/", func(w http.ResponseWriter, r *http.Request) {
+		handleCollection(db, "/hash/", w, r, handleHash)
+	})
+	mux.HandleFunc("/queue/", func(w http.ResponseWriter, r *http.Request) {
+		handleQueue(db, w, r)
+	})
+	mux.HandleFunc("/lock/", func(w http.ResponseWriter, r *http.Request) {
+		handleLock(db, w, r)
+	})
+	mux.HandleFunc("/admin/compact", func(w http.ResponseWriter, r *http.Request) {
+		handleCompact(db, w, r)
+	})
+	mux.HandleFunc("/admin/export", func(w http.ResponseWriter, r *http.Request) {
+		handleExport(db, w, r)
+	})
+	mux.HandleFunc("/admin/import", func(w http.ResponseWriter, r *http.Request) {
+		handleImport(db, w, r)
+	})
+	mux.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		handleStats(db, w, r)
+	})
+	return mux
+}
+
+// retryAfter is how many seconds a client should back off when the write
+// queue is full.
+const retryAfter = "1"
+
+// writeFailed reports a failed write. A full write queue gets 503 with
+// Retry-After, so the balancer sheds load instead of piling up requests.
+// Writes to a reserved bucket get 400.
+func writeFailed(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, datastore.ErrBusy) {
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, datastore.ErrInvalidBucket) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// statsSource is implemented by stores that report file and queue stats.
+type statsSource interface {
+	Stats() datastore.Stats
+}
+
+func handleStats(store datastore.Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	src, ok := store.(statsSource)
+	if !ok {
+		http.Error(w, "stats are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(src.Stats())
+}
+
+func handleCompact(db datastore.Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := db.Compact(r.Context()); err != nil {
+		http.Error(w, "compaction failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleExport streams the whole store as newline-delimited JSON. Once the
+// body has started an error can only cut the stream short.
+func handleExport(db datastore.Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := db.Export(w); err != nil {
+		http.Error(w, "export failed: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleImport(db datastore.Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := db.Import(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, datastore.ErrBusy) {
+			w.Header().Set("Retry-After", retryAfter)
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"imported": n,
+			"error":    err.Error(),
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported": n,
+	})
+}
+
+// changeFeed is implemented by stores with a global write order.
+type changeFeed interface {
+	ChangesSince(since uint64, fn func(datastore.Change) error) error
+}
+
+// handleChanges streams the changes after ?since= as JSON lines. A client
+// that fell behind a compaction gets 410 Gone with the horizon to resume from
+// once it has reloaded the data.
+func handleChanges(store datastore.Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	feed, ok := store.(changeFeed)
+	if !ok {
+		http.Error(w, "change feed is not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	streaming := false
+	err := feed.ChangesSince(since, func(c datastore.Change) error {
+		streaming = true
+		return enc.Encode(c)
+	})
+	if err == nil || streaming {
+		// Once lines went out an error can only cut the stream short.
+		return
+	}
+	var compacted *datastore.CompactedError
+	if errors.As(err, &compacted) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   err.Error(),
+			"horizon": compacted.Horizon,
+		})
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// keyValue is implemented by both a datastore.Store and its buckets.
+type keyValue interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	GetInt64(key string) (int64, error)
+	PutInt64(key string, value int64) error
+	PutStream(key string, r io.Reader, size int64) error
+	GetStream(key string) (io.ReadCloser, error)
+	GetWithMeta(key string) ([]byte, datastore.Meta, error)
+	Delete(key string) error
+}
+
+// handleDB serves /db/{key} from the default key space and
+// /db/{bucket}/{key} from a bucket. DELETE /db/{bucket}/ drops the bucket.
+func handleDB(store datastore.Store, w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/db/")
+	bucket, key, scoped := strings.Cut(path, "/")
+	if !scoped {
+		bucket, key = "", path
+	}
+
+	if scoped && bucket == "_index" {
+		handleIndex(store, key, w, r)
+		return
+	}
+	if !scoped && key == "_changes" {
+		handleChanges(store, w, r)
+		return
+	}
+	if scoped && key == "" && r.Method == http.MethodDelete {
+		err := store.DropBucket(bucket)
+		if errors.Is(err, datastore.ErrInvalidBucket) {
+			http.Error(w, "invalid bucket", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeFailed(w, err, "drop error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if scoped && bucket == "" {
+		http.Error(w, "missing bucket", http.StatusBadRequest)
+		return
+	}
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	var db keyValue = store
+	if scoped {
+		db = store.Bucket(bucket)
+	}
+	handleKey(db, key, w, r)
+}
+
+// handleIndex serves GET /db/_index/{name}?value= lookups and creates indexes
+// with POST /db/_index/{name} and a {"path": "..."} body.
+func handleIndex(store datastore.Store, name string, w http.ResponseWriter, r *http.Request) {
+	if name == "" {
+		http.Error(w, "missing index name", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value := r.URL.Query().Get("value")
+		keys, err := store.Lookup(name, value)
+		if errors.Is(err, datastore.ErrIndexNotFound) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "lookup error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"index": name,
+			"value": value,
+			"keys":  keys,
+		})
+
+	case http.MethodPost:
+		var data struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Path == "" {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		err := store.CreateIndex(name, data.Path)
+		if errors.Is(err, datastore.ErrIndexExists) {
+			http.Error(w, "index exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleKey(db keyValue, key string, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		typ := r.URL.Query().Get("type")
+		if typ == "" {
+			typ = "string"
+		}
+		if at := r.URL.Query().Get("at"); at != "" {
+			handleKeyAt(db, key, typ, at, w)
+			return
+		}
+
+		switch typ {
+		case "string", "int64":
+			data, meta, err := db.GetWithMeta(key)
+			if err != nil || meta.Type != typ {
+				http.Error(w, "", http.StatusNotFound)
+				return
+			}
+			body, err := valueJSON(key, typ, data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !meta.WrittenAt.IsZero() {
+				body["updatedAt"] = meta.WrittenAt.UTC()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(body)
+
+		case "bytes":
+			body, err := db.GetStream(key)
+			if err != nil {
+				http.Error(w, "", http.StatusNotFound)
+				return
+			}
+			defer body.Close()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = io.Copy(w, body)
+
+		default:
+			http.Error(w, "unsupported type", http.StatusBadRequest)
+		}
+
+	case http.MethodPut:
+		if r.Header.Get("Content-Type") != "application/octet-stream" {
+			http.Error(w, "expected application/octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.ContentLength < 0 {
+			http.Error(w, "missing content length", http.StatusLengthRequired)
+			return
+		}
+		err := db.PutStream(key, r.Body, r.ContentLength)
+		if errors.Is(err, datastore.ErrTooLarge) {
+			http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			writeFailed(w, err, "put error")
+			return
+		}
+
+	case http.MethodPost:
+		var data map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		rawVal, ok := data["value"]
+		if !ok {
+			http.Error(w, "missing value", http.StatusBadRequest)
+			return
+		}
+
+		switch v := rawVal.(type) {
+		case string:
+			err := db.Put(key, v)
+			if err != nil {
+				writeFailed(w, err, "put error")
+			}
+		case float64:
+			err := db.PutInt64(key, int64(v))
+			if err != nil {
+				writeFailed(w, err, "put error")
+			}
+		default:
+			http.Error(w, "invalid value type", http.StatusBadRequest)
+		}
+
+	case http.MethodDelete:
+		err := db.Delete(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeFailed(w, err, "delete error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// timeTravel is implemented by stores that keep old versions of keys.
+type timeTravel interface {
+	GetAt(key string, t time.Time) ([]byte, string, error)
+}
+
+// handleKeyAt serves GET /db/{key}?at= with the value key had at the given
+// RFC 3339 time. A time whose version was compacted away gets 410 Gone.
+func handleKeyAt(db keyValue, key, typ, at string, w http.ResponseWriter) {
+	t, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		http.Error(w, "invalid at", http.StatusBadRequest)
+		return
+	}
+	store, ok := db.(timeTravel)
+	if !ok {
+		http.Error(w, "history is not supported here", http.StatusNotImplemented)
+		return
+	}
+	data, got, err := store.GetAt(key, t)
+	if errors.Is(err, datastore.ErrCompacted) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if errors.Is(err, datastore.ErrUnsupportedFormat) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil || got != typ {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	switch typ {
+	case "string", "int64":
+		body, err := valueJSON(key, typ, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(body)
+
+	case "bytes":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+
+	default:
+		http.Error(w, "unsupported type", http.StatusBadRequest)
+	}
+}
+
+// valueJSON is the response body for a string or int64 value.
+func valueJSON(key, typ string, data []byte) (map[string]interface{}, error) {
+	if typ == "int64" {
+		val, err := datastore.Int64Codec.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"key": key, "value": val}, nil
+	}
+	return map[string]interface{}{"key": key, "value": string(data)}, nil
+}
+
+func handleSomeData(db datastore.Store, w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	typ := r.URL.Query().Get("type")
+	if typ == "" {
+		typ = "string"
+	}
+
+	switch typ {
+	case "string":
+		value, err := db.Get(key)
+		if err != nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"key":   key,
+			"value": value,
+		})
+
+	case "int64":
+		value, err := db.GetInt64(key)
+		if err != nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"key":   key,
+			"value": value,
+		})
+
+	default:
+		http.Error(w, "unsupported type", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func doRequest(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// valueBody checks that a GET response carries the write time and returns the
+// rest of it.
+func valueBody(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	updatedAt, ok := body["updatedAt"].(string)
+	require.True(t, ok, "missing updatedAt in %s", rec.Body.String())
+	_, err := time.Parse(time.RFC3339Nano, updatedAt)
+	require.NoError(t, err)
+	delete(body, "updatedAt")
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestHandleDB_PutGetString(t *testing.T) {
+	h := newHandler(datastore.NewMemStore())
+
+	rec := doRequest(h, http.MethodPost, "/db/team", `{"value": "2024-01-01"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(h, http.MethodGet, "/db/team", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "team", "value": "2024-01-01"}`, valueBody(t, rec))
+}
+
+func TestHandleDB_PutGetInt64(t *testing.T) {
+	store := datastore.NewMemStore()
+	h := newHandler(store)
+
+	rec := doRequest(h, http.MethodPost, "/db/counter", `{"value": 42}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	val, err := store.GetInt64("counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), val)
+
+	rec = doRequest(h, http.MethodGet, "/db/counter?type=int64", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "counter", "value": 42}`, valueBody(t, rec))
+}
+
+func TestHandleDB_Errors(t *testing.T) {
+	h := newHandler(datastore.NewMemStore())
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodGet, "/db/", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodGet, "/db/missing", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodGet, "/db/k?type=float", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/db/k", "not json").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/db/k", `{"other": 1}`).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(h, http.MethodPatch, "/db/k", "").Code)
+}
+
+func TestHandleDB_Delete(t *testing.T) {
+	store := datastore.NewMemStore()
+	require.NoError(t, store.Put("k", "v"))
+	h := newHandler(store)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodDelete, "/db/k", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodDelete, "/db/k", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodGet, "/db/k", "").Code)
+}
+
+func TestHandleSomeData(t *testing.T) {
+	store := datastore.NewMemStore()
+	require.NoError(t, store.Put("k", "v"))
+	h := newHandler(store)
+
+	rec := doRequest(h, http.MethodGet, "/api/v1/some-data?key=k", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "k", "value": "v"}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodGet, "/api/v1/some-data", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodGet, "/api/v1/some-data?key=missing", "").Code)
+}
+
+func TestHandleDB_Stream(t *testing.T) {
+	h := newHandler(datastore.NewMemStore())
+	payload := strings.Repeat("artifact", 4096)
+
+	req := httptest.NewRequest(http.MethodPut, "/db/build", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(h, http.MethodGet, "/db/build?type=bytes", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+	assert.Equal(t, payload, rec.Body.String())
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, doRequest(h, http.MethodPut, "/db/build", payload).Code)
+}
+
+func TestHandleDB_Buckets(t *testing.T) {
+	store := datastore.NewMemStore()
+	require.NoError(t, store.Put("k", "root"))
+	h := newHandler(store)
+
+	rec := doRequest(h, http.MethodPost, "/db/team/k", `{"value": "scoped"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	val, err := store.Bucket("team").Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, "scoped", val)
+
+	assert.JSONEq(t, `{"key": "k", "value": "root"}`, valueBody(t, doRequest(h, http.MethodGet, "/db/k", "")))
+	assert.JSONEq(t, `{"key": "k", "value": "scoped"}`, valueBody(t, doRequest(h, http.MethodGet, "/db/team/k", "")))
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodGet, "/db/team/", "").Code)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodDelete, "/db/team/", "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodGet, "/db/team/k", "").Code)
+	assert.Equal(t, http.StatusOK, doRequest(h, http.MethodGet, "/db/k", "").Code)
+}
+
+func TestHandleIndex(t *testing.T) {
+	store := datastore.NewMemStore()
+	require.NoError(t, store.Put("u1", `{"role": "admin"}`))
+	require.NoError(t, store.Put("u2", `{"role": "user"}`))
+	require.NoError(t, store.Bucket("staff").Put("u3", `{"role": "admin"}`))
+	h := newHandler(store)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodGet, "/db/_index/by_role?value=admin", "").Code)
+	assert.Equal(t, http.StatusCreated, doRequest(h, http.MethodPost, "/db/_index/by_role", `{"path": "role"}`).Code)
+	assert.Equal(t, http.StatusConflict, doRequest(h, http.MethodPost, "/db/_index/by_role", `{"path": "role"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/db/_index/bad", `{"path": ""}`).Code)
+
+	rec := doRequest(h, http.MethodGet, "/db/_index/by_role?value=admin", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"index": "by_role", "value": "admin", "keys": [{"key": "u1"}, {"bucket": "staff", "key": "u3"}]}`, rec.Body.String())
+}
+
+func TestHandleCompact(t *testing.T) {
+	h := newHandler(datastore.NewMemStore())
+
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodPost, "/admin/compact", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(h, http.MethodGet, "/admin/compact", "").Code)
+}
+
+func TestHandleExportImport(t *testing.T) {
+	src := datastore.NewMemStore()
+	require.NoError(t, src.Put("a", "1"))
+	require.NoError(t, src.PutInt64("n", 2))
+
+	rec := doRequest(newHandler(src), http.MethodGet, "/admin/export", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	dst := datastore.NewMemStore()
+	h := newHandler(dst)
+	imported := doRequest(h, http.MethodPost, "/admin/import", rec.Body.String())
+	require.Equal(t, http.StatusOK, imported.Code)
+	assert.JSONEq(t, `{"imported": 2}`, imported.Body.String())
+	val, err := dst.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, "1", val)
+
+	bad := doRequest(h, http.MethodPost, "/admin/import", `{"key": "x", "type": "int64", "value": "y"}`)
+	assert.Equal(t, http.StatusBadRequest, bad.Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(h, http.MethodPost, "/admin/export", "").Code)
+}
+
+func TestHandleChanges(t *testing.T) {
+	store := datastore.NewMemStore()
+	require.NoError(t, store.Put("a", "1"))
+	require.NoError(t, store.PutInt64("n", 2))
+	require.NoError(t, store.Delete("a"))
+	h := newHandler(store)
+
+	rec := doRequest(h, http.MethodGet, "/db/_changes?since=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"seq": 2, "key": "n", "type": "int64", "value": 2}`, lines[0])
+	assert.JSONEq(t, `{"seq": 3, "key": "a", "type": "tombstone", "value": null}`, lines[1])
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodGet, "/db/_changes?since=x", "").Code)
+}
+
+func TestHandleChangesCompacted(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	require.NoError(t, db.Put("k", "1"))
+	require.NoError(t, db.Put("k", "2"))
+	require.NoError(t, db.Compact(context.Background()))
+	h := newHandler(db)
+
+	rec := doRequest(h, http.MethodGet, "/db/_changes?since=1", "")
+	require.Equal(t, http.StatusGone, rec.Code)
+	var body struct {
+		Horizon uint64 `json:"horizon"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, uint64(2), body.Horizon)
+
+	assert.Equal(t, http.StatusOK, doRequest(h, http.MethodGet, "/db/_changes?since=2", "").Code)
+}
+
+func TestHandleDB_GetAt(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	require.NoError(t, db.Put("team", "old"))
+	require.NoError(t, db.PutInt64("n", 1))
+	versions, err := db.History("team")
+	require.NoError(t, err)
+	at := versions[0].Time.Format(time.RFC3339Nano)
+	require.NoError(t, db.Put("team", "new"))
+	h := newHandler(db)
+
+	rec := doRequest(h, http.MethodGet, "/db/team?at="+at, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "team", "value": "old"}`, rec.Body.String())
+
+	rec = doRequest(h, http.MethodGet, "/db/n?type=int64&at="+time.Now().Format(time.RFC3339Nano), "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"key": "n", "value": 1}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodGet, "/db/team?at=2000-01-01T00:00:00Z", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodGet, "/db/team?at=yesterday", "").Code)
+	assert.Equal(t, http.StatusNotImplemented, doRequest(newHandler(datastore.NewMemStore()), http.MethodGet, "/db/team?at="+at, "").Code)
+}
+
+// busyStore fails every write the way a Db with a full write queue does.
+type busyStore struct {
+	*datastore.MemStore
+}
+
+func (busyStore) Put(string, string) error { return datastore.ErrBusy }
+
+func (busyStore) Delete(string) error { return datastore.ErrBusy }
+
+func (busyStore) Import(io.Reader) (int, error) { return 0, datastore.ErrBusy }
+
+func TestHandleDB_Busy(t *testing.T) {
+	store := busyStore{datastore.NewMemStore()}
+	require.NoError(t, store.MemStore.Put("k", "v"))
+	h := newHandler(store)
+
+	for _, rec := range []*httptest.ResponseRecorder{
+		doRequest(h, http.MethodPost, "/db/k", `{"value": "v2"}`),
+		doRequest(h, http.MethodDelete, "/db/k", ""),
+		doRequest(h, http.MethodPost, "/admin/import", `{"key": "x", "type": "string", "value": "y"}`),
+	} {
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	}
+	assert.Equal(t, http.StatusOK, doRequest(h, http.MethodGet, "/db/k", "").Code)
+}
+
+func TestHandleStats(t *testing.T) {
+	db, err := datastore.Open(t.TempDir(), datastore.WithWriteQueue(8))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	require.NoError(t, db.Put("k", "v"))
+	h := newHandler(db)
+
+	rec := doRequest(h, http.MethodGet, "/admin/stats", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats datastore.Stats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, 1, stats.Keys)
+	assert.Equal(t, 8, stats.QueueCap)
+
+	assert.Equal(t, http.StatusNotImplemented, doRequest(newHandler(datastore.NewMemStore()), http.MethodGet, "/admin/stats", "").Code)
+}
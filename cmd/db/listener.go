@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+)
+
+// logListener writes datastore events to a structured log.
+type logListener struct {
+	log *slog.Logger
+}
+
+func (l logListener) RecoveryStarted(dir string) {
+	l.log.Info("recovery started", "dir", dir)
+}
+
+func (l logListener) RecoveryFinished(info datastore.RecoveryInfo) {
+	attrs := []any{
+		"dir", info.Dir,
+		"records", info.Records,
+		"keys", info.Keys,
+		"duration", info.Duration,
+		"truncated", info.Truncated,
+	}
+	if info.Err != nil {
+		l.log.Error("recovery failed", append(attrs, "err", info.Err)...)
+		return
+	}
+	l.log.Info("recovery finished", attrs...)
+}
+
+func (l logListener) CompactionStarted(dir string) {
+	l.log.Info("compaction started", "dir", dir)
+}
+
+func (l logListener) CompactionFinished(info datastore.CompactionInfo) {
+	if info.Err != nil {
+		l.log.Warn("compaction abandoned", "dir", info.Dir, "duration", info.Duration, "err", info.Err)
+		return
+	}
+	l.log.Info("compaction finished",
+		"dir", info.Dir,
+		"duration", info.Duration,
+		"size", info.Size,
+		"reclaimed", info.Reclaimed,
+	)
+}
+
+func (l logListener) WriteFailed(dir, key string, err error) {
+	l.log.Error("write failed", "dir", dir, "key", key, "err", err)
+}
+
+func (l logListener) CorruptionDetected(dir string, err *datastore.CorruptionError) {
+	l.log.Error("corruption detected", "dir", dir, "offset", err.Offset, "err", err.Err)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogListener(t *testing.T) {
+	var out bytes.Buffer
+	l := logListener{log: slog.New(slog.NewJSONHandler(&out, nil))}
+	dir := t.TempDir()
+
+	db, err := datastore.Open(dir, datastore.WithListener(l), datastore.WithMaxRecordSize(64))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	require.ErrorIs(t, db.Put("big", strings.Repeat("x", 100)), datastore.ErrTooLarge)
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, dir, entry["dir"])
+		messages = append(messages, entry["msg"].(string))
+	}
+	assert.Equal(t, []string{"recovery started", "recovery finished", "write failed"}, messages)
+}
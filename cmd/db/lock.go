@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+)
+
+// lockService is implemented by stores with named locks.
+type lockService interface {
+	AcquireLock(name, owner string, ttl time.Duration) (datastore.Lock, error)
+	RenewLock(name, owner string, token uint64, ttl time.Duration) (datastore.Lock, error)
+	ReleaseLock(name, owner string, token uint64) error
+}
+
+// lockRequest is the body of every lock call. ttl is a Go duration such as
+// "30s"; release ignores it.
+type lockRequest struct {
+	Owner string `json:"owner"`
+	Token uint64 `json:"token"`
+	TTL   string `json:"ttl"`
+}
+
+func lockJSON(l datastore.Lock) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      l.Name,
+		"owner":     l.Owner,
+		"token":     l.Token,
+		"expiresAt": l.ExpiresAt.UTC(),
+	}
+}
+
+// handleLock serves POST /lock/{name}/acquire, /renew and /release. Acquire
+// and renew answer with the lock and its fencing token. A lock held by
+// another owner, or one the caller no longer holds, gets 409 Conflict.
+func handleLock(store datastore.Store, w http.ResponseWriter, r *http.Request) {
+	locks, ok := store.(lockService)
+	if !ok {
+		http.Error(w, "locks are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The name is cut from the escaped path, so a name with a slash, sent
+	// as %2F, stays one segment.
+	escaped, op, ok := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/lock/"), "/")
+	name, err := url.PathUnescape(escaped)
+	if !ok || err != nil || name == "" {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Owner == "" {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if op != "release" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var l datastore.Lock
+	switch op {
+	case "acquire":
+		l, err = locks.AcquireLock(name, req.Owner, ttl)
+	case "renew":
+		l, err = locks.RenewLock(name, req.Owner, req.Token, ttl)
+	case "release":
+		err = locks.ReleaseLock(name, req.Owner, req.Token)
+	default:
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case errors.Is(err, datastore.ErrLockHeld):
+		body := lockJSON(l)
+		delete(body, "token")
+		body["error"] = err.Error()
+		writeJSON(w, http.StatusConflict, body)
+	case errors.Is(err, datastore.ErrLockLost):
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error()})
+	case err != nil:
+		writeFailed(w, err, "lock error")
+	case op == "release":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusOK, lockJSON(l))
+	}
+}
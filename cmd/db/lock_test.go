@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ProMKQ/kpi-lab5/lockclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleLock(t *testing.T) {
+	srv := httptest.NewServer(openDiskHandler(t))
+	defer srv.Close()
+	ctx := context.Background()
+
+	first := lockclient.New(srv.URL, "server1")
+	second := lockclient.New(srv.URL, "server2")
+
+	l, err := first.Acquire(ctx, "seed", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "server1", l.Owner)
+	assert.NotZero(t, l.Token)
+	_, err = second.Acquire(ctx, "seed", time.Minute)
+	assert.ErrorIs(t, err, lockclient.ErrHeld)
+
+	expires := l.ExpiresAt
+	require.NoError(t, l.Renew(ctx))
+	assert.False(t, l.ExpiresAt.Before(expires))
+	require.NoError(t, l.Release(ctx))
+	assert.ErrorIs(t, l.Release(ctx), lockclient.ErrLost)
+
+	next, err := second.Acquire(ctx, "seed", time.Minute)
+	require.NoError(t, err)
+	assert.Greater(t, next.Token, l.Token)
+	assert.ErrorIs(t, l.Renew(ctx), lockclient.ErrLost)
+
+	nested, err := first.Acquire(ctx, "jobs/nightly", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "jobs/nightly", nested.Name)
+	require.NoError(t, nested.Renew(ctx))
+	_, err = second.Acquire(ctx, "jobs/nightly", time.Minute)
+	assert.ErrorIs(t, err, lockclient.ErrHeld)
+	require.NoError(t, nested.Release(ctx))
+
+	h := openDiskHandler(t)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/lock/seed/acquire", `{"owner": "a", "ttl": "soon"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/lock/seed/acquire", `{"ttl": "1s"}`).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodPost, "/lock/seed/steal", `{"owner": "a", "ttl": "1s"}`).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(h, http.MethodGet, "/lock/seed/acquire", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/db/_lock/seed", `{"value": "stolen"}`).Code)
+}
@@ -1,151 +1,149 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/ProMKQ/kpi-lab5/datastore"
 )
 
-var db *datastore.Db
+var (
+	migrate    = flag.Bool("migrate", false, "rewrite db-data to the current on-disk format and exit")
+	partitions = flag.Int("partitions", 1, "number of hash partitions to spread keys over")
+	engine     = flag.String("engine", "hash", "storage engine: hash (in-memory index over a log) or lsm (sorted tables, without history, collections, queues and locks)")
+	memtable   = flag.Int64("memtable-size", 4<<20, "bytes the lsm engine buffers before flushing a table")
+
+	compactDeadRatio = flag.Float64("compact-dead-ratio", 0.5, "share of dead bytes that triggers a background compaction, 0 disables it")
+	compactMinDead   = flag.Int64("compact-min-dead", 1<<20, "dead bytes required before a background compaction")
+	compactRate      = flag.Int64("compact-rate", 8<<20, "compaction copy rate limit in bytes per second, 0 for unlimited")
+	compactWindow    = flag.String("compact-window", "", "daily window for background compaction, e.g. 02:00-05:00")
+
+	historyVersions = flag.Int("history-versions", 0, "previous versions of every key kept through compaction")
+	historyWindow   = flag.Duration("history-window", 0, "keep versions that were current within this long of a compaction")
+
+	writeQueue = flag.Int("write-queue", 0, "writes that may wait for the write loop")
+	shedWrites = flag.Bool("shed-writes", false, "answer 503 instead of waiting when the write queue is full")
+
+	compactIndex = flag.Bool("compact-index", false, "index key hashes instead of keys, reading keys back from disk on collisions")
+)
+
+// hashOnlyFlags tune the data file of the hash engine, the lsm engine has no
+// use for them.
+var hashOnlyFlags = []string{
+	"compact-dead-ratio", "compact-min-dead", "compact-rate", "compact-window",
+	"history-versions", "history-window",
+	"write-queue", "shed-writes",
+	"compact-index",
+}
 
 func main() {
+	flag.Parse()
+
 	var err error
-	err = os.Mkdir("db-data", os.ModePerm)
+	err = os.MkdirAll("db-data", os.ModePerm)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db, err = datastore.OpenWithSegmentLimit("db-data", 1024)
+	if *migrate {
+		if err := datastore.Migrate("db-data"); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("db-data migrated to the current format")
+		return
+	}
+	db, err := openStore("db-data")
+	if errors.Is(err, datastore.ErrLocked) {
+		log.Fatal("db-data is already in use by another db process")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	http.HandleFunc("/db/", handleDB)
-	http.HandleFunc("/api/v1/some-data", handleSomeData)
-
 	port := ":8081"
 	fmt.Println("DB service listening on", port)
-	log.Fatal(http.ListenAndServe("0.0.0.0"+port, nil))
+	log.Fatal(http.ListenAndServe("0.0.0.0"+port, newHandler(db)))
 }
 
-func handleDB(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/db/")
-	if key == "" {
-		http.Error(w, "missing key", http.StatusBadRequest)
-		return
+func openStore(dir string) (datastore.Store, error) {
+	policy := datastore.CompactionPolicy{
+		DeadRatio:      *compactDeadRatio,
+		MinDeadBytes:   *compactMinDead,
+		BytesPerSecond: *compactRate,
 	}
-
-	switch r.Method {
-	case http.MethodGet:
-		typ := r.URL.Query().Get("type")
-		if typ == "" {
-			typ = "string"
-		}
-
-		switch typ {
-		case "string":
-			val, err := db.Get(key)
-			if err != nil {
-				http.Error(w, "", http.StatusNotFound)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(map[string]string{
-				"key":   key,
-				"value": val,
-			})
-
-		case "int64":
-			val, err := db.GetInt64(key)
-			if err != nil {
-				http.Error(w, "", http.StatusNotFound)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(map[string]interface{}{
-				"key":   key,
-				"value": val,
-			})
-
-		default:
-			http.Error(w, "unsupported type", http.StatusBadRequest)
-		}
-
-	case http.MethodPost:
-		var data map[string]interface{}
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "invalid json", http.StatusBadRequest)
-			return
-		}
-		rawVal, ok := data["value"]
-		if !ok {
-			http.Error(w, "missing value", http.StatusBadRequest)
-			return
-		}
-
-		switch v := rawVal.(type) {
-		case string:
-			err := db.Put(key, v)
-			if err != nil {
-				http.Error(w, "put error", http.StatusInternalServerError)
-			}
-		case float64:
-			err := db.PutInt64(key, int64(v))
-			if err != nil {
-				http.Error(w, "put error", http.StatusInternalServerError)
-			}
-		default:
-			http.Error(w, "invalid value type", http.StatusBadRequest)
+	if *compactWindow != "" {
+		start, end, err := parseWindow(*compactWindow)
+		if err != nil {
+			return nil, err
 		}
-
-	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		policy.WindowStart, policy.WindowEnd = start, end
 	}
-}
-
-func handleSomeData(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("key")
-	if key == "" {
-		http.Error(w, "missing key", http.StatusBadRequest)
-		return
+	opts := []datastore.Option{
+		datastore.WithCompactionPolicy(policy),
+		datastore.WithHistory(datastore.HistoryPolicy{
+			Versions: *historyVersions,
+			Window:   *historyWindow,
+		}),
+		datastore.WithWriteQueue(*writeQueue),
+		datastore.WithListener(logListener{log: slog.Default()}),
 	}
-
-	typ := r.URL.Query().Get("type")
-	if typ == "" {
-		typ = "string"
+	if *shedWrites {
+		opts = append(opts, datastore.NonBlocking())
 	}
-
-	switch typ {
-	case "string":
-		value, err := db.Get(key)
-		if err != nil {
-			http.Error(w, "", http.StatusNotFound)
-			return
+	if *compactIndex {
+		opts = append(opts, datastore.WithCompactIndex())
+	}
+	switch {
+	case *engine == "lsm" && *partitions > 1:
+		return nil, fmt.Errorf("the lsm engine does not support partitions")
+	case *engine == "lsm":
+		if name := setFlag(hashOnlyFlags); name != "" {
+			return nil, fmt.Errorf("-%s is not supported by the lsm engine", name)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]string{
-			"key":   key,
-			"value": value,
-		})
+		return datastore.OpenLSM(dir, datastore.WithListener(logListener{log: slog.Default()}), datastore.WithMemtableSize(*memtable))
+	case *engine != "hash":
+		return nil, fmt.Errorf("unknown engine %q", *engine)
+	case *partitions > 1:
+		return datastore.OpenSharded(dir, *partitions, opts...)
+	}
+	return datastore.Open(dir, opts...)
+}
 
-	case "int64":
-		value, err := db.GetInt64(key)
-		if err != nil {
-			http.Error(w, "", http.StatusNotFound)
-			return
+// setFlag returns the first of names given on the command line, or "".
+func setFlag(names []string) string {
+	var set string
+	flag.Visit(func(f *flag.Flag) {
+		if set == "" && slices.Contains(names, f.Name) {
+			set = f.Name
 		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]interface{}{
-			"key":   key,
-			"value": value,
-		})
+	})
+	return set
+}
 
-	default:
-		http.Error(w, "unsupported type", http.StatusBadRequest)
+// parseWindow parses "HH:MM-HH:MM" into offsets from midnight.
+func parseWindow(s string) (time.Duration, time.Duration, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid compaction window %q", s)
+	}
+	start, err := time.Parse("15:04", from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid compaction window %q: %w", s, err)
+	}
+	end, err := time.Parse("15:04", to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid compaction window %q: %w", s, err)
+	}
+	sinceMidnight := func(t time.Time) time.Duration {
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
 	}
+	return sinceMidnight(start), sinceMidnight(end), nil
 }
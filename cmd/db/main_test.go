@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setFlags sets command line flags for the rest of the test.
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		old := flag.Lookup(name).Value.String()
+		require.NoError(t, flag.Set(name, value))
+		t.Cleanup(func() { _ = flag.Set(name, old) })
+	}
+}
+
+func TestOpenStoreLSM(t *testing.T) {
+	setFlags(t, map[string]string{"engine": "lsm"})
+	store, err := openStore(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, store.Put("k", "v"))
+	require.NoError(t, store.Close())
+
+	setFlags(t, map[string]string{"history-versions": "2"})
+	_, err = openStore(t.TempDir())
+	assert.ErrorContains(t, err, "-history-versions is not supported by the lsm engine")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+)
+
+// defaultVisibility is how long a leased message stays hidden when the
+// client does not ask for a visibility timeout.
+const defaultVisibility = 30 * time.Second
+
+// workQueue is implemented by stores with durable queues.
+type workQueue interface {
+	Enqueue(name string, body []byte) (uint64, error)
+	Lease(name string, visibility time.Duration) (datastore.Message, error)
+	Ack(name string, id, receipt uint64) error
+	Nack(name string, id, receipt uint64, delay time.Duration) error
+}
+
+// handleQueue serves the queue under /queue/{name}:
+//
+//	POST /queue/{name}                                enqueue a {"body": "..."} message
+//	POST /queue/{name}/lease?visibility=30s           lease the oldest ready message
+//	POST /queue/{name}/ack/{id}?receipt=1             remove a leased message
+//	POST /queue/{name}/nack/{id}?receipt=1&delay=0s   hand a leased message back
+//
+// Ack and nack take the receipt the lease returned. A lease on a queue with
+// no ready message gets 204 No Content.
+func handleQueue(store datastore.Store, w http.ResponseWriter, r *http.Request) {
+	q, ok := store.(workQueue)
+	if !ok {
+		http.Error(w, "queues are not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/queue/"), "/")
+	name := parts[0]
+	if name == "" {
+		http.Error(w, "missing queue name", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		var data struct {
+			Body *string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Body == nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		id, err := q.Enqueue(name, []byte(*data.Body))
+		if err != nil {
+			queueFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"id": id})
+
+	case len(parts) == 2 && parts[1] == "lease":
+		visibility, ok := durationParam(w, r, "visibility", defaultVisibility)
+		if !ok {
+			return
+		}
+		if visibility == 0 {
+			http.Error(w, "invalid visibility", http.StatusBadRequest)
+			return
+		}
+		msg, err := q.Lease(name, visibility)
+		if errors.Is(err, datastore.ErrQueueEmpty) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			queueFailed(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":          msg.ID,
+			"body":        string(msg.Body),
+			"attempts":    msg.Attempts,
+			"receipt":     msg.Receipt,
+			"leasedUntil": msg.LeasedUntil.UTC(),
+		})
+
+	case len(parts) == 3 && (parts[1] == "ack" || parts[1] == "nack"):
+		id, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid message id", http.StatusBadRequest)
+			return
+		}
+		receipt, err := strconv.ParseUint(r.URL.Query().Get("receipt"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid receipt", http.StatusBadRequest)
+			return
+		}
+		if parts[1] == "ack" {
+			err = q.Ack(name, id, receipt)
+		} else {
+			delay, ok := durationParam(w, r, "delay", 0)
+			if !ok {
+				return
+			}
+			err = q.Nack(name, id, receipt, delay)
+		}
+		if err != nil {
+			queueFailed(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "", http.StatusNotFound)
+	}
+}
+
+// durationParam reads a non-negative duration from the query, answering 400
+// if it is invalid.
+func durationParam(w http.ResponseWriter, r *http.Request, name string, def time.Duration) (time.Duration, bool) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		http.Error(w, "invalid "+name, http.StatusBadRequest)
+		return 0, false
+	}
+	return d, true
+}
+
+// queueFailed maps queue errors to a status. Acking a message whose lease
+// ran out or whose receipt is stale is a conflict, the message may already be
+// with another worker.
+func queueFailed(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		http.Error(w, "", http.StatusNotFound)
+	case errors.Is(err, datastore.ErrNotLeased):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, datastore.ErrInvalidBucket):
+		http.Error(w, "invalid queue name", http.StatusBadRequest)
+	default:
+		writeFailed(w, err, "queue error")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openDiskHandler serves a datastore in a temporary directory.
+func openDiskHandler(t *testing.T) http.Handler {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return newHandler(db)
+}
+
+func TestHandleQueue(t *testing.T) {
+	h := openDiskHandler(t)
+
+	rec := doRequest(h, http.MethodPost, "/queue/jobs", `{"body": "resize 1.png"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	doRequest(h, http.MethodPost, "/queue/jobs", `{"body": "resize 2.png"}`)
+
+	var msg struct {
+		ID       uint64 `json:"id"`
+		Body     string `json:"body"`
+		Attempts int    `json:"attempts"`
+		Receipt  uint64 `json:"receipt"`
+	}
+	rec = doRequest(h, http.MethodPost, "/queue/jobs/lease?visibility=1m", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msg))
+	assert.Equal(t, "resize 1.png", msg.Body)
+	assert.Equal(t, 1, msg.Attempts)
+	first, firstReceipt := msg.ID, msg.Receipt
+
+	rec = doRequest(h, http.MethodPost, "/queue/jobs/lease", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msg))
+	assert.Equal(t, "resize 2.png", msg.Body)
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodPost, "/queue/jobs/lease", "").Code)
+
+	ack := fmt.Sprintf("/queue/jobs/ack/%d?receipt=%d", first, firstReceipt)
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodPost, ack, "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(h, http.MethodPost, ack, "").Code)
+	stale := msg.Receipt
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodPost, fmt.Sprintf("/queue/jobs/nack/%d?receipt=%d", msg.ID, stale), "").Code)
+	assert.Equal(t, http.StatusConflict, doRequest(h, http.MethodPost, fmt.Sprintf("/queue/jobs/ack/%d?receipt=%d", msg.ID, stale), "").Code)
+
+	rec = doRequest(h, http.MethodPost, "/queue/jobs/lease", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msg))
+	assert.Equal(t, 2, msg.Attempts)
+	assert.Equal(t, http.StatusConflict, doRequest(h, http.MethodPost, fmt.Sprintf("/queue/jobs/ack/%d?receipt=%d", msg.ID, stale), "").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(h, http.MethodPost, fmt.Sprintf("/queue/jobs/ack/%d?receipt=%d", msg.ID, msg.Receipt), "").Code)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/queue/jobs", `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/queue/jobs/lease?visibility=soon", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/queue/jobs/lease?visibility=0s", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/queue/jobs/ack/1", "").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPost, "/queue/jobs/ack/x", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(h, http.MethodGet, "/queue/jobs", "").Code)
+	assert.Equal(t, http.StatusNotImplemented, doRequest(newHandler(datastore.NewMemStore()), http.MethodPost, "/queue/jobs", `{"body": ""}`).Code)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+)
+
+var (
+	dir = flag.String("dir", "db-data", "datastore directory")
+
+	historyVersions = flag.Int("history-versions", 0, "previous versions of every key kept through compaction")
+	historyWindow   = flag.Duration("history-window", 0, "keep versions that were current within this long of a compaction")
+	mergeOperator   = flag.String("merge-operator", "", "merge operator of the datastore, used by compact and get: int64add, append or jsonpatch")
+	mergeSeparator  = flag.String("merge-separator", ",", "separator of the append merge operator")
+)
+
+const usage = `usage: dbtool [-dir path] <command> [args]
+
+commands:
+  dump          print every record with its offset, sequence number, write
+                time, type and checksum
+  verify        scan the data file and report corruption
+  compact       compact the data file offline, keeping the history that
+                -history-versions and -history-window ask for and folding
+                merge operands with -merge-operator
+  stats         print live and dead bytes
+  get <key>     print the value stored under key, use bucket/key for
+                a key inside a bucket; merge operands are folded with
+                -merge-operator
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd := flag.Arg(0); cmd {
+	case "dump":
+		err = dump(os.Stdout)
+	case "verify":
+		err = verify(os.Stdout)
+	case "compact":
+		err = compact(os.Stdout)
+	case "stats":
+		err = stats(os.Stdout)
+	case "get":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = get(os.Stdout, strings.Replace(flag.Arg(1), "/", datastore.BucketSeparator, 1))
+	default:
+		log.Printf("unknown command %q", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dump(w io.Writer) error {
+	return datastore.Scan(*dir, func(rec datastore.Record) error {
+		written := "-"
+		if !rec.Time.IsZero() {
+			written = rec.Time.UTC().Format(time.RFC3339Nano)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%s\t%q\t%s\n",
+			rec.Offset, rec.Size, rec.Seq, written, rec.Type, hex.EncodeToString(rec.Checksum), rec.Key, formatValue(rec.Type, rec.Value))
+		return nil
+	})
+}
+
+func verify(w io.Writer) error {
+	records := 0
+	err := datastore.Scan(*dir, func(datastore.Record) error {
+		records++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("verify failed after %d good records: %w", records, err)
+	}
+	fmt.Fprintf(w, "ok: %d records\n", records)
+	return nil
+}
+
+func compact(w io.Writer) error {
+	before, err := datastore.Stat(*dir)
+	if err != nil {
+		return err
+	}
+
+	opts := []datastore.Option{
+		datastore.WithHistory(datastore.HistoryPolicy{
+			Versions: *historyVersions,
+			Window:   *historyWindow,
+		}),
+	}
+	op, err := mergeOperatorFlag()
+	if err != nil {
+		return err
+	}
+	if op != nil {
+		opts = append(opts, datastore.WithMergeOperator(op))
+	}
+	db, err := datastore.Open(*dir, opts...)
+	if err != nil {
+		return err
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		_ = db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	after, err := datastore.Stat(*dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "compacted: %d -> %d records, %d bytes reclaimed\n",
+		before.Records, after.Records, before.LiveBytes+before.DeadBytes-after.LiveBytes-after.DeadBytes)
+	return nil
+}
+
+// mergeOperatorFlag returns the operator named by -merge-operator, or nil
+// if none is set.
+func mergeOperatorFlag() (datastore.MergeOperator, error) {
+	switch *mergeOperator {
+	case "":
+		return nil, nil
+	case "int64add":
+		return datastore.Int64Add(), nil
+	case "append":
+		return datastore.StringAppend(*mergeSeparator), nil
+	case "jsonpatch":
+		return datastore.JSONMergePatch(), nil
+	}
+	return nil, fmt.Errorf("unknown merge operator %q", *mergeOperator)
+}
+
+func stats(w io.Writer) error {
+	s, err := datastore.Stat(*dir)
+	if err != nil {
+		return err
+	}
+	total := s.LiveBytes + s.DeadBytes
+	fmt.Fprintf(w, "format version: %d\n", s.Version)
+	fmt.Fprintf(w, "records:        %d\n", s.Records)
+	fmt.Fprintf(w, "keys:           %d\n", s.Keys)
+	fmt.Fprintf(w, "live bytes:     %d\n", s.LiveBytes)
+	fmt.Fprintf(w, "dead bytes:     %d\n", s.DeadBytes)
+	if total > 0 {
+		fmt.Fprintf(w, "dead ratio:     %.1f%%\n", float64(s.DeadBytes)*100/float64(total))
+	}
+	return nil
+}
+
+func get(w io.Writer, key string) error {
+	// chain holds the last value or delete of key and the merge operands
+	// written after it.
+	var chain []datastore.Record
+	err := datastore.Scan(*dir, func(rec datastore.Record) error {
+		if rec.Key == key {
+			if strings.HasPrefix(rec.Type, datastore.MergeTypePrefix) {
+				chain = append(chain, rec)
+			} else {
+				chain = []datastore.Record{rec}
+			}
+		}
+		if rec.Type == datastore.TypeDropBucket && strings.HasPrefix(key, rec.Key+datastore.BucketSeparator) {
+			chain = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(chain) > 0 && chain[0].Type == datastore.TypeTombstone {
+		chain = chain[1:]
+	}
+	if len(chain) == 0 {
+		return datastore.ErrNotFound
+	}
+	if len(chain) == 1 && !strings.HasPrefix(chain[0].Type, datastore.MergeTypePrefix) {
+		fmt.Fprintln(w, formatValue(chain[0].Type, chain[0].Value))
+		return nil
+	}
+
+	typ, value, err := fold(key, chain)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, formatValue(typ, value))
+	return nil
+}
+
+// fold applies the merge operands of chain to its leading value, if there is
+// one, with the operator named by -merge-operator.
+func fold(key string, chain []datastore.Record) (string, []byte, error) {
+	op, err := mergeOperatorFlag()
+	if err != nil {
+		return "", nil, err
+	}
+	last := chain[len(chain)-1]
+	if op == nil {
+		return "", nil, fmt.Errorf("%q has unfolded operands of %s, set -merge-operator to fold them",
+			key, strings.TrimPrefix(last.Type, datastore.MergeTypePrefix))
+	}
+
+	var existing []byte
+	if first := chain[0]; !strings.HasPrefix(first.Type, datastore.MergeTypePrefix) {
+		if first.Type != op.Type() {
+			return "", nil, fmt.Errorf("%w: expected %s, got %s", datastore.ErrTypeMismatch, op.Type(), first.Type)
+		}
+		existing, chain = first.Value, chain[1:]
+	}
+	operands := make([][]byte, len(chain))
+	for i, rec := range chain {
+		if rec.Type != datastore.MergeTypePrefix+op.Name() {
+			return "", nil, fmt.Errorf("%w: operand of %s, operator %s",
+				datastore.ErrTypeMismatch, strings.TrimPrefix(rec.Type, datastore.MergeTypePrefix), op.Name())
+		}
+		operands[i] = rec.Value
+	}
+	value, err := op.Merge(key, existing, operands)
+	if err != nil {
+		return "", nil, fmt.Errorf("merge %q: %w", key, err)
+	}
+	return op.Type(), value, nil
+}
+
+func formatValue(typ string, value []byte) string {
+	if typ == datastore.TypeInt64 && len(value) == 8 {
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(value)), 10)
+	}
+	return strconv.Quote(string(value))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/ProMKQ/kpi-lab5/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestDir fills a temporary datastore and points -dir at it.
+func openTestDir(t *testing.T) {
+	t.Helper()
+	d := t.TempDir()
+	db, err := datastore.Open(d)
+	require.NoError(t, err)
+	require.NoError(t, db.Put("name", "old"))
+	require.NoError(t, db.Put("name", "Ann"))
+	require.NoError(t, db.PutInt64("count", 42))
+	require.NoError(t, db.Put("gone", "v"))
+	require.NoError(t, db.Delete("gone"))
+	require.NoError(t, db.Bucket("users").Put("u1", "Bob"))
+	require.NoError(t, db.Close())
+
+	old := *dir
+	*dir = d
+	t.Cleanup(func() { *dir = old })
+}
+
+// setFlags sets command line flags for the rest of the test.
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		old := flag.Lookup(name).Value.String()
+		require.NoError(t, flag.Set(name, value))
+		t.Cleanup(func() { _ = flag.Set(name, old) })
+	}
+}
+
+func TestDump(t *testing.T) {
+	openTestDir(t)
+	var out bytes.Buffer
+	require.NoError(t, dump(&out))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 6)
+	assert.Contains(t, lines[0], "\tstring\t")
+	assert.Contains(t, lines[0], "\t\"name\"\t\"old\"")
+	assert.Contains(t, lines[2], "\tint64\t")
+	assert.Contains(t, lines[2], "\t\"count\"\t42")
+	assert.Contains(t, lines[4], "\ttombstone\t")
+	assert.Contains(t, lines[5], `"users\x00u1"`)
+}
+
+func TestVerifyAndStats(t *testing.T) {
+	openTestDir(t)
+	var out bytes.Buffer
+	require.NoError(t, verify(&out))
+	assert.Equal(t, "ok: 6 records\n", out.String())
+
+	out.Reset()
+	require.NoError(t, stats(&out))
+	assert.Contains(t, out.String(), "records:        6\n")
+	assert.Contains(t, out.String(), "keys:           3\n")
+	assert.Contains(t, out.String(), "dead ratio:")
+}
+
+func TestGet(t *testing.T) {
+	openTestDir(t)
+	for key, want := range map[string]string{
+		"name":     "\"Ann\"\n",
+		"count":    "42\n",
+		"users/u1": "\"Bob\"\n",
+	} {
+		var out bytes.Buffer
+		require.NoError(t, get(&out, strings.Replace(key, "/", datastore.BucketSeparator, 1)), key)
+		assert.Equal(t, want, out.String(), key)
+	}
+	assert.ErrorIs(t, get(&bytes.Buffer{}, "gone"), datastore.ErrNotFound)
+	assert.ErrorIs(t, get(&bytes.Buffer{}, "missing"), datastore.ErrNotFound)
+}
+
+func TestCompact(t *testing.T) {
+	openTestDir(t)
+	setFlags(t, map[string]string{"history-versions": "1"})
+	var out bytes.Buffer
+	require.NoError(t, compact(&out))
+	assert.Equal(t, "compacted: 6 -> 6 records, 0 bytes reclaimed\n", out.String())
+
+	db, err := datastore.Open(*dir, datastore.WithHistory(datastore.HistoryPolicy{Versions: 1}))
+	require.NoError(t, err)
+	defer db.Close()
+	versions, err := db.History("name")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "old", string(versions[0].Value))
+	assert.Equal(t, "Ann", string(versions[1].Value))
+}
+
+func TestCompactMerge(t *testing.T) {
+	d := t.TempDir()
+	db, err := datastore.Open(d, datastore.WithMergeOperator(datastore.StringAppend(";")))
+	require.NoError(t, err)
+	require.NoError(t, db.Put("tags", "a"))
+	require.NoError(t, db.Merge("tags", []byte("b")))
+	require.NoError(t, db.Close())
+	old := *dir
+	*dir = d
+	t.Cleanup(func() { *dir = old })
+
+	setFlags(t, map[string]string{"merge-operator": "sum"})
+	assert.ErrorContains(t, compact(&bytes.Buffer{}), `unknown merge operator "sum"`)
+
+	setFlags(t, map[string]string{"merge-operator": "append", "merge-separator": ";"})
+	require.NoError(t, compact(&bytes.Buffer{}))
+	var out bytes.Buffer
+	require.NoError(t, dump(&out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "\t\"tags\"\t\"a;b\"")
+}
+
+func TestGetMerge(t *testing.T) {
+	d := t.TempDir()
+	db, err := datastore.Open(d, datastore.WithMergeOperator(datastore.Int64Add()))
+	require.NoError(t, err)
+	require.NoError(t, db.PutInt64("hits", 40))
+	require.NoError(t, db.Merge("hits", binary.LittleEndian.AppendUint64(nil, 1)))
+	require.NoError(t, db.Merge("hits", binary.LittleEndian.AppendUint64(nil, 2)))
+	require.NoError(t, db.Close())
+	old := *dir
+	*dir = d
+	t.Cleanup(func() { *dir = old })
+
+	assert.ErrorContains(t, get(&bytes.Buffer{}, "hits"), `"hits" has unfolded operands of int64add, set -merge-operator`)
+	setFlags(t, map[string]string{"merge-operator": "append"})
+	assert.ErrorIs(t, get(&bytes.Buffer{}, "hits"), datastore.ErrTypeMismatch)
+
+	setFlags(t, map[string]string{"merge-operator": "int64add"})
+	var out bytes.Buffer
+	require.NoError(t, get(&out, "hits"))
+	assert.Equal(t, "43\n", out.String())
+}
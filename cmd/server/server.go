@@ -2,16 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/ProMKQ/kpi-lab5/httptools"
+	"github.com/ProMKQ/kpi-lab5/lockclient"
 	"github.com/ProMKQ/kpi-lab5/signal"
 )
 
@@ -20,9 +25,19 @@ var port = flag.Int("port", 8080, "server port")
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
-const dbURL = "http://db:8981/db"
+const dbAddress = "http://db:8081"
+const dbURL = dbAddress + "/db"
+const dbBucket = "servers"
 const teamName = "dmwteam"
 
+// seedLockTTL keeps the other servers from repeating the seed post for a while
+// after one of them made it.
+const seedLockTTL = time.Minute
+
+// seedRetryMax caps the wait between attempts to take the seed lock while the
+// db is unreachable.
+const seedRetryMax = 30 * time.Second
+
 func main() {
 	flag.Parse()
 	h := new(http.ServeMux)
@@ -38,10 +53,13 @@ func main() {
 		}
 	})
 	go func() {
-		time.Sleep(1 * time.Second)
-		now := time.Now().Format("2006-01-02")
-		payload, _ := json.Marshal(map[string]string{"value": now})
-		_, _ = http.Post(fmt.Sprintf("%s/%s", dbURL, teamName), "application/json", bytes.NewBuffer(payload))
+		owner, _ := os.Hostname()
+		locks := lockclient.New(dbAddress, fmt.Sprintf("%s:%d", owner, *port))
+		seed(context.Background(), locks, time.Second, func() {
+			now := time.Now().Format("2006-01-02")
+			payload, _ := json.Marshal(map[string]string{"value": now})
+			_, _ = http.Post(fmt.Sprintf("%s/%s/%s", dbURL, dbBucket, teamName), "application/json", bytes.NewBuffer(payload))
+		})
 	}()
 
 	h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
@@ -56,7 +74,7 @@ func main() {
 			return
 		}
 
-		resp, err := http.Get(fmt.Sprintf("%s/%s", dbURL, key))
+		resp, err := http.Get(fmt.Sprintf("%s/%s/%s", dbURL, dbBucket, url.PathEscape(key)))
 		if err != nil || resp.StatusCode != http.StatusOK {
 			http.NotFound(rw, r)
 			return
@@ -79,3 +97,27 @@ func main() {
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+// seed runs post on the one server that takes the seed lock. Every server
+// starts with the same seed; the lock is left to expire rather than released.
+// Until the lock is taken or held by another server, for instance while the
+// db is still starting, taking it is retried with a growing delay.
+func seed(ctx context.Context, locks *lockclient.Client, delay time.Duration, post func()) {
+	for {
+		_, err := locks.Acquire(ctx, "seed-"+teamName, seedLockTTL)
+		if err == nil {
+			post()
+			return
+		}
+		if errors.Is(err, lockclient.ErrHeld) {
+			return
+		}
+		log.Printf("seed lock: %s, retrying in %s", err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, seedRetryMax)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ProMKQ/kpi-lab5/lockclient"
+)
+
+func TestSeedRetriesUntilTheDbIsUp(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"name": "seed-dmwteam", "owner": "s1", "token": 1}`))
+	}))
+	defer srv.Close()
+
+	posted := false
+	seed(context.Background(), lockclient.New(srv.URL, "s1"), time.Millisecond, func() { posted = true })
+	if !posted || calls.Load() != 3 {
+		t.Errorf("posted = %v after %d calls, want a post after 3", posted, calls.Load())
+	}
+}
+
+func TestSeedSkipsHeldLock(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "held", http.StatusConflict)
+	}))
+	defer srv.Close()
+
+	seed(context.Background(), lockclient.New(srv.URL, "s2"), time.Millisecond, func() {
+		t.Error("posted the seed while another server holds the lock")
+	})
+}
@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// typeBatch wraps the records of a Batch into a single record, so the whole
+// batch is covered by one checksum.
+// The wrapped records keep their own layout, so the index points straight at
+// them and compaction copies them out as standalone records.
+const typeBatch = "batch"
+
+// batchValueOffset is where the value of a batch record (empty key) starts.
+const batchValueOffset = 4 + 4 + 4
+
+// Batch collects writes that are applied atomically by Db.Write.
+type Batch struct {
+	entries []entry
+}
+
+func (b *Batch) Put(key, value string) {
+	b.entries = append(b.entries, entry{key: key, value: []byte(value), Type: typeString})
+}
+
+func (b *Batch) PutInt64(key string, value int64) {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(value))
+	b.entries = append(b.entries, entry{key: key, value: data, Type: typeInt64})
+}
+
+// PutTyped adds a raw value tagged with typ, see TypedStore.
+func (b *Batch) PutTyped(key, typ string, value []byte) {
+	b.entries = append(b.entries, entry{key: key, value: value, Type: typ})
+}
+
+// Delete removes key. Unlike Db.Delete, deleting a missing key is not an error.
+func (b *Batch) Delete(key string) {
+	b.entries = append(b.entries, entry{key: key, Type: typeTombstone})
+}
+
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// check validates every entry before any of them is written.
+func (b *Batch) check() error {
+	for _, e := range b.entries {
+		if err := checkKey(e.key); err != nil {
+			return err
+		}
+		if e.Type == typeTombstone {
+			continue
+		}
+		if err := checkTyped(e.Type, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write applies every write of the batch atomically: readers see either none
+// or all of them, and a batch torn by a crash is detected as one corrupted
+// record rather than recovered halfway.
+func (db *Db) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := b.check(); err != nil {
+		return err
+	}
+	return db.send(writeRequest{op: func() error {
+		return db.writeBatch(b.entries)
+	}})
+}
+
+func (db *Db) writeBatch(entries []entry) error {
+	sizes := make([]int64, len(entries))
+	now := db.now().UnixNano()
+	encode := func() []byte {
+		var value []byte
+		for i := range entries {
+			entries[i].seq = db.seq + uint64(i) + 1
+			entries[i].ts = now
+			db.header.prepare(&entries[i])
+			record := entries[i].Encode()
+			sizes[i] = int64(len(record))
+			value = append(value, record...)
+		}
+		e := entry{value: value, Type: typeBatch}
+		db.header.prepare(&e)
+		return e.Encode()
+	}
+
+	data := encode()
+	if int64(len(data)) > db.maxRecordSize {
+		return db.writeFailed("", ErrTooLarge)
+	}
+	if db.segmentSizeLimit > 0 && db.outOffset+int64(len(data)) > db.segmentSizeLimit {
+		if err := db.rollSegment(); err != nil {
+			return db.writeFailed("", err)
+		}
+		data = encode()
+	}
+
+	n, err := db.out.Write(data)
+	if err != nil {
+		return db.writeFailed("", db.discardTail(err))
+	}
+
+	db.muIndex.Lock()
+	defer db.muIndex.Unlock()
+	offset := db.outOffset + batchValueOffset
+	db.outOffset += int64(n)
+	for _, e := range entries {
+		db.seq = max(db.seq, e.seq)
+	}
+	for i, e := range entries {
+		if err := db.applyRecord(e.key, e.Type, offset, sizes[i]); err != nil {
+			return db.writeFailed("", err)
+		}
+		db.updateSecondary(e.key, e.Type, e.value)
+		offset += sizes[i]
+	}
+	return nil
+}
+
+// splitBatch calls fn for every record wrapped in the value of a batch record,
+// with the record's offset inside the value and its size.
+func splitBatch(value []byte, fn func(offset, size int64, e entry)) error {
+	for offset := 0; offset < len(value); {
+		if len(value)-offset < 4 {
+			return fmt.Errorf("truncated batch at %d", offset)
+		}
+		size := int(binary.LittleEndian.Uint32(value[offset:]))
+		if size < 4 || offset+size > len(value) {
+			return fmt.Errorf("invalid record size %d in batch at %d", size, offset)
+		}
+		var e entry
+		if err := e.Decode(value[offset : offset+size]); err != nil {
+			return fmt.Errorf("batch record at %d: %w", offset, err)
+		}
+		fn(int64(offset), int64(size), e)
+		offset += size
+	}
+	return nil
+}
+
+// applyBatch indexes the records of a batch record stored at offset.
+func (db *Db) applyBatch(batch entry, offset int64) error {
+	var applyErr error
+	err := splitBatch(batch.value, func(inner, size int64, e entry) {
+		if applyErr == nil {
+			applyErr = db.applyRecord(e.key, e.Type, offset+batchValueOffset+inner, size)
+			db.seq = max(db.seq, e.seq)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return applyErr
+}
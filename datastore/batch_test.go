@@ -0,0 +1,65 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestBatchRecoveryAndCompaction(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	for i := 0; i < 10; i++ {
+		b.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	b.Delete("key9")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := 0
+	if err := Scan(tmp, func(rec Record) error {
+		records++
+		if rec.Type == typeBatch {
+			t.Errorf("Scan returned the batch wrapper")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if records != 11 {
+		t.Errorf("Scan returned %d records, want 11", records)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	check := func() {
+		t.Helper()
+		for i := 0; i < 9; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if val, err := db.Get(key); err != nil || val != fmt.Sprintf("value%d", i) {
+				t.Errorf("Get(%s) = %q, %v", key, val, err)
+			}
+		}
+		if _, err := db.Get("key9"); err == nil {
+			t.Errorf("key9 was deleted in the batch")
+		}
+	}
+	check()
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// typeBytes holds raw values written through PutStream.
+const typeBytes = "bytes"
+
+var ErrTooLarge = errors.New("value is too large")
+
+// PutStream stores exactly size bytes read from r under key without holding
+// the value in memory. The value is spooled to a temporary file first, so a
+// slow r does not hold up other writers.
+func (db *Db) PutStream(key string, r io.Reader, size int64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if size < 0 || streamedSize(&entry{key: key, Type: typeBytes, seq: 1, ts: 1}, size, true) > db.maxRecordSize {
+		return ErrTooLarge
+	}
+
+	spool, err := db.fs.CreateTemp(db.dir, "blob-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer db.fs.Remove(spool.Name())
+	defer spool.Close()
+
+	n, err := io.Copy(spool, io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("PutStream: got %d of %d bytes: %w", n, size, io.ErrUnexpectedEOF)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return db.send(writeRequest{
+		key:  key,
+		typ:  typeBytes,
+		blob: spool,
+		size: size,
+	})
+}
+
+func (db *Db) writeStream(key string, value io.Reader, size int64) error {
+	e := entry{key: key, Type: typeBytes}
+	layout := func() bool {
+		e.seq, e.ts = db.seq+1, db.now().UnixNano()
+		db.header.prepare(&e)
+		return db.header.flags&flagChecksum != 0
+	}
+	checksum := layout()
+	if db.segmentSizeLimit > 0 && db.outOffset+streamedSize(&e, size, checksum) > db.segmentSizeLimit {
+		if err := db.rollSegment(); err != nil {
+			return db.writeFailed(key, err)
+		}
+		checksum = layout()
+	}
+
+	out := bufio.NewWriter(db.out)
+	n, err := encodeStream(out, &e, value, size, checksum)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		return db.writeFailed(key, db.discardTail(err))
+	}
+	if err := db.commit(key, typeBytes, nil, n, e.seq); err != nil {
+		return db.writeFailed(key, err)
+	}
+	return nil
+}
+
+// GetStream returns a reader over the value stored under key. The value is
+// read from disk as the caller consumes it and its checksum is verified once
+// the reader reaches the end.
+func (db *Db) GetStream(key string) (io.ReadCloser, error) {
+	file, position, ops, err := db.openRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	if ops != nil {
+		// Folded values are built in memory, there is nothing to stream.
+		_ = file.Close()
+		record, err := db.readEntry(key)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(record.value)), nil
+	}
+	r, err := newValueReader(file, position)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+type valueReader struct {
+	file     File
+	value    io.Reader
+	hash     hash.Hash
+	checksum []byte
+}
+
+func newValueReader(file File, position int64) (*valueReader, error) {
+	buf := make([]byte, 8)
+	if _, err := file.ReadAt(buf, position); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(buf))
+	kl := int64(binary.LittleEndian.Uint32(buf[4:]))
+
+	valueAt := position + 8 + kl + 4
+	if _, err := file.ReadAt(buf[:4], valueAt-4); err != nil {
+		return nil, err
+	}
+	vl := int64(binary.LittleEndian.Uint32(buf))
+
+	if _, err := file.ReadAt(buf[:4], valueAt+vl); err != nil {
+		return nil, err
+	}
+	tl := int64(binary.LittleEndian.Uint32(buf))
+	checksumAt := valueAt + vl + 4 + tl
+	meta, _, _ := trailer(position + size - checksumAt)
+	checksumAt += meta
+	checksum := make([]byte, position+size-checksumAt)
+	if _, err := file.ReadAt(checksum, checksumAt); err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	return &valueReader{
+		file:     file,
+		value:    io.TeeReader(io.NewSectionReader(file, valueAt, vl), h),
+		hash:     h,
+		checksum: checksum,
+	}, nil
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	n, err := r.value.Read(p)
+	if errors.Is(err, io.EOF) && len(r.checksum) > 0 && !bytes.Equal(r.hash.Sum(nil), r.checksum) {
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+func (r *valueReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutGetStreamLarge(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const size = 20 << 20
+	expected := sha1.New()
+	src := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(1)), size), expected)
+	if err := db.PutStream("artifact", src, size); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		r, err := db.GetStream("artifact")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got := sha1.New()
+		n, err := io.Copy(got, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != size || !bytes.Equal(got.Sum(nil), expected.Sum(nil)) {
+			t.Errorf("GetStream returned %d bytes with a different hash", n)
+		}
+	}
+	check()
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	check()
+	if val, err := db.Get("small"); err != nil || val != "value" {
+		t.Errorf("Get(small) = %q, %v", val, err)
+	}
+
+	spooled, _ := filepath.Glob(filepath.Join(tmp, "blob-*"))
+	if len(spooled) != 0 {
+		t.Errorf("spool files left behind: %v", spooled)
+	}
+}
+
+func TestGetStreamDetectsCorruption(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	value := bytes.Repeat([]byte{'a'}, 1024)
+	if err := db.PutStream("k", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{'b'}, int64(bytes.Index(data, value)+10)); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	r, err := db.GetStream("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
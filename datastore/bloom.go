@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+const (
+	bloomBitsPerKey = 10
+	// bloomHashes is close to the optimum of bits per key times ln 2, which
+	// gives about 1% false positives.
+	bloomHashes = 7
+)
+
+// bloom is a Bloom filter over the keys of a table. It tells for certain that
+// a key is absent, so most lookups of missing keys never read the table.
+type bloom struct {
+	bits   []byte
+	hashes uint32
+}
+
+func newBloom(keys int) bloom {
+	n := max(keys*bloomBitsPerKey, 64)
+	return bloom{bits: make([]byte, (n+7)/8), hashes: bloomHashes}
+}
+
+// bloomHash splits one 64 bit hash in two for double hashing. It must not
+// change, filters are stored with the tables.
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (b bloom) add(key string) {
+	h1, h2 := bloomHash(key)
+	m := uint32(len(b.bits) * 8)
+	for i := uint32(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (b bloom) mayContain(key string) bool {
+	if len(b.bits) == 0 {
+		return true
+	}
+	h1, h2 := bloomHash(key)
+	m := uint32(len(b.bits) * 8)
+	for i := uint32(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// encode stores the number of hashes ahead of the bits.
+func (b bloom) encode() []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, b.hashes), b.bits...)
+}
+
+func decodeBloom(data []byte) (bloom, bool) {
+	if len(data) < 4 {
+		return bloom{}, false
+	}
+	return bloom{hashes: binary.LittleEndian.Uint32(data), bits: data[4:]}, true
+}
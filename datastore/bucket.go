@@ -0,0 +1,271 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Keys of a bucket are stored as name + bucketSeparator + key, so buckets
+// share the data file and the index with the default key space.
+const bucketSeparator = "\x00"
+
+// typeDropBucket records that every key of the bucket named by the record key
+// was removed. The dropped keys are only filtered out on read and purged by
+// the next compaction, so a drop costs a single record no matter how large
+// the bucket was.
+const typeDropBucket = "dropbucket"
+
+var ErrInvalidBucket = errors.New("invalid bucket name")
+
+func bucketPrefix(name string) string {
+	return name + bucketSeparator
+}
+
+func bucketOf(key string) (string, bool) {
+	name, _, ok := strings.Cut(key, bucketSeparator)
+	return name, ok
+}
+
+func validBucket(name string) bool {
+	return name != "" && !strings.Contains(name, bucketSeparator)
+}
+
+// reservedBucket reports whether the datastore keeps its own records in the
+// bucket called name: index definitions, queues and locks. Their state is
+// rebuilt from those records, so the key-value API must not touch them.
+func reservedBucket(name string) bool {
+	return name == indexBucket || name == lockBucket || strings.HasPrefix(name, queueBucketPrefix)
+}
+
+// reservedKey reports whether key lies in a reserved bucket.
+func reservedKey(key string) bool {
+	name, ok := bucketOf(key)
+	return ok && reservedBucket(name)
+}
+
+// checkKey rejects keys of reserved buckets written through the key-value
+// API.
+func checkKey(key string) error {
+	if reservedKey(key) {
+		name, _ := bucketOf(key)
+		return fmt.Errorf("%w: bucket %q is reserved", ErrInvalidBucket, name)
+	}
+	return nil
+}
+
+// userBucket reports whether name is a bucket the key-value API may use.
+func userBucket(name string) bool {
+	return validBucket(name) && !reservedBucket(name)
+}
+
+// bucketStats counts the keys of a bucket and the bytes of their records.
+type bucketStats struct {
+	keys  int
+	bytes int64
+}
+
+// droppedBuckets maps every bucket dropped since the last compaction to the
+// offset of its latest drop record. Keys of the bucket indexed at a lower
+// offset are dead: they stay in the index until compaction purges them.
+type droppedBuckets map[string]int64
+
+func (d droppedBuckets) dead(key string, offset int64) bool {
+	if len(d) == 0 {
+		return false
+	}
+	name, ok := bucketOf(key)
+	if !ok {
+		return false
+	}
+	at, ok := d[name]
+	return ok && offset < at
+}
+
+// end returns the offset of the latest drop record. No dead key is indexed
+// at or past it.
+func (d droppedBuckets) end() int64 {
+	var end int64
+	for _, at := range d {
+		end = max(end, at)
+	}
+	return end
+}
+
+// Bucket is a namespace inside a Store. It exposes the same key-value API,
+// with every key scoped to the bucket.
+type Bucket struct {
+	store  Store
+	name   string
+	prefix string
+}
+
+func newBucket(store Store, name string) *Bucket {
+	return &Bucket{store: store, name: name, prefix: bucketPrefix(name)}
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Len returns the number of keys in the bucket.
+func (b *Bucket) Len() int {
+	return b.store.Buckets()[b.name]
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	if !userBucket(b.name) {
+		return "", ErrInvalidBucket
+	}
+	return b.store.Get(b.prefix + key)
+}
+
+func (b *Bucket) Put(key, value string) error {
+	if !userBucket(b.name) {
+		return ErrInvalidBucket
+	}
+	return b.store.Put(b.prefix+key, value)
+}
+
+func (b *Bucket) GetInt64(key string) (int64, error) {
+	if !userBucket(b.name) {
+		return 0, ErrInvalidBucket
+	}
+	return b.store.GetInt64(b.prefix + key)
+}
+
+func (b *Bucket) PutInt64(key string, value int64) error {
+	if !userBucket(b.name) {
+		return ErrInvalidBucket
+	}
+	return b.store.PutInt64(b.prefix+key, value)
+}
+
+func (b *Bucket) PutStream(key string, r io.Reader, size int64) error {
+	if !userBucket(b.name) {
+		return ErrInvalidBucket
+	}
+	return b.store.PutStream(b.prefix+key, r, size)
+}
+
+func (b *Bucket) GetStream(key string) (io.ReadCloser, error) {
+	if !userBucket(b.name) {
+		return nil, ErrInvalidBucket
+	}
+	return b.store.GetStream(b.prefix + key)
+}
+
+func (b *Bucket) GetTyped(key string) ([]byte, string, error) {
+	if !userBucket(b.name) {
+		return nil, "", ErrInvalidBucket
+	}
+	return b.store.GetTyped(b.prefix + key)
+}
+
+func (b *Bucket) PutTyped(key, typ string, value []byte) error {
+	if !userBucket(b.name) {
+		return ErrInvalidBucket
+	}
+	return b.store.PutTyped(b.prefix+key, typ, value)
+}
+
+func (b *Bucket) GetWithMeta(key string) ([]byte, Meta, error) {
+	if !userBucket(b.name) {
+		return nil, Meta{}, ErrInvalidBucket
+	}
+	return b.store.GetWithMeta(b.prefix + key)
+}
+
+func (b *Bucket) Delete(key string) error {
+	if !userBucket(b.name) {
+		return ErrInvalidBucket
+	}
+	return b.store.Delete(b.prefix + key)
+}
+
+// Bucket returns a handle to the named bucket. Buckets need no creation: a
+// bucket exists while it holds keys.
+func (db *Db) Bucket(name string) *Bucket {
+	return newBucket(db, name)
+}
+
+// Buckets returns the number of keys in every non-empty bucket.
+func (db *Db) Buckets() map[string]int {
+	db.muIndex.RLock()
+	defer db.muIndex.RUnlock()
+	res := make(map[string]int, len(db.buckets))
+	for name, s := range db.buckets {
+		if !reservedBucket(name) {
+			res[name] = s.keys
+		}
+	}
+	return res
+}
+
+// DropBucket removes every key of the bucket.
+func (db *Db) DropBucket(name string) error {
+	if !userBucket(name) {
+		return ErrInvalidBucket
+	}
+	return db.write(name, nil, typeDropBucket)
+}
+
+// countKey adjusts the live bytes and the stats of the bucket that key
+// belongs to by keys and bytes.
+func (db *Db) countKey(key string, keys int, bytes int64) {
+	db.liveBytes += bytes
+	name, ok := bucketOf(key)
+	if !ok {
+		return
+	}
+	s := db.buckets[name]
+	s.keys += keys
+	s.bytes += bytes
+	if s.keys <= 0 {
+		delete(db.buckets, name)
+	} else {
+		db.buckets[name] = s
+	}
+}
+
+// indexGet looks key up in the index, skipping keys of dropped buckets.
+// Callers hold muIndex or have exclusive access to the db.
+func (db *Db) indexGet(key string) (recordPos, bool, error) {
+	pos, ok, err := db.index.get(key)
+	if ok && db.dropped.dead(key, pos.offset) {
+		return recordPos{}, false, nil
+	}
+	return pos, ok, err
+}
+
+// indexPut indexes key at pos and returns the live position it replaces.
+func (db *Db) indexPut(key string, pos recordPos) (recordPos, bool, error) {
+	old, ok, err := db.index.put(key, pos)
+	if ok {
+		db.supersede(key, old.offset)
+	}
+	if ok && db.dropped.dead(key, old.offset) {
+		db.deadKeys--
+		return recordPos{}, false, err
+	}
+	return old, ok, err
+}
+
+// indexRemove drops key from the index and returns its live position.
+func (db *Db) indexRemove(key string) (recordPos, bool, error) {
+	old, ok, err := db.index.remove(key)
+	if ok {
+		db.supersede(key, old.offset)
+	}
+	if ok && db.dropped.dead(key, old.offset) {
+		db.deadKeys--
+		return recordPos{}, false, err
+	}
+	return old, ok, err
+}
+
+// keyCount returns the number of live keys.
+func (db *Db) keyCount() int {
+	return db.index.len() - db.deadKeys
+}
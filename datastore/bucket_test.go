@@ -0,0 +1,236 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDropBucketSurvivesRecoveryAndCompaction(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, users := db.Bucket("logs"), db.Bucket("users")
+	for i := 0; i < 100; i++ {
+		if err := logs.Put(fmt.Sprintf("line%d", i), "text"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := users.Put("alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("logs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logs.Put("line0", "after drop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	check := func() {
+		t.Helper()
+		if counts := db.Buckets(); counts["logs"] != 1 || counts["users"] != 1 {
+			t.Errorf("unexpected bucket counts %v", counts)
+		}
+		if _, err := db.Bucket("logs").Get("line1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound for a dropped key, got %v", err)
+		}
+		if val, err := db.Bucket("logs").Get("line0"); err != nil || val != "after drop" {
+			t.Errorf("Get(line0) = %q, %v", val, err)
+		}
+	}
+	check()
+
+	before, _ := db.Size()
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := db.Size()
+	if after >= before {
+		t.Errorf("compaction did not reclaim the dropped bucket (before %d, after %d)", before, after)
+	}
+	check()
+}
+
+func TestDropBucketStats(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"hash index":    nil,
+		"compact index": {WithCompactIndex()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := Open(t.TempDir(), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Put("plain", "v"); err != nil {
+				t.Fatal(err)
+			}
+			empty := db.Stats()
+			logs := db.Bucket("logs")
+			for i := 0; i < 50; i++ {
+				if err := logs.Put(fmt.Sprintf("line%d", i), "text"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.DropBucket("logs"); err != nil {
+				t.Fatal(err)
+			}
+			if s := db.Stats(); s.Keys != 1 || s.LiveBytes != empty.LiveBytes {
+				t.Errorf("stats after drop = %+v, want the keys and bytes of %+v", s, empty)
+			}
+			if err := logs.Delete("line1"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Delete of a dropped key error = %v, want ErrNotFound", err)
+			}
+			if err := logs.Put("line2", "again"); err != nil {
+				t.Fatal(err)
+			}
+			if n := logs.Len(); n != 1 {
+				t.Errorf("Len after a put into a dropped bucket = %d, want 1", n)
+			}
+			live := db.Stats().LiveBytes
+
+			if err := db.Compact(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if s := db.Stats(); s.Keys != 2 || s.LiveBytes != live || s.DeadBytes != 0 {
+				t.Errorf("stats after compaction = %+v, want 2 keys and %d live bytes", s, live)
+			}
+			if v, err := logs.Get("line2"); err != nil || v != "again" {
+				t.Errorf("Get(line2) = %q, %v", v, err)
+			}
+		})
+	}
+}
+
+func TestDropBucketDuringCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Bucket("old").Put(fmt.Sprint(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Bucket("tail").Put(fmt.Sprint(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DropBucket("old"); err != nil {
+		t.Fatal(err)
+	}
+
+	var c *compaction
+	err = db.runOnWriter(context.Background(), func() (err error) {
+		c, err = db.startCompaction(0)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.copyLive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Dropped after the snapshot, its keys were copied and stay dead.
+	if err := db.DropBucket("tail"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Bucket("tail").Put("new", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.runOnWriter(context.Background(), c.finish); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		if counts := db.Buckets(); len(counts) != 1 || counts["tail"] != 1 {
+			t.Errorf("bucket counts = %v, want tail:1", counts)
+		}
+		if _, err := db.Bucket("tail").Get("3"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of a key dropped during compaction error = %v, want ErrNotFound", err)
+		}
+		if v, err := db.Bucket("tail").Get("new"); err != nil || v != "v" {
+			t.Errorf("Get(new) = %q, %v", v, err)
+		}
+		if s := db.Stats(); s.Keys != 1 {
+			t.Errorf("Stats().Keys = %d, want 1", s.Keys)
+		}
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestReservedBuckets(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateIndex("by_name", "name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Enqueue("jobs", []byte("job")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AcquireLock("seed", "server1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	var b Batch
+	b.Put(bucketPrefix(lockBucket)+"seed", "stolen")
+	for name, err := range map[string]error{
+		"drop index bucket":    db.DropBucket(indexBucket),
+		"drop queue bucket":    db.DropBucket(queueBucketPrefix + "jobs"),
+		"put into index":       db.Bucket(indexBucket).Put("by_name", "other"),
+		"get from lock bucket": func() error { _, err := db.Bucket(lockBucket).Get("seed"); return err }(),
+		"raw put into lock":    db.Put(bucketPrefix(lockBucket)+"seed", "stolen"),
+		"raw delete of queue":  db.Delete(messageKey("jobs", 1)),
+		"batch into lock":      db.Write(&b),
+	} {
+		if !errors.Is(err, ErrInvalidBucket) {
+			t.Errorf("%s: error = %v, want ErrInvalidBucket", name, err)
+		}
+	}
+	if counts := db.Buckets(); len(counts) != 0 {
+		t.Errorf("Buckets() = %v, want no reserved buckets", counts)
+	}
+
+	var out bytes.Buffer
+	if err := db.Export(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Export wrote reserved records: %s", out.String())
+	}
+	line := `{"key": "_lock\u0000seed", "type": "string", "value": "stolen"}`
+	if _, err := db.Import(strings.NewReader(line)); !errors.Is(err, ErrInvalidBucket) {
+		t.Errorf("Import of a lock record error = %v, want ErrInvalidBucket", err)
+	}
+	if _, err := db.Lease("jobs", time.Minute); err != nil {
+		t.Errorf("queue broken after rejected writes: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrCompacted = errors.New("changes were compacted away")
+
+// CompactedError is returned by ChangesSince when changes after since may
+// already have been dropped by a compaction. The consumer has to start over,
+// for instance from an export, and follow the changes after Horizon.
+type CompactedError struct {
+	Since   uint64
+	Horizon uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("%s: since %d, compacted up to %d", ErrCompacted, e.Since, e.Horizon)
+}
+
+func (e *CompactedError) Unwrap() error {
+	return ErrCompacted
+}
+
+// Change is a single write. Deletes have the tombstone type and dropped
+// buckets the dropbucket type with the bucket name as the key; neither has a
+// value.
+type Change struct {
+	Seq   uint64
+	Key   string
+	Type  string
+	Value []byte
+}
+
+// MarshalJSON encodes the value the way Export does.
+func (c Change) MarshalJSON() ([]byte, error) {
+	value, err := exportValue(c.Type, c.Value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Seq   uint64          `json:"seq"`
+		Key   string          `json:"key"`
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	}{c.Seq, c.Key, c.Type, value})
+}
+
+// ChangesSince calls fn for every change with a sequence number above since,
+// in order, up to the last write acknowledged when it is called. Index
+// definitions are left out. A file written before sequence numbers were
+// introduced has to be migrated or compacted first.
+func (db *Db) ChangesSince(since uint64, fn func(Change) error) error {
+	db.muIndex.RLock()
+	h, end := db.header, db.outOffset
+	f, err := openRead(db.fs, db.outPath)
+	db.muIndex.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if h.flags&flagSequence == 0 {
+		return fmt.Errorf("%w: version %d has no sequence numbers", ErrUnsupportedFormat, h.version)
+	}
+	if since < h.horizon {
+		return &CompactedError{Since: since, Horizon: h.horizon}
+	}
+
+	return db.readLog(f, h, end, func(_, _ int64, e entry) error {
+		if e.seq <= since || isIndexDefinition(e.key) {
+			return nil
+		}
+		return fn(Change{Seq: e.seq, Key: e.key, Type: e.Type, Value: e.value})
+	})
+}
+
+// readLog calls fn for every record of f between the header and end in file
+// order, with batches unwrapped into the records they hold. Offsets and sizes
+// are those the index would use.
+func (db *Db) readLog(f File, h segmentHeader, end int64, fn func(offset, size int64, e entry) error) error {
+	in := bufio.NewReader(io.NewSectionReader(f, h.size(), end-h.size()))
+	for offset := h.size(); offset < end; {
+		var rec entry
+		n, err := rec.decodeFromReader(in, db.maxRecordSize)
+		if err != nil {
+			return fmt.Errorf("read record at %d: %w", offset, err)
+		}
+		at := offset
+		offset += int64(n)
+
+		if rec.Type != typeBatch {
+			if err := fn(at, int64(n), rec); err != nil {
+				return err
+			}
+			continue
+		}
+		type innerRecord struct {
+			offset, size int64
+			e            entry
+		}
+		var inner []innerRecord
+		if err := splitBatch(rec.value, func(inOffset, size int64, e entry) {
+			inner = append(inner, innerRecord{at + batchValueOffset + inOffset, size, e})
+		}); err != nil {
+			return err
+		}
+		for _, r := range inner {
+			if err := fn(r.offset, r.size, r.e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func collectChanges(t *testing.T, db interface {
+	ChangesSince(uint64, func(Change) error) error
+}, since uint64) []Change {
+	t.Helper()
+	var changes []Change
+	if err := db.ChangesSince(since, func(c Change) error {
+		changes = append(changes, c)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func changeKeys(changes []Change) string {
+	keys := make([]string, len(changes))
+	for i, c := range changes {
+		keys[i] = c.Type + ":" + c.Key
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestChangesSince(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutStream("blob", strings.NewReader("xyz"), 3); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.Put("b", "2")
+	b.Delete("a")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Bucket("team").Put("x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("team"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := collectChanges(t, db, 0)
+	want := "string:a bytes:blob string:b tombstone:a string:team\x00x dropbucket:team"
+	if got := changeKeys(changes); got != want {
+		t.Fatalf("changes = %q, want %q", got, want)
+	}
+	for i, c := range changes {
+		if c.Seq != uint64(i)+1 {
+			t.Errorf("change %d has seq %d", i, c.Seq)
+		}
+	}
+	if !bytes.Equal(changes[1].Value, []byte("xyz")) {
+		t.Errorf("blob change value = %q", changes[1].Value)
+	}
+	if got := changeKeys(collectChanges(t, db, 4)); got != "string:team\x00x dropbucket:team" {
+		t.Errorf("changes since 4 = %q", got)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if changes := collectChanges(t, db, 6); len(changes) != 1 || changes[0].Seq != 7 {
+		t.Errorf("expected seq 7 after reopening, got %+v", changes)
+	}
+}
+
+func TestChangesSinceCompacted(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"1", "2", "3"} {
+		if err := db.Put("k", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.ChangesSince(1, func(Change) error { return nil })
+	var compacted *CompactedError
+	if !errors.As(err, &compacted) || !errors.Is(err, ErrCompacted) || compacted.Horizon != 3 {
+		t.Fatalf("expected CompactedError with horizon 3, got %v", err)
+	}
+
+	if err := db.Put("k", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if got := changeKeys(collectChanges(t, db, 3)); got != "string:k" {
+		t.Errorf("changes since the horizon = %q", got)
+	}
+
+	// The horizon survives a restart even though the records are gone.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.ChangesSince(0, func(Change) error { return nil }); !errors.Is(err, ErrCompacted) {
+		t.Errorf("expected ErrCompacted after reopening, got %v", err)
+	}
+	if err := db.Put("k", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if changes := collectChanges(t, db, 4); len(changes) != 1 || changes[0].Seq != 5 {
+		t.Errorf("expected seq 5, got %+v", changes)
+	}
+}
+
+func TestChangesAfterUpgrade(t *testing.T) {
+	v2 := segmentHeader{version: formatV2, flags: flagChecksum}
+	records := []entry{
+		{key: "k1", value: []byte("v1"), Type: typeString},
+		{key: "k2", value: []byte("v2"), Type: typeString},
+	}
+	var buf bytes.Buffer
+	buf.Write(v2.Encode())
+	for _, rec := range records {
+		v2.prepare(&rec)
+		buf.Write(rec.Encode())
+	}
+
+	for name, upgrade := range map[string]func(dir string) error{
+		"migrate": func(dir string) error {
+			return Migrate(dir)
+		},
+		"compact": func(dir string) error {
+			db, err := Open(dir)
+			if err != nil {
+				return err
+			}
+			if err := db.ChangesSince(0, func(Change) error { return nil }); !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("expected ErrUnsupportedFormat before upgrading, got %v", err)
+			}
+			if err := db.Compact(context.Background()); err != nil {
+				return err
+			}
+			return db.Close()
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmp := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmp, outFileName), buf.Bytes(), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := upgrade(tmp); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := Open(tmp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Put("k3", "v3"); err != nil {
+				t.Fatal(err)
+			}
+			changes := collectChanges(t, db, 0)
+			if got := changeKeys(changes); got != "string:k1 string:k2 string:k3" {
+				t.Fatalf("changes = %q", got)
+			}
+			if changes[2].Seq != 3 {
+				t.Errorf("expected the first new write to get seq 3, got %d", changes[2].Seq)
+			}
+		})
+	}
+}
+
+func TestMemStoreChangesSince(t *testing.T) {
+	s := NewMemStore()
+	if err := s.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := changeKeys(collectChanges(t, s, 1)); got != "tombstone:a" {
+		t.Errorf("changes since 1 = %q", got)
+	}
+	if got := collectChanges(t, s, 10); len(got) != 0 {
+		t.Errorf("expected no changes past the end, got %v", got)
+	}
+}
@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// typeJSON is the record type of values written with JSONCodec. Secondary
+// indexes cover them like JSON documents stored as strings.
+const typeJSON = "json"
+
+var ErrReservedType = errors.New("type name is reserved")
+
+// TypedStore reads and writes raw values tagged with the name of their type.
+type TypedStore interface {
+	GetTyped(key string) (value []byte, typ string, err error)
+	PutTyped(key, typ string, value []byte) error
+}
+
+// Codec converts values of type T to and from the bytes of a record. Its
+// name is stored as the record type and checked on every read.
+type Codec[T any] interface {
+	Name() string
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// GetAs reads the value stored under key with c. It fails with
+// ErrTypeMismatch if the value was written by a codec of another name.
+func GetAs[T any](s TypedStore, key string, c Codec[T]) (T, error) {
+	var zero T
+	data, typ, err := s.GetTyped(key)
+	if err != nil {
+		return zero, err
+	}
+	if typ != c.Name() {
+		return zero, fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, c.Name(), typ)
+	}
+	v, err := c.Decode(data)
+	if err != nil {
+		return zero, fmt.Errorf("decode %q as %s: %w", key, c.Name(), err)
+	}
+	return v, nil
+}
+
+// PutAs stores v under key encoded with c.
+func PutAs[T any](s TypedStore, key string, v T, c Codec[T]) error {
+	data, err := c.Encode(v)
+	if err != nil {
+		return fmt.Errorf("encode %q as %s: %w", key, c.Name(), err)
+	}
+	return s.PutTyped(key, c.Name(), data)
+}
+
+// checkTyped rejects the record types the datastore uses internally and
+// values that the built-in accessors could not read back.
+func checkTyped(typ string, value []byte) error {
+	if isMergeType(typ) {
+		return fmt.Errorf("%w: %q", ErrReservedType, typ)
+	}
+	switch typ {
+	case "", typeTombstone, typeDropBucket, typeBatch:
+		return fmt.Errorf("%w: %q", ErrReservedType, typ)
+	case typeInt64:
+		if len(value) != 8 {
+			return fmt.Errorf("%w: int64 value of %d bytes", ErrTypeMismatch, len(value))
+		}
+	case typeList, typeSet, typeHash:
+		return checkCollection(typ, value)
+	case typeQueueMessage:
+		_, err := decodeMessage(value)
+		return err
+	case typeLock:
+		_, err := decodeLock("", value)
+		return err
+	}
+	return nil
+}
+
+var (
+	// StringCodec stores strings the way Put does.
+	StringCodec Codec[string] = stringCodec{}
+	// Int64Codec stores integers the way PutInt64 does.
+	Int64Codec Codec[int64] = int64Codec{}
+)
+
+type stringCodec struct{}
+
+func (stringCodec) Name() string { return typeString }
+
+func (stringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (stringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+type int64Codec struct{}
+
+func (int64Codec) Name() string { return typeInt64 }
+
+func (int64Codec) Encode(v int64) ([]byte, error) {
+	return binary.LittleEndian.AppendUint64(nil, uint64(v)), nil
+}
+
+func (int64Codec) Decode(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("int64 value of %d bytes", len(data))
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
+
+// JSONCodec stores values as JSON documents.
+func JSONCodec[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) Name() string { return typeJSON }
+
+func (jsonCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec stores values in the encoding/gob format.
+func GobCodec[T any]() Codec[T] {
+	return gobCodec[T]{}
+}
+
+type gobCodec[T any] struct{}
+
+func (gobCodec[T]) Name() string { return "gob" }
+
+func (gobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// Named gives c another name, so values of different Go types sharing an
+// encoding, say two structs stored as JSON, cannot be read as one another.
+func Named[T any](name string, c Codec[T]) Codec[T] {
+	return namedCodec[T]{Codec: c, name: name}
+}
+
+type namedCodec[T any] struct {
+	Codec[T]
+	name string
+}
+
+func (c namedCodec[T]) Name() string { return c.name }
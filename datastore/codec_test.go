@@ -0,0 +1,68 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+)
+
+type codecUser struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func TestCodecsSurviveReopen(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := Named("user", JSONCodec[codecUser]())
+	if err := PutAs(db, "u1", codecUser{Name: "ann", Age: 30}, users); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutAs(db, "s", "text", StringCodec); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := GetAs(db, "u1", users); err != nil || got != (codecUser{Name: "ann", Age: 30}) {
+		t.Errorf("GetAs(u1) = %+v, %v", got, err)
+	}
+	if _, err := GetAs(db, "u1", JSONCodec[codecUser]()); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch for another codec name, got %v", err)
+	}
+	if got, err := db.Get("s"); err != nil || got != "text" {
+		t.Errorf("Get(s) = %q, %v; want text", got, err)
+	}
+}
+
+func TestJSONCodecValuesAreIndexed(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateIndex("name", "name"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutAs(db, "u1", codecUser{Name: "ann"}, JSONCodec[codecUser]()); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := db.Lookup("name", "ann"); err != nil || len(keys) != 1 || keys[0] != (IndexedKey{Key: "u1"}) {
+		t.Errorf("Lookup(ann) = %v, %v; want [u1]", keys, err)
+	}
+}
+
+func TestPutTypedRejectsShortInt64(t *testing.T) {
+	db := NewMemStore()
+	if err := db.PutTyped("n", typeInt64, []byte{1, 2}); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch, got %v", err)
+	}
+}
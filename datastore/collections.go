@@ -0,0 +1,339 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Collections are stored as a count followed by length-prefixed strings. A
+// set keeps its members sorted, a hash its fields sorted with every value
+// right after its field. Emptying a collection deletes its key.
+const (
+	typeList = "list"
+	typeSet  = "set"
+	typeHash = "hash"
+)
+
+var errMalformedCollection = errors.New("malformed collection")
+
+func encodeItems(items []string) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(items)))
+	for _, item := range items {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(item)))
+		data = append(data, item...)
+	}
+	return data
+}
+
+func decodeItems(data []byte) ([]string, error) {
+	if len(data) < 4 {
+		return nil, errMalformedCollection
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if n > len(data)/4 {
+		return nil, errMalformedCollection
+	}
+	items := make([]string, n)
+	for i := range items {
+		if len(data) < 4 {
+			return nil, errMalformedCollection
+		}
+		l := int(binary.LittleEndian.Uint32(data))
+		if l > len(data)-4 {
+			return nil, errMalformedCollection
+		}
+		items[i] = string(data[4 : 4+l])
+		data = data[4+l:]
+	}
+	if len(data) > 0 {
+		return nil, errMalformedCollection
+	}
+	return items, nil
+}
+
+// checkCollection validates a collection value written with PutTyped.
+func checkCollection(typ string, value []byte) error {
+	items, err := decodeItems(value)
+	if err == nil {
+		switch typ {
+		case typeSet:
+			err = checkSorted(items, 1)
+		case typeHash:
+			err = checkSorted(items, 2)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s value: %s", ErrTypeMismatch, typ, err)
+	}
+	return nil
+}
+
+// checkSorted checks that every step-th item, starting with the first, is
+// greater than the one before.
+func checkSorted(items []string, step int) error {
+	if len(items)%step != 0 {
+		return errMalformedCollection
+	}
+	for i := step; i < len(items); i += step {
+		if items[i] <= items[i-step] {
+			return errMalformedCollection
+		}
+	}
+	return nil
+}
+
+// readItems returns the collection of type typ stored under key, or nil if
+// there is none.
+func (db *Db) readItems(key, typ string) ([]string, error) {
+	record, err := db.readEntry(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.Type != typ {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, typ, record.Type)
+	}
+	return decodeItems(record.value)
+}
+
+// update runs fn on the write loop with the collection stored under key and
+// stores the result if fn reports a change, so the read, the change and the
+// write are atomic.
+func (db *Db) update(key, typ string, fn func(items []string) ([]string, bool, error)) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.send(writeRequest{op: func() error {
+		items, err := db.readItems(key, typ)
+		if err != nil {
+			return err
+		}
+		existed := len(items) > 0
+		items, changed, err := fn(items)
+		if err != nil || !changed {
+			return err
+		}
+		if len(items) == 0 {
+			if !existed {
+				return nil
+			}
+			return db.writeEntry(key, nil, typeTombstone)
+		}
+		return db.writeEntry(key, encodeItems(items), typ)
+	}})
+}
+
+// LPush prepends values to the list under key, so the last one ends up
+// first, and returns the new length of the list.
+func (db *Db) LPush(key string, values ...string) (int, error) {
+	var n int
+	err := db.update(key, typeList, func(items []string) ([]string, bool, error) {
+		pushed := make([]string, 0, len(values)+len(items))
+		for i := len(values) - 1; i >= 0; i-- {
+			pushed = append(pushed, values[i])
+		}
+		pushed = append(pushed, items...)
+		n = len(pushed)
+		return pushed, len(values) > 0, nil
+	})
+	return n, err
+}
+
+// RPush appends values to the list under key and returns its new length.
+func (db *Db) RPush(key string, values ...string) (int, error) {
+	var n int
+	err := db.update(key, typeList, func(items []string) ([]string, bool, error) {
+		items = append(items, values...)
+		n = len(items)
+		return items, len(values) > 0, nil
+	})
+	return n, err
+}
+
+// LPop removes and returns the first element of the list under key. An
+// empty list fails with ErrNotFound.
+func (db *Db) LPop(key string) (string, error) {
+	var value string
+	err := db.update(key, typeList, func(items []string) ([]string, bool, error) {
+		if len(items) == 0 {
+			return nil, false, ErrNotFound
+		}
+		value = items[0]
+		return items[1:], true, nil
+	})
+	return value, err
+}
+
+// RPop removes and returns the last element of the list under key.
+func (db *Db) RPop(key string) (string, error) {
+	var value string
+	err := db.update(key, typeList, func(items []string) ([]string, bool, error) {
+		if len(items) == 0 {
+			return nil, false, ErrNotFound
+		}
+		value = items[len(items)-1]
+		return items[:len(items)-1], true, nil
+	})
+	return value, err
+}
+
+// LRange returns the elements of the list under key from start to stop,
+// both included. Negative indexes count from the end, so 0 and -1 select
+// the whole list. A missing key is an empty list.
+func (db *Db) LRange(key string, start, stop int) ([]string, error) {
+	items, err := db.readItems(key, typeList)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		start = max(len(items)+start, 0)
+	}
+	if stop < 0 {
+		stop += len(items)
+	}
+	stop = min(stop, len(items)-1)
+	if start > stop {
+		return []string{}, nil
+	}
+	return items[start : stop+1], nil
+}
+
+// SAdd adds members to the set under key and returns how many were new.
+func (db *Db) SAdd(key string, members ...string) (int, error) {
+	var added int
+	err := db.update(key, typeSet, func(items []string) ([]string, bool, error) {
+		added = 0
+		for _, m := range members {
+			i := sort.SearchStrings(items, m)
+			if i < len(items) && items[i] == m {
+				continue
+			}
+			items = append(items, "")
+			copy(items[i+1:], items[i:])
+			items[i] = m
+			added++
+		}
+		return items, added > 0, nil
+	})
+	return added, err
+}
+
+// SRem removes members from the set under key and returns how many were
+// there.
+func (db *Db) SRem(key string, members ...string) (int, error) {
+	var removed int
+	err := db.update(key, typeSet, func(items []string) ([]string, bool, error) {
+		removed = 0
+		for _, m := range members {
+			i := sort.SearchStrings(items, m)
+			if i < len(items) && items[i] == m {
+				items = append(items[:i], items[i+1:]...)
+				removed++
+			}
+		}
+		return items, removed > 0, nil
+	})
+	return removed, err
+}
+
+// SMembers returns the members of the set under key in sorted order.
+func (db *Db) SMembers(key string) ([]string, error) {
+	items, err := db.readItems(key, typeSet)
+	if items == nil && err == nil {
+		items = []string{}
+	}
+	return items, err
+}
+
+// SIsMember reports whether member is in the set under key.
+func (db *Db) SIsMember(key, member string) (bool, error) {
+	items, err := db.readItems(key, typeSet)
+	if err != nil {
+		return false, err
+	}
+	i := sort.SearchStrings(items, member)
+	return i < len(items) && items[i] == member, nil
+}
+
+// hashField finds field among the sorted fields of a hash stored as
+// field, value pairs.
+func hashField(items []string, field string) (int, bool) {
+	i := sort.Search(len(items)/2, func(i int) bool {
+		return items[2*i] >= field
+	})
+	return 2 * i, 2*i < len(items) && items[2*i] == field
+}
+
+// HSet sets field of the hash under key to value. It reports whether the
+// field is new.
+func (db *Db) HSet(key, field, value string) (bool, error) {
+	var created bool
+	err := db.update(key, typeHash, func(items []string) ([]string, bool, error) {
+		i, ok := hashField(items, field)
+		created = !ok
+		if ok {
+			if items[i+1] == value {
+				return items, false, nil
+			}
+			items[i+1] = value
+			return items, true, nil
+		}
+		items = append(items, "", "")
+		copy(items[i+2:], items[i:])
+		items[i], items[i+1] = field, value
+		return items, true, nil
+	})
+	return created, err
+}
+
+// HGet returns field of the hash under key. A missing key or field fails
+// with ErrNotFound.
+func (db *Db) HGet(key, field string) (string, error) {
+	items, err := db.readItems(key, typeHash)
+	if err != nil {
+		return "", err
+	}
+	i, ok := hashField(items, field)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return items[i+1], nil
+}
+
+// HGetAll returns every field of the hash under key.
+func (db *Db) HGetAll(key string) (map[string]string, error) {
+	items, err := db.readItems(key, typeHash)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		fields[items[i]] = items[i+1]
+	}
+	return fields, nil
+}
+
+// HDel removes fields from the hash under key and returns how many were
+// there.
+func (db *Db) HDel(key string, fields ...string) (int, error) {
+	var removed int
+	err := db.update(key, typeHash, func(items []string) ([]string, bool, error) {
+		removed = 0
+		for _, f := range fields {
+			if i, ok := hashField(items, f); ok {
+				items = append(items[:i], items[i+2:]...)
+				removed++
+			}
+		}
+		return items, removed > 0, nil
+	})
+	return removed, err
+}
@@ -0,0 +1,157 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLists(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.RPush("l", "b", "c"); err != nil || n != 2 {
+		t.Fatalf("RPush = %d, %v", n, err)
+	}
+	if n, err := db.LPush("l", "z", "a"); err != nil || n != 4 {
+		t.Fatalf("LPush = %d, %v", n, err)
+	}
+	for _, tc := range []struct {
+		start, stop int
+		want        string
+	}{
+		{0, -1, "[a z b c]"},
+		{1, 2, "[z b]"},
+		{-2, 10, "[b c]"},
+		{3, 1, "[]"},
+	} {
+		if got, err := db.LRange("l", tc.start, tc.stop); err != nil || fmt.Sprint(got) != tc.want {
+			t.Errorf("LRange(%d, %d) = %v, %v, want %s", tc.start, tc.stop, got, err, tc.want)
+		}
+	}
+	if v, err := db.LPop("l"); err != nil || v != "a" {
+		t.Errorf("LPop = %q, %v", v, err)
+	}
+	if v, err := db.RPop("l"); err != nil || v != "c" {
+		t.Errorf("RPop = %q, %v", v, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.LRange("l", 0, -1); err != nil || fmt.Sprint(got) != "[z b]" {
+		t.Errorf("LRange after reopen = %v, %v", got, err)
+	}
+	for range 2 {
+		if _, err := db.LPop("l"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.LPop("l"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LPop of an empty list error = %v, want ErrNotFound", err)
+	}
+	if _, _, err := db.GetTyped("l"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("emptied list still stored: %v", err)
+	}
+}
+
+func TestSetsAndHashes(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if n, err := db.SAdd("s", "b", "a", "b"); err != nil || n != 2 {
+		t.Errorf("SAdd = %d, %v", n, err)
+	}
+	if n, err := db.SAdd("s", "a", "c"); err != nil || n != 1 {
+		t.Errorf("SAdd = %d, %v", n, err)
+	}
+	if n, err := db.SRem("s", "a", "x"); err != nil || n != 1 {
+		t.Errorf("SRem = %d, %v", n, err)
+	}
+	if got, err := db.SMembers("s"); err != nil || fmt.Sprint(got) != "[b c]" {
+		t.Errorf("SMembers = %v, %v", got, err)
+	}
+	if ok, err := db.SIsMember("s", "c"); err != nil || !ok {
+		t.Errorf("SIsMember(c) = %v, %v", ok, err)
+	}
+
+	if created, err := db.HSet("h", "name", "Ann"); err != nil || !created {
+		t.Errorf("HSet = %v, %v", created, err)
+	}
+	if created, err := db.HSet("h", "city", "Kyiv"); err != nil || !created {
+		t.Errorf("HSet = %v, %v", created, err)
+	}
+	if created, err := db.HSet("h", "name", "Bob"); err != nil || created {
+		t.Errorf("HSet of an existing field = %v, %v", created, err)
+	}
+	if v, err := db.HGet("h", "name"); err != nil || v != "Bob" {
+		t.Errorf("HGet(name) = %q, %v", v, err)
+	}
+	if _, err := db.HGet("h", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("HGet(missing) error = %v, want ErrNotFound", err)
+	}
+	if n, err := db.HDel("h", "city"); err != nil || n != 1 {
+		t.Errorf("HDel = %d, %v", n, err)
+	}
+	if got, err := db.HGetAll("h"); err != nil || fmt.Sprint(got) != "map[name:Bob]" {
+		t.Errorf("HGetAll = %v, %v", got, err)
+	}
+
+	if err := db.Put("str", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SAdd("str", "x"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("SAdd on a string error = %v, want ErrTypeMismatch", err)
+	}
+	if _, err := db.LRange("s", 0, -1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("LRange on a set error = %v, want ErrTypeMismatch", err)
+	}
+	if err := db.PutTyped("bad", typeSet, encodeItems([]string{"b", "a"})); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("PutTyped of an unsorted set error = %v, want ErrTypeMismatch", err)
+	}
+}
+
+func TestCollectionsAreAtomic(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				if _, err := db.RPush("l", fmt.Sprint(w, i)); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := db.HSet("h", fmt.Sprint(w, i), "v"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got, _ := db.LRange("l", 0, -1); len(got) != 200 {
+		t.Errorf("list has %d elements, want 200", len(got))
+	}
+	if got, _ := db.HGetAll("h"); len(got) != 200 {
+		t.Errorf("hash has %d fields, want 200", len(got))
+	}
+}
@@ -0,0 +1,713 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sort"
+	"time"
+)
+
+// CompactionPolicy controls background compaction. The zero value disables
+// it, leaving only WithSegmentLimit and explicit Compact calls.
+type CompactionPolicy struct {
+	// DeadRatio triggers a compaction once dead records make up at least this
+	// share of the data file.
+	DeadRatio float64
+	// MinDeadBytes keeps small files from being compacted over and over.
+	MinDeadBytes int64
+	// BytesPerSecond caps how fast live records are copied. Zero means no cap.
+	BytesPerSecond int64
+	// WindowStart and WindowEnd restrict automatic compaction to a daily
+	// window, as offsets from local midnight. The window may wrap midnight.
+	// Equal values allow compaction at any time.
+	WindowStart, WindowEnd time.Duration
+	// CheckInterval is how often the policy is evaluated, a minute by default.
+	CheckInterval time.Duration
+}
+
+// WithCompactionPolicy starts a background goroutine that compacts the data
+// file whenever the policy says so.
+func WithCompactionPolicy(p CompactionPolicy) Option {
+	return func(o *options) {
+		o.policy = p
+	}
+}
+
+func (p CompactionPolicy) inWindow(t time.Time) bool {
+	if p.WindowStart == p.WindowEnd {
+		return true
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	d := t.Sub(midnight)
+	if p.WindowStart < p.WindowEnd {
+		return d >= p.WindowStart && d < p.WindowEnd
+	}
+	return d >= p.WindowStart || d < p.WindowEnd
+}
+
+func (p CompactionPolicy) due(s Stats) bool {
+	total := s.LiveBytes + s.DeadBytes
+	if p.DeadRatio <= 0 || total == 0 || s.DeadBytes < p.MinDeadBytes {
+		return false
+	}
+	return float64(s.DeadBytes)/float64(total) >= p.DeadRatio
+}
+
+// Stats describes the current data file and the write queue. HistoryBytes
+// are the old versions kept for the history policy by the last compaction
+// since opening; they do not count as dead. Rejected counts the writes that
+// failed with ErrBusy.
+type Stats struct {
+	Keys         int   `json:"keys"`
+	LiveBytes    int64 `json:"liveBytes"`
+	DeadBytes    int64 `json:"deadBytes"`
+	HistoryBytes int64 `json:"historyBytes"`
+	QueueLen     int   `json:"queueLen"`
+	QueueCap     int   `json:"queueCap"`
+	Rejected     int64 `json:"rejected"`
+}
+
+func (db *Db) Stats() Stats {
+	db.muIndex.RLock()
+	defer db.muIndex.RUnlock()
+	return Stats{
+		Keys:         db.keyCount(),
+		LiveBytes:    db.liveBytes,
+		DeadBytes:    db.outOffset - db.header.size() - db.liveBytes - db.historyBytes,
+		HistoryBytes: db.historyBytes,
+		QueueLen:     len(db.writeChan),
+		QueueCap:     cap(db.writeChan),
+		Rejected:     db.rejected.Load(),
+	}
+}
+
+func (db *Db) compactionLoop() {
+	defer db.background.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-db.closeChan
+		cancel()
+	}()
+
+	interval := db.policy.CheckInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if db.policy.inWindow(now) && db.policy.due(db.Stats()) {
+				_ = db.Compact(ctx)
+			}
+		}
+	}
+}
+
+// Compact rewrites the data file keeping only the live record of every key
+// and the old versions the history policy asks for.
+// Live records are copied in the background at the policy's rate while
+// writes go on; only the final swap runs on the write loop. Cancelling ctx
+// abandons the compaction and leaves the current file in place.
+//
+// Files of an older format are converted entirely on the write loop, as their
+// records are given sequence numbers on the way.
+func (db *Db) Compact(ctx context.Context) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	var c *compaction
+	err := db.runOnWriter(ctx, func() (err error) {
+		c, err = db.startCompaction(db.policy.BytesPerSecond)
+		if err != nil || !c.upgrading() {
+			return err
+		}
+		defer func() { c = nil }()
+		if err := c.copyLive(ctx); err != nil {
+			return c.report(c.discard(err))
+		}
+		return c.report(c.finish())
+	})
+	if err != nil || c == nil {
+		return err
+	}
+	if err := c.copyLive(ctx); err != nil {
+		return c.report(c.discard(err))
+	}
+	err = db.runOnWriter(ctx, c.finish)
+	if err != nil && c.tmp != nil {
+		err = c.discard(err)
+	}
+	return c.report(err)
+}
+
+// rollSegment compacts the data file in place on the write loop. It is a
+// no-op while a background compaction is running.
+func (db *Db) rollSegment() error {
+	if !db.compactMu.TryLock() {
+		return nil
+	}
+	defer db.compactMu.Unlock()
+
+	c, err := db.startCompaction(0)
+	if err != nil {
+		return err
+	}
+	if err := c.copyLive(context.Background()); err != nil {
+		return c.report(c.discard(err))
+	}
+	return c.report(c.finish())
+}
+
+// compaction copies a snapshot of the live records into a temporary file.
+// Records appended after the snapshot are carried over by finish.
+type compaction struct {
+	db        *Db
+	src       File
+	srcHeader segmentHeader
+	live      []indexedRecord
+	end       int64
+	tmp       File
+	tmpPath   string
+	out       *bufio.Writer
+	offset    int64
+	header    segmentHeader
+	throttle  throttle
+	// moved maps the copied records to their new place, in file order.
+	moved []movedRecord
+	// kept maps the old versions copied for the history policy. They are
+	// apart from moved since a folded value takes the offset of its first
+	// record, which may have a history copy as well.
+	kept []movedRecord
+	// chains holds the indexed record and the merge operands of every key
+	// that was folded on read at the snapshot; folded lists those that
+	// compaction replaced with a single value.
+	chains map[string][]recordPos
+	folded map[string]bool
+	// grown is how much larger the folded value of a key is than its chain.
+	grown map[string]int64
+	// dropped is a snapshot of the dropped buckets, whose dead keys are
+	// left behind.
+	dropped droppedBuckets
+	// bucketBytes sums the copied records of every bucket when upgrading,
+	// as the records change size on the way.
+	bucketBytes map[string]int64
+	// historyBytes counts the old versions copied for the history policy.
+	historyBytes int64
+	started      time.Time
+	reclaimed    int64
+}
+
+// upgrading reports whether the source file has an older format.
+func (c *compaction) upgrading() bool {
+	return c.srcHeader.format() != currentHeader
+}
+
+// nextSeq numbers the records of an older format. It must run on the write
+// loop.
+func (c *compaction) nextSeq() uint64 {
+	c.db.seq++
+	return c.db.seq
+}
+
+// startCompaction takes the snapshot. It must run on the write loop.
+func (db *Db) startCompaction(rate int64) (*compaction, error) {
+	src, err := openRead(db.fs, db.outPath)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := db.outPath + ".compact"
+	tmp, err := db.fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+
+	db.muIndex.RLock()
+	live, err := db.liveRecords("")
+	var chains map[string][]recordPos
+	if err == nil {
+		live, chains, err = db.liveChains(live)
+	}
+	db.muIndex.RUnlock()
+	if err != nil {
+		_ = src.Close()
+		_ = tmp.Close()
+		_ = db.fs.Remove(tmpPath)
+		return nil, err
+	}
+
+	// Changes up to here may be dropped, a consumer that has not seen them
+	// yet has to start over.
+	header := currentHeader
+	header.horizon = max(db.header.horizon, db.seq)
+
+	c := &compaction{
+		db:          db,
+		src:         src,
+		srcHeader:   db.header,
+		live:        live,
+		end:         db.outOffset,
+		tmp:         tmp,
+		tmpPath:     tmpPath,
+		out:         bufio.NewWriter(tmp),
+		moved:       make([]movedRecord, 0, len(live)),
+		chains:      chains,
+		folded:      make(map[string]bool),
+		grown:       make(map[string]int64),
+		dropped:     maps.Clone(db.dropped),
+		bucketBytes: make(map[string]int64),
+		offset:      header.size(),
+		header:      header,
+		throttle:    throttle{rate: rate, start: time.Now()},
+	}
+	if _, err := c.out.Write(header.Encode()); err != nil {
+		return nil, c.discard(err)
+	}
+	c.started = time.Now()
+	db.listener.CompactionStarted(db.dir)
+	return c, nil
+}
+
+// report tells the listener how the compaction ended and returns err.
+func (c *compaction) report(err error) error {
+	info := CompactionInfo{Dir: c.db.dir, Duration: time.Since(c.started), Err: err}
+	if err == nil {
+		info.Size, info.Reclaimed = c.offset, c.reclaimed
+	}
+	c.db.listener.CompactionFinished(info)
+	return err
+}
+
+func (c *compaction) copyLive(ctx context.Context) error {
+	// Folded values take the place of the last operand, so history copies
+	// of the older ones still replay before them.
+	folded, inChain, err := c.foldChains()
+	if err != nil {
+		return err
+	}
+	if c.db.history.enabled() {
+		kept, err := c.db.retained(c.src, c.srcHeader, c.end, c.db.now())
+		if err != nil {
+			return fmt.Errorf("compact history: %w", err)
+		}
+		for _, rec := range kept {
+			// Operands that are copied as they are must not be copied twice.
+			if key, ok := inChain[rec.offset]; !ok || c.folded[key] {
+				c.live = append(c.live, rec)
+			}
+		}
+		sort.Slice(c.live, func(i, j int) bool {
+			return c.live[i].offset < c.live[j].offset
+		})
+	}
+
+	dropEnd := c.dropped.end()
+	for _, rec := range c.live {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Keys are only needed to leave out the dead keys of dropped buckets
+		// and to count the bytes of every bucket anew when upgrading.
+		var recKey string
+		if !rec.old && (rec.offset < dropEnd || c.upgrading()) {
+			if recKey, err = readKeyAt(c.src, rec.offset); err != nil {
+				return fmt.Errorf("compact record at %d: %w", rec.offset, err)
+			}
+			if c.dropped.dead(recKey, rec.offset) {
+				continue
+			}
+		}
+		var n int64
+		if key, ok := inChain[rec.offset]; ok && !rec.old && c.folded[key] {
+			e, last := folded[key]
+			chain := c.chains[key]
+			if !last || chain[len(chain)-1].offset != rec.offset {
+				continue
+			}
+			if e.seq == 0 {
+				e.seq = c.nextSeq()
+			}
+			c.header.prepare(&e)
+			written, err := c.out.Write(e.Encode())
+			if err != nil {
+				return fmt.Errorf("compact merged %q: %w", key, err)
+			}
+			n = int64(written)
+			c.grown[key] = n
+			for _, pos := range chain {
+				c.grown[key] -= pos.size
+			}
+			c.countBucket(key, n)
+			c.moved = append(c.moved, movedRecord{from: chain[0].offset, to: c.offset, size: chain[0].size, newSize: n})
+		} else {
+			n, err = copyRecord(c.out, c.src, rec.offset, c.srcHeader, c.nextSeq)
+			if err != nil {
+				return fmt.Errorf("compact record at %d: %w", rec.offset, err)
+			}
+			if rec.old {
+				c.historyBytes += n
+				c.kept = append(c.kept, movedRecord{from: rec.offset, to: c.offset, size: rec.size, newSize: n})
+			} else {
+				c.countBucket(recKey, n)
+				c.moved = append(c.moved, movedRecord{from: rec.offset, to: c.offset, size: rec.size, newSize: n})
+			}
+		}
+		c.offset += n
+		if err := c.throttle.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	// Folded values land after records that came before their first one.
+	sort.Slice(c.moved, func(i, j int) bool {
+		return c.moved[i].from < c.moved[j].from
+	})
+	return nil
+}
+
+// foldChains folds the chains of the snapshot. Chains that do not fold, say
+// for want of the operator, are copied as they are. inChain maps the offset
+// of every chained record to its key.
+func (c *compaction) foldChains() (map[string]entry, map[int64]string, error) {
+	folded := make(map[string]entry, len(c.chains))
+	inChain := make(map[int64]string)
+	for key, chain := range c.chains {
+		for _, pos := range chain {
+			inChain[pos.offset] = key
+		}
+		first, err := c.db.readRecordAt(c.src, chain[0].offset)
+		if err != nil {
+			return nil, nil, fmt.Errorf("compact record at %d: %w", chain[0].offset, err)
+		}
+		records, err := c.db.readChain(c.src, first, chain[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if e, err := c.db.fold(records); err == nil {
+			folded[key] = e
+			c.folded[key] = true
+		}
+	}
+	return folded, inChain, nil
+}
+
+// countBucket adds n copied bytes of key to its bucket.
+func (c *compaction) countBucket(key string, n int64) {
+	if name, ok := bucketOf(key); ok {
+		c.bucketBytes[name] += n
+	}
+}
+
+type movedRecord struct {
+	from, to int64
+	size     int64
+	newSize  int64
+}
+
+// finish carries over the records written since the snapshot and swaps the
+// new file in together with a rebuilt index. It must run on the write loop.
+func (c *compaction) finish() error {
+	db := c.db
+
+	for pos := c.end; pos < db.outOffset; {
+		sizeBuf := make([]byte, 4)
+		if _, err := c.src.ReadAt(sizeBuf, pos); err != nil {
+			return c.discard(err)
+		}
+		size := int64(binary.LittleEndian.Uint32(sizeBuf))
+		n, err := copyRecord(c.out, c.src, pos, c.srcHeader, c.nextSeq)
+		if err != nil {
+			return c.discard(fmt.Errorf("compact tail at %d: %w", pos, err))
+		}
+		c.moved = append(c.moved, movedRecord{from: pos, to: c.offset, size: size, newSize: n})
+		c.offset += n
+		pos += size
+	}
+
+	if err := c.out.Flush(); err != nil {
+		return c.discard(err)
+	}
+	if err := c.tmp.Sync(); err != nil {
+		return c.discard(err)
+	}
+
+	var keyFile File
+	if db.keyFile != nil {
+		f, err := openRead(db.fs, c.tmpPath)
+		if err != nil {
+			return c.discard(err)
+		}
+		keyFile = f
+	}
+
+	db.muIndex.Lock()
+	defer db.muIndex.Unlock()
+
+	// Every indexed record was either copied from the snapshot or carried
+	// over with the tail, records inside a batch with the batch. Only dead
+	// keys of dropped buckets were left behind.
+	relocate := func(pos recordPos) (recordPos, bool) {
+		return relocateIn(c.moved, pos)
+	}
+	// Replaced records were copied as history, or with the tail if they
+	// were written since the snapshot.
+	relocateOld := func(pos recordPos) (recordPos, bool) {
+		if moved, ok := relocateIn(c.kept, pos); ok {
+			return moved, true
+		}
+		return relocate(pos)
+	}
+	var live int64
+	move := func(pos recordPos) (recordPos, bool) {
+		pos, ok := relocate(pos)
+		if ok {
+			live += pos.size
+		}
+		return pos, ok
+	}
+	merges, grown, err := c.remapMerges(move)
+	if err != nil {
+		if keyFile != nil {
+			_ = keyFile.Close()
+		}
+		return c.discard(err)
+	}
+	index := db.index.remap(move)
+
+	if err := db.fs.Rename(c.tmpPath, db.outPath); err != nil {
+		if keyFile != nil {
+			_ = keyFile.Close()
+		}
+		return c.discard(err)
+	}
+	_ = c.src.Close()
+	_ = db.out.Close()
+	if keyFile != nil {
+		_ = db.keyFile.Close()
+		db.keyFile = keyFile
+	}
+	c.reclaimed = db.outOffset - c.offset
+	db.deadKeys -= db.index.len() - index.len()
+	// Buckets dropped before the snapshot are purged, those dropped since
+	// still have dead keys in the file.
+	dropped := make(droppedBuckets)
+	for name, at := range db.dropped {
+		if at < c.end {
+			continue
+		}
+		if pos, ok := relocate(recordPos{offset: at}); ok {
+			dropped[name] = pos.offset
+		}
+	}
+	if c.upgrading() {
+		// Every record changed size on the way. Nothing was written since
+		// the snapshot, so no key is dead.
+		db.liveBytes = live
+		for name, s := range db.buckets {
+			s.bytes = c.bucketBytes[name]
+			db.buckets[name] = s
+		}
+	} else {
+		for key, delta := range grown {
+			db.countKey(key, 0, delta)
+		}
+	}
+	db.out = c.tmp
+	db.index = index
+	db.merges = merges
+	db.superseded = remapVersions(db.superseded, relocateOld)
+	// The history copies of a folded chain are older versions of its value
+	// now, as they are once the file is replayed.
+	for key := range grown {
+		for _, pos := range c.chains[key] {
+			if moved, ok := relocateIn(c.kept, pos); ok {
+				db.superseded[key] = append(db.superseded[key], moved.offset)
+			}
+		}
+	}
+	db.drops = remapVersions(db.drops, relocate)
+	db.dropped = dropped
+	db.outOffset = c.offset
+	db.header = c.header
+	db.historyBytes = c.historyBytes
+	c.tmp = nil
+	return nil
+}
+
+// relocateIn returns where the record at pos went according to moved, which
+// is sorted by the old offset.
+func relocateIn(moved []movedRecord, pos recordPos) (recordPos, bool) {
+	i := sort.Search(len(moved), func(i int) bool {
+		return moved[i].from+moved[i].size > pos.offset
+	})
+	if i == len(moved) || moved[i].from > pos.offset {
+		return pos, false
+	}
+	m := moved[i]
+	if pos.offset == m.from {
+		pos = recordPos{offset: m.to, size: m.newSize}
+	} else {
+		pos.offset = m.to + pos.offset - m.from
+	}
+	return pos, true
+}
+
+// remapMerges moves the operands that were not folded into the new file.
+// Operands folded by the compaction are dropped as long as the key still
+// indexes the record its chain started with; grown has how much larger such
+// keys got. Callers hold muIndex.
+func (c *compaction) remapMerges(move func(recordPos) (recordPos, bool)) (merges map[string][]recordPos, grown map[string]int64, err error) {
+	merges = make(map[string][]recordPos, len(c.db.merges))
+	grown = make(map[string]int64)
+	for key, ops := range c.db.merges {
+		if chain := c.chains[key]; c.folded[key] {
+			pos, _, err := c.db.index.get(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			if pos.offset == chain[0].offset {
+				grown[key] = c.grown[key]
+				if ops = ops[len(chain)-1:]; len(ops) == 0 {
+					continue
+				}
+			}
+		}
+		// Keys of dropped buckets lose their operands with the drop, so
+		// every operand was copied.
+		moved := make([]recordPos, len(ops))
+		for i, pos := range ops {
+			moved[i], _ = move(pos)
+		}
+		merges[key] = moved
+	}
+	return merges, grown, nil
+}
+
+func (c *compaction) discard(err error) error {
+	_ = c.src.Close()
+	if c.tmp != nil {
+		_ = c.tmp.Close()
+		_ = c.db.fs.Remove(c.tmpPath)
+		c.tmp = nil
+	}
+	return err
+}
+
+// throttle paces copying to rate bytes per second.
+type throttle struct {
+	rate   int64
+	start  time.Time
+	copied int64
+}
+
+func (t *throttle) wait(ctx context.Context, n int64) error {
+	if t.rate <= 0 {
+		return nil
+	}
+	t.copied += n
+	due := t.start.Add(time.Duration(float64(t.copied) / float64(t.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type indexedRecord struct {
+	offset int64
+	size   int64
+	// old marks a superseded version kept for the history policy.
+	old bool
+}
+
+// liveRecords lists the records of the keys starting with prefix in file
+// order. Callers hold muIndex or run on the write loop.
+func (db *Db) liveRecords(prefix string) ([]indexedRecord, error) {
+	var live []indexedRecord
+	if prefix == "" {
+		// Without a prefix the keys are not needed, the compact index would
+		// have to read every one of them.
+		for _, pos := range db.index.positions() {
+			live = append(live, indexedRecord{offset: pos.offset, size: pos.size})
+		}
+	} else {
+		err := db.index.scan(prefix, func(_ string, pos recordPos) {
+			live = append(live, indexedRecord{offset: pos.offset, size: pos.size})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].offset < live[j].offset
+	})
+	return live, nil
+}
+
+// liveChains adds the merge operands to live and returns the chain of every
+// key that is folded on read. Callers hold muIndex or run on the write loop.
+func (db *Db) liveChains(live []indexedRecord) ([]indexedRecord, map[string][]recordPos, error) {
+	chains := make(map[string][]recordPos, len(db.merges))
+	for key, ops := range db.merges {
+		pos, _, err := db.index.get(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		chains[key] = append([]recordPos{pos}, ops...)
+		for _, op := range ops {
+			live = append(live, indexedRecord{offset: op.offset, size: op.size})
+		}
+	}
+	if len(chains) > 0 {
+		sort.Slice(live, func(i, j int) bool {
+			return live[i].offset < live[j].offset
+		})
+	}
+	return live, chains, nil
+}
+
+// copyRecord copies the record at offset into out. Records already in the
+// current format are copied byte for byte without loading the value, older
+// ones are upgraded and numbered with next.
+func copyRecord(out io.Writer, from io.ReaderAt, offset int64, h segmentHeader, next func() uint64) (int64, error) {
+	sizeBuf := make([]byte, 4)
+	if _, err := from.ReadAt(sizeBuf, offset); err != nil {
+		return 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(sizeBuf))
+	record := io.NewSectionReader(from, offset, size)
+
+	if h.format() == currentHeader {
+		return io.Copy(out, record)
+	}
+
+	var e entry
+	if _, err := e.DecodeFromReader(bufio.NewReader(record)); err != nil {
+		return 0, err
+	}
+	if err := upgrade(&e, h, next); err != nil {
+		return 0, err
+	}
+	n, err := out.Write(e.Encode())
+	return int64(n), err
+}
@@ -0,0 +1,176 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompactWithConcurrentWrites(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithCompactionPolicy(CompactionPolicy{BytesPerSecond: 64 << 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, round)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- db.Compact(context.Background())
+	}()
+
+	var b Batch
+	for i := 0; i < 50; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("during-%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+		b.Put(fmt.Sprintf("batch%d", i), "b")
+		expected[fmt.Sprintf("batch%d", i)] = "b"
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 190; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for key, value := range expected {
+			if got, err := db.Get(key); err != nil || got != value {
+				t.Errorf("Get(%s) = %q, %v; want %q", key, got, err, value)
+			}
+		}
+		if _, err := db.Get("key195"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound for a deleted key, got %v", err)
+		}
+		if stats := db.Stats(); stats.Keys != len(expected) {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	}
+	check()
+	if stats := db.Stats(); stats.DeadBytes > stats.LiveBytes {
+		t.Errorf("compaction left too much dead data: %+v", stats)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	check()
+}
+
+func TestCompactCancel(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithCompactionPolicy(CompactionPolicy{BytesPerSecond: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sizeBefore, _ := db.Size()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := db.Compact(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if sizeAfter, _ := db.Size(); sizeAfter != sizeBefore {
+		t.Errorf("cancelled compaction changed the file (%d -> %d)", sizeBefore, sizeAfter)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, outFileName+".compact")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	if val, err := db.Get("key"); err != nil || val != "value9" {
+		t.Errorf("Get(key) = %q, %v", val, err)
+	}
+}
+
+func TestCompactionPolicyTriggers(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithCompactionPolicy(CompactionPolicy{
+		DeadRatio:     0.5,
+		MinDeadBytes:  1024,
+		CheckInterval: 10 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().DeadBytes >= 1024 {
+		if time.Now().After(deadline) {
+			t.Fatalf("policy did not compact the file: %+v", db.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if val, err := db.Get("key"); err != nil || val != "value99" {
+		t.Errorf("Get(key) = %q, %v", val, err)
+	}
+}
+
+func TestCompactionPolicyWindow(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2024, 1, 1, h, m, 0, 0, time.Local)
+	}
+	night := CompactionPolicy{WindowStart: 23 * time.Hour, WindowEnd: 5 * time.Hour}
+	for _, tc := range []struct {
+		policy   CompactionPolicy
+		t        time.Time
+		expected bool
+	}{
+		{CompactionPolicy{}, at(12, 0), true},
+		{CompactionPolicy{WindowStart: 2 * time.Hour, WindowEnd: 4 * time.Hour}, at(3, 0), true},
+		{CompactionPolicy{WindowStart: 2 * time.Hour, WindowEnd: 4 * time.Hour}, at(4, 0), false},
+		{night, at(23, 30), true},
+		{night, at(4, 59), true},
+		{night, at(12, 0), false},
+	} {
+		if got := tc.policy.inWindow(tc.t); got != tc.expected {
+			t.Errorf("%+v.inWindow(%s) = %v", tc.policy, tc.t.Format("15:04"), got)
+		}
+	}
+}
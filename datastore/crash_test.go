@@ -0,0 +1,197 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDbStoreOnMemFS(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db, err := Open("db", WithFS(NewMemFS()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		return db
+	})
+}
+
+// crashWorkload writes and overwrites keys, deletes some and compacts, both
+// explicitly and through the segment limit. It records the values every key
+// may have after a crash: the last acknowledged one, or any later write that
+// failed and so may or may not have landed. deleted stands for no value.
+func crashWorkload(fs *MemFS) (map[string][]string, error) {
+	const deleted = "\x00deleted"
+	possible := make(map[string][]string)
+	record := func(key, value string, err error) {
+		if err == nil {
+			possible[key] = []string{value}
+			return
+		}
+		if _, ok := possible[key]; !ok {
+			possible[key] = []string{deleted}
+		}
+		possible[key] = append(possible[key], value)
+	}
+
+	db, err := Open("db", WithFS(fs), WithSegmentLimit(2048))
+	if err != nil {
+		return nil, err
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20; i++ {
+			key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, round)
+			record(key, value, db.Put(key, value))
+		}
+	}
+	for i := 15; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		record(key, deleted, db.Delete(key))
+	}
+
+	var b Batch
+	for i := 0; i < 5; i++ {
+		b.Put(fmt.Sprintf("batch%d", i), "b")
+	}
+	err = db.Write(&b)
+	for i := 0; i < 5; i++ {
+		record(fmt.Sprintf("batch%d", i), "b", err)
+	}
+
+	_ = db.Compact(context.Background())
+	for i := 0; i < 5; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("after-%d", i)
+		record(key, value, db.Put(key, value))
+	}
+	_ = db.Close()
+	return possible, nil
+}
+
+func TestCrashDuringCompaction(t *testing.T) {
+	dry := NewMemFS()
+	if _, err := crashWorkload(dry); err != nil {
+		t.Fatal(err)
+	}
+	if dry.Crashed() {
+		t.Fatal("dry run crashed")
+	}
+	total := dry.Ops()
+
+	for op := 1; op <= total; op++ {
+		for _, short := range []bool{false, true} {
+			name := fmt.Sprintf("op%d", op)
+			if short {
+				name += "/short"
+			}
+			t.Run(name, func(t *testing.T) {
+				fs := NewMemFS()
+				fs.FailAt(op, short)
+				possible, err := crashWorkload(fs)
+				if err != nil {
+					// The crash hit Open itself, nothing was acknowledged.
+					possible = nil
+				}
+
+				restarted := fs.Restart()
+				db, err := Open("db", WithFS(restarted))
+				if err != nil {
+					t.Fatalf("reopen after crash: %v", err)
+				}
+				for key, values := range possible {
+					got, err := db.Get(key)
+					if errors.Is(err, ErrNotFound) {
+						got = "\x00deleted"
+					} else if err != nil {
+						t.Fatalf("Get(%s): %v", key, err)
+					}
+					if !contains(values, got) {
+						t.Errorf("Get(%s) = %q, want one of %q", key, got, values)
+					}
+				}
+
+				if err := db.Put("fresh", "value"); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+				db, err = Open("db", WithFS(restarted))
+				if err != nil {
+					t.Fatalf("reopen after recovery: %v", err)
+				}
+				defer db.Close()
+				if got, err := db.Get("fresh"); err != nil || got != "value" {
+					t.Errorf("Get(fresh) = %q, %v; want value", got, err)
+				}
+			})
+		}
+	}
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	torn := entry{key: "torn", value: []byte("lost"), Type: typeString}
+	currentHeader.prepare(&torn)
+	data := torn.Encode()
+	f, err := os.OpenFile(filepath.Join(tmp, outFileName), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("torn"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the torn record to be dropped, got %v", err)
+	}
+	if err := db.Put("next", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key", "next"} {
+		if got, err := db.Get(key); err != nil || got != "value" {
+			t.Errorf("Get(%s) = %q, %v; want value", key, got, err)
+		}
+	}
+}
@@ -2,36 +2,76 @@ package datastore
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	outFileName = "current-data"
-	typeString  = "string"
-	typeInt64   = "int64"
+	outFileName  = "current-data"
+	lockFileName = "LOCK"
+	typeString   = "string"
+	typeInt64    = "int64"
+
+	// typeTombstone marks a deleted key. Compaction drops the key entirely
+	// unless the history policy keeps older versions of it.
+	typeTombstone = "tombstone"
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrReadOnly = fmt.Errorf("datastore is opened read-only")
+	ErrLocked   = fmt.Errorf("datastore directory is locked by another process")
+	ErrClosed   = fmt.Errorf("datastore is closed")
+	ErrBusy     = fmt.Errorf("write queue is full")
 
-type hashIndex map[string]int64
+	ErrTypeMismatch = errors.New("type mismatch")
+)
+
+// recordPos locates a record in the data file.
+type recordPos struct {
+	offset int64
+	size   int64
+}
 
 type writeRequest struct {
 	key   string
 	value []byte
 	typ   string
+	op    func() error
+	blob  File
+	size  int64
 	resp  chan error
 }
 
 type Db struct {
-	out              *os.File
+	fs               FS
+	out              File
+	outPath          string
+	lock             io.Closer
+	readOnly         bool
+	header           segmentHeader
 	outOffset        int64
-	index            hashIndex
+	index            keyIndex
+	keyFile          File // read handle the compact index reads keys through
+	liveBytes        int64
+	buckets          map[string]bucketStats
+	dropped          droppedBuckets
+	deadKeys         int // indexed keys of dropped buckets
+	secondary        map[string]*secondaryIndex
+	mergeOp          MergeOperator
+	merges           map[string][]recordPos // operands chained after the indexed record
+	superseded       map[string][]int64     // replaced records of a key still in the file, oldest first
+	drops            map[string][]int64     // drop records of a bucket still in the file
+	queues           map[string]*queue      // only the write loop touches them
 	segmentSize      int64
 	mu               sync.Mutex
 	segmentSizeLimit int64
@@ -39,13 +79,35 @@ type Db struct {
 	muIndex          sync.RWMutex
 	writeChan        chan writeRequest
 	closeChan        chan struct{}
+	loopDone         chan struct{}
+	compactMu        sync.Mutex
+	policy           CompactionPolicy
+	history          HistoryPolicy
+	historyBytes     int64
+	now              func() time.Time
+	background       sync.WaitGroup
+	maxRecordSize    int64
+	nonBlocking      bool
+	rejected         atomic.Int64
+	listener         Listener
+	// seq is the last sequence number handed out. Only the write loop
+	// changes it.
+	seq uint64
 }
 
 func (db *Db) writeLoop() {
+	defer close(db.loopDone)
 	for {
 		select {
 		case req := <-db.writeChan:
-			err := db.writeEntry(req.key, req.value, req.typ)
+			var err error
+			if req.op != nil {
+				err = req.op()
+			} else if req.blob != nil {
+				err = db.writeStream(req.key, req.blob, req.size)
+			} else {
+				err = db.writeEntry(req.key, req.value, req.typ)
+			}
 			req.resp <- err
 		case <-db.closeChan:
 			return
@@ -54,104 +116,391 @@ func (db *Db) writeLoop() {
 }
 
 func (db *Db) writeEntry(key string, value []byte, typ string) error {
+	switch typ {
+	case typeTombstone:
+		db.muIndex.RLock()
+		_, ok, err := db.indexGet(key)
+		db.muIndex.RUnlock()
+		if err != nil {
+			return db.writeFailed(key, err)
+		}
+		if !ok {
+			return ErrNotFound
+		}
+	case typeDropBucket:
+		db.muIndex.RLock()
+		keys := db.buckets[key].keys
+		db.muIndex.RUnlock()
+		if keys == 0 {
+			return nil
+		}
+	}
+
 	e := entry{
 		key:   key,
 		value: value,
 		Type:  typ,
+		seq:   db.seq + 1,
+		ts:    db.now().UnixNano(),
 	}
+	db.header.prepare(&e)
 	data := e.Encode()
+	if int64(len(data)) > db.maxRecordSize {
+		return db.writeFailed(key, ErrTooLarge)
+	}
 
 	if db.segmentSizeLimit > 0 && db.outOffset+int64(len(data)) > db.segmentSizeLimit {
 		if err := db.rollSegment(); err != nil {
-			return err
+			return db.writeFailed(key, err)
 		}
+		e.seq = db.seq + 1
+		db.header.prepare(&e)
+		data = e.Encode()
 	}
 
 	n, err := db.out.Write(data)
 	if err != nil {
-		return err
+		return db.writeFailed(key, db.discardTail(err))
+	}
+	if err := db.commit(key, typ, value, int64(n), e.seq); err != nil {
+		return db.writeFailed(key, err)
 	}
+	return nil
+}
 
+// commit indexes the record that was just appended at outOffset. The record
+// is stored even if indexing fails, recovery picks it up on the next open.
+func (db *Db) commit(key, typ string, value []byte, n int64, seq uint64) error {
 	db.muIndex.Lock()
-	db.index[key] = db.outOffset
-	db.muIndex.Unlock()
+	defer db.muIndex.Unlock()
+	err := db.applyRecord(key, typ, db.outOffset, n)
+	if err == nil && isMergeType(typ) && len(db.secondary) > 0 {
+		value, typ, err = db.foldForIndex(key)
+	}
+	if err == nil {
+		db.updateSecondary(key, typ, value)
+	}
+	db.outOffset += n
+	db.seq = max(db.seq, seq)
+	return err
+}
 
-	db.outOffset += int64(n)
+// applyRecord updates the index with a record of size bytes stored at
+// offset. Callers must hold muIndex or have exclusive access to the db.
+func (db *Db) applyRecord(key, typ string, offset, size int64) error {
+	switch typ {
+	case typeTombstone:
+		old, ok, err := db.indexRemove(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			db.dropMerges(key)
+			db.countKey(key, -1, -old.size)
+		}
+		db.supersede(key, offset)
+	case typeDropBucket:
+		// The keys stay indexed, they are told apart by their offset.
+		s := db.buckets[key]
+		delete(db.buckets, key)
+		db.liveBytes -= s.bytes
+		db.deadKeys += s.keys
+		db.dropped[key] = offset
+		db.drops[key] = append(db.drops[key], offset)
+		for k := range db.merges {
+			if strings.HasPrefix(k, bucketPrefix(key)) {
+				delete(db.merges, k)
+			}
+		}
+	default:
+		if isMergeType(typ) {
+			return db.applyMerge(key, recordPos{offset: offset, size: size})
+		}
+		old, ok, err := db.indexPut(key, recordPos{offset: offset, size: size})
+		if err != nil {
+			return err
+		}
+		if ok {
+			db.dropMerges(key)
+			db.countKey(key, 0, size-old.size)
+		} else {
+			db.countKey(key, 1, size)
+		}
+	}
 	return nil
 }
 
+// discardTail cuts off a partially appended record so that the next append
+// does not land after garbage.
+func (db *Db) discardTail(err error) error {
+	if truncErr := db.out.Truncate(db.outOffset); truncErr != nil {
+		return fmt.Errorf("%w (truncate failed: %s)", err, truncErr)
+	}
+	return err
+}
+
+type options struct {
+	segmentSizeLimit int64
+	readOnly         bool
+	policy           CompactionPolicy
+	history          HistoryPolicy
+	fs               FS
+	maxRecordSize    int64
+	now              func() time.Time
+	writeQueue       int
+	nonBlocking      bool
+	listener         Listener
+	compactIndex     bool
+	memtableSize     int64
+	mergeOperator    MergeOperator
+}
+
+type Option func(*options)
+
+// WithWriteQueue lets up to size writes wait for the write loop in a queue,
+// so a burst does not block every caller until the loop gets to it.
+func WithWriteQueue(size int) Option {
+	return func(o *options) {
+		o.writeQueue = max(size, 0)
+	}
+}
+
+// NonBlocking makes writes fail with ErrBusy instead of waiting when the
+// write queue is full. Without a queue, that is whenever the write loop is
+// busy.
+func NonBlocking() Option {
+	return func(o *options) {
+		o.nonBlocking = true
+	}
+}
+
+// WithMaxRecordSize rejects writes of records larger than limit bytes and
+// treats larger records found on disk as corrupted.
+func WithMaxRecordSize(limit int64) Option {
+	return func(o *options) {
+		o.maxRecordSize = min(limit, maxRecordSize)
+	}
+}
+
+// WithSegmentLimit makes the db compact its data file once it grows past
+// limit bytes.
+func WithSegmentLimit(limit int64) Option {
+	return func(o *options) {
+		o.segmentSizeLimit = limit
+	}
+}
+
+// ReadOnly opens the db for reading only. Any number of read-only openers
+// may share a directory, but not with a writer.
+func ReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
 func OpenWithSegmentLimit(dir string, limit int64) (*Db, error) {
-	outputPath := filepath.Join(dir, outFileName)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	return Open(dir, WithSegmentLimit(limit))
+}
+
+func Open(dir string, opts ...Option) (*Db, error) {
+	o := buildOptions(opts)
+	parts, err := o.fs.Glob(filepath.Join(dir, "part-*"))
 	if err != nil {
 		return nil, err
 	}
-	db := &Db{
-		out:              f,
-		index:            make(hashIndex),
-		dir:              dir,
-		segmentSizeLimit: limit,
-		writeChan:        make(chan writeRequest),
-		closeChan:        make(chan struct{}),
+	if len(parts) > 0 {
+		return nil, fmt.Errorf("%w: found %d partitions in %s", ErrPartitionMismatch, len(parts), dir)
+	}
+
+	lock, err := o.fs.Lock(dir, o.readOnly)
+	if err != nil {
+		return nil, err
 	}
-	go db.writeLoop()
-	return db, nil
-}
 
-func Open(dir string) (*Db, error) {
 	outputPath := filepath.Join(dir, outFileName)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	flag := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	if o.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := o.fs.OpenFile(outputPath, flag, 0o600)
 	if err != nil {
+		_ = lock.Close()
 		return nil, err
 	}
+
 	db := &Db{
+		fs:               o.fs,
+		maxRecordSize:    o.maxRecordSize,
 		out:              f,
+		outPath:          outputPath,
+		lock:             lock,
+		readOnly:         o.readOnly,
 		index:            make(hashIndex),
+		buckets:          make(map[string]bucketStats),
+		dropped:          make(droppedBuckets),
+		secondary:        make(map[string]*secondaryIndex),
+		mergeOp:          o.mergeOperator,
+		merges:           make(map[string][]recordPos),
+		superseded:       make(map[string][]int64),
+		drops:            make(map[string][]int64),
+		queues:           make(map[string]*queue),
 		dir:              dir,
-		segmentSizeLimit: 0,
-		writeChan:        make(chan writeRequest),
+		segmentSizeLimit: o.segmentSizeLimit,
+		policy:           o.policy,
+		history:          o.history,
+		now:              o.now,
+		nonBlocking:      o.nonBlocking,
+		listener:         o.listener,
+		writeChan:        make(chan writeRequest, o.writeQueue),
 		closeChan:        make(chan struct{}),
+		loopDone:         make(chan struct{}),
+	}
+	if o.compactIndex {
+		if db.keyFile, err = openRead(db.fs, outputPath); err != nil {
+			_ = f.Close()
+			_ = lock.Close()
+			return nil, err
+		}
+		db.index = newCompactIndex(db.keyAt)
 	}
-	go db.writeLoop()
 	err = db.recover()
 	if err != nil && err != io.EOF {
+		_ = db.closeKeyFile()
+		_ = f.Close()
+		_ = lock.Close()
 		return nil, err
 	}
+	if !db.readOnly {
+		go db.writeLoop()
+		if db.policy.DeadRatio > 0 {
+			db.background.Add(1)
+			go db.compactionLoop()
+		}
+	}
 	return db, nil
 }
 
-func (db *Db) recover() error {
-	f, err := os.Open(db.out.Name())
+func (db *Db) recover() (err error) {
+	db.listener.RecoveryStarted(db.dir)
+	report := RecoveryInfo{Dir: db.dir}
+	start := time.Now()
+	defer func() {
+		report.Keys = db.keyCount()
+		report.Duration = time.Since(start)
+		report.Err = err
+		db.listener.RecoveryFinished(report)
+	}()
+
+	f, err := openRead(db.fs, db.outPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// A file too short to hold a header or a legacy record only ever had its
+	// header torn by a crash, so it is started over.
+	if info.Size() < currentHeader.size() {
+		db.header = currentHeader
+		db.outOffset = currentHeader.size()
+		if db.readOnly {
+			return nil
+		}
+		if info.Size() > 0 {
+			if err := db.out.Truncate(0); err != nil {
+				return err
+			}
+			report.Truncated = info.Size()
+		}
+		_, err = db.out.Write(currentHeader.Encode())
+		return err
+	}
+
 	in := bufio.NewReader(f)
+	db.header, err = readHeader(in)
+	if err != nil {
+		return err
+	}
+	db.outOffset = db.header.size()
+	db.seq = db.header.horizon
+
 	for err == nil {
 		var (
 			record entry
 			n      int
 		)
-		n, err = record.DecodeFromReader(in)
+		n, err = record.decodeFromReader(in, db.maxRecordSize)
 		if errors.Is(err, io.EOF) {
 			if n != 0 {
 				return fmt.Errorf("corrupted file")
 			}
 			break
 		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A record cut short by the end of the file is a write torn by
+			// a crash. It was never acknowledged, so it is dropped below.
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
 
-		db.index[record.key] = db.outOffset
+		if record.Type == typeBatch {
+			if err = db.applyBatch(record, db.outOffset); err != nil {
+				break
+			}
+		} else {
+			if err = db.applyRecord(record.key, record.Type, db.outOffset, int64(n)); err != nil {
+				break
+			}
+			db.seq = max(db.seq, record.seq)
+		}
+		report.Records++
 		db.outOffset += int64(n)
 	}
-	return err
+	if isCorruption(err) {
+		db.listener.CorruptionDetected(db.dir, &CorruptionError{Offset: db.outOffset, Err: err})
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if info.Size() > db.outOffset && !db.readOnly {
+		if err := db.out.Truncate(db.outOffset); err != nil {
+			return err
+		}
+		report.Truncated = info.Size() - db.outOffset
+	}
+	if err := db.loadSecondary(); err != nil {
+		return err
+	}
+	return db.loadQueues()
 }
 
 func (db *Db) Close() error {
-	if db.closeChan != nil {
+	if !db.readOnly {
 		close(db.closeChan)
+		db.background.Wait()
+		<-db.loopDone
+	}
+	err := db.out.Close()
+	if keyErr := db.closeKeyFile(); err == nil {
+		err = keyErr
 	}
-	return db.out.Close()
+	if lockErr := db.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+func (db *Db) closeKeyFile() error {
+	if db.keyFile == nil {
+		return nil
+	}
+	return db.keyFile.Close()
 }
 
 func (db *Db) Get(key string) (string, error) {
@@ -160,7 +509,7 @@ func (db *Db) Get(key string) (string, error) {
 		return "", err
 	}
 	if typ != typeString {
-		return "", fmt.Errorf("type mismatch: expected %s, got %s", typeString, typ)
+		return "", fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, typeString, typ)
 	}
 	return string(data), nil
 }
@@ -171,124 +520,191 @@ func (db *Db) GetInt64(key string) (int64, error) {
 		return 0, err
 	}
 	if typ != typeInt64 {
-		return 0, fmt.Errorf("type mismatch: expected %s, got %s", typeInt64, typ)
+		return 0, fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, typeInt64, typ)
 	}
 	return int64(binary.LittleEndian.Uint64(data)), nil
 }
 
-func (db *Db) getWithType(key string) ([]byte, string, error) {
-	db.muIndex.RLock()
-	position, ok := db.index[key]
-	db.muIndex.RUnlock()
-	if !ok {
-		return nil, "", ErrNotFound
+// GetTyped returns the raw value stored under key and its type.
+func (db *Db) GetTyped(key string) ([]byte, string, error) {
+	return db.getWithType(key)
+}
+
+// Meta describes a stored value.
+type Meta struct {
+	Type string
+	// WrittenAt is zero for values written before write times were recorded.
+	WrittenAt time.Time
+	// Size is the length of the value in bytes.
+	Size int64
+}
+
+// GetWithMeta returns the raw value stored under key along with its type and
+// the time it was written.
+func (db *Db) GetWithMeta(key string) ([]byte, Meta, error) {
+	record, err := db.readEntry(key)
+	if err != nil {
+		return nil, Meta{}, err
 	}
+	return record.value, Meta{
+		Type:      record.Type,
+		WrittenAt: writeTime(record.ts),
+		Size:      int64(len(record.value)),
+	}, nil
+}
 
-	file, err := os.Open(db.out.Name())
+func (db *Db) getWithType(key string) ([]byte, string, error) {
+	record, err := db.readEntry(key)
 	if err != nil {
 		return nil, "", err
 	}
+	return record.value, record.Type, nil
+}
+
+func (db *Db) readEntry(key string) (entry, error) {
+	var record entry
+	file, position, ops, err := db.openRecord(key)
+	if err != nil {
+		return record, err
+	}
 	defer file.Close()
 
 	_, err = file.Seek(position, 0)
 	if err != nil {
-		return nil, "", err
+		return record, err
 	}
 
-	var record entry
-	if _, err = record.DecodeFromReader(bufio.NewReader(file)); err != nil {
-		return nil, "", err
+	_, err = record.decodeFromReader(bufio.NewReader(file), db.maxRecordSize)
+	if isCorruption(err) {
+		db.listener.CorruptionDetected(db.dir, &CorruptionError{Offset: position, Err: err})
 	}
-	return record.value, record.Type, nil
+	if err != nil || ops == nil {
+		return record, err
+	}
+	chain, err := db.readChain(file, record, ops)
+	if err != nil {
+		return entry{}, err
+	}
+	return db.fold(chain)
 }
 
-func (db *Db) Put(key, value string) error {
-	resp := make(chan error)
-	db.writeChan <- writeRequest{
-		key:   key,
-		value: []byte(value),
-		typ:   typeString,
-		resp:  resp,
+// openRecord resolves the key and opens the data file under the same read lock,
+// so the offset always refers to the file it was indexed against even if a
+// compaction swaps both right after the lock is released. ops is not nil if
+// the record has to be folded with the merge operands at ops.
+func (db *Db) openRecord(key string) (file File, offset int64, ops []recordPos, err error) {
+	db.muIndex.RLock()
+	defer db.muIndex.RUnlock()
+
+	pos, ok, err := db.indexGet(key)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if !ok {
+		return nil, 0, nil, ErrNotFound
+	}
+	file, err = openRead(db.fs, db.outPath)
+	if err != nil {
+		return nil, 0, nil, err
 	}
-	return <-resp
+	ops = db.chain(key)
+	return file, pos.offset, ops, nil
+}
+
+func (db *Db) Put(key, value string) error {
+	return db.write(key, []byte(value), typeString)
 }
 
 func (db *Db) PutInt64(key string, value int64) error {
 	data := make([]byte, 8)
 	binary.LittleEndian.PutUint64(data, uint64(value))
-
-	resp := make(chan error)
-	db.writeChan <- writeRequest{
-		key:   key,
-		value: data,
-		typ:   typeInt64,
-		resp:  resp,
-	}
-	return <-resp
+	return db.write(key, data, typeInt64)
 }
 
-func (db *Db) rollSegment() error {
-	oldName := db.out.Name()
-	backupName := oldName + ".bak"
-
-	if err := db.out.Close(); err != nil {
-		return err
-	}
-	if err := os.Rename(oldName, backupName); err != nil {
+func (db *Db) PutTyped(key, typ string, value []byte) error {
+	if err := checkTyped(typ, value); err != nil {
 		return err
 	}
+	return db.write(key, value, typ)
+}
 
-	newFile, err := os.OpenFile(oldName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
-	if err != nil {
-		_ = os.Rename(backupName, oldName)
-		return err
-	}
+func (db *Db) Delete(key string) error {
+	return db.write(key, nil, typeTombstone)
+}
 
-	backupFile, err := os.Open(backupName)
-	if err != nil {
-		_ = newFile.Close()
-		_ = os.Rename(backupName, oldName)
+func (db *Db) write(key string, value []byte, typ string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := checkKey(key); err != nil {
 		return err
 	}
-	defer backupFile.Close()
-
-	reader := bufio.NewReader(backupFile)
-	latest := make(map[string]entry)
+	return db.send(writeRequest{
+		key:   key,
+		value: value,
+		typ:   typ,
+	})
+}
 
-	for {
-		var rec entry
-		_, err := rec.DecodeFromReader(reader)
-		if err == io.EOF {
-			break
+// send hands req to the write loop and waits for the result. In
+// non-blocking mode a full queue fails it with ErrBusy.
+func (db *Db) send(req writeRequest) error {
+	req.resp = make(chan error, 1)
+	if db.nonBlocking {
+		select {
+		case db.writeChan <- req:
+		case <-db.closeChan:
+			return ErrClosed
+		default:
+			db.rejected.Add(1)
+			return ErrBusy
 		}
-		if err != nil {
-			_ = newFile.Close()
-			_ = os.Rename(backupName, oldName)
-			return fmt.Errorf("decode error: %w", err)
+	} else {
+		select {
+		case db.writeChan <- req:
+		case <-db.closeChan:
+			return ErrClosed
 		}
-		latest[rec.key] = rec
 	}
+	return db.wait(req.resp)
+}
 
-	db.out = newFile
-	db.outOffset = 0
-	db.index = make(hashIndex)
-
-	for k, e := range latest {
-		n, err := db.out.Write(e.Encode())
-		if err != nil {
-			_ = db.out.Close()
-			_ = os.Rename(backupName, oldName)
-			return fmt.Errorf("write error: %w", err)
+// wait returns the result of a request handed to the write loop. A request
+// still queued when the loop stops fails with ErrClosed.
+func (db *Db) wait(resp chan error) error {
+	select {
+	case err := <-resp:
+		return err
+	case <-db.loopDone:
+		select {
+		case err := <-resp:
+			return err
+		default:
+			return ErrClosed
 		}
-		db.index[k] = db.outOffset
-		db.outOffset += int64(n)
 	}
+}
 
-	_ = os.Remove(backupName)
-	return nil
+// runOnWriter executes op on the write loop, so it does not interleave with
+// writes. ctx only bounds the wait for its turn.
+func (db *Db) runOnWriter(ctx context.Context, op func() error) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	resp := make(chan error, 1)
+	select {
+	case db.writeChan <- writeRequest{op: op, resp: resp}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.closeChan:
+		return ErrClosed
+	}
+	return db.wait(resp)
 }
 
 func (db *Db) Size() (int64, error) {
+	db.muIndex.RLock()
+	defer db.muIndex.RUnlock()
 	info, err := db.out.Stat()
 	if err != nil {
 		return 0, err
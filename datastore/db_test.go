@@ -1,8 +1,15 @@
 package datastore
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDb(t *testing.T) {
@@ -172,3 +179,343 @@ func TestGetInt64WrongType(t *testing.T) {
 		}
 	})
 }
+
+func TestConcurrentGetDuringCompaction(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := OpenWithSegmentLimit(tmp, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	const keys = 8
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("key%d-0", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%d", i%keys)
+				val, err := db.Get(key)
+				if err != nil {
+					errs <- fmt.Errorf("get %s: %w", key, err)
+					return
+				}
+				if !strings.HasPrefix(val, key+"-") {
+					errs <- fmt.Errorf("get %s returned a foreign value %q", key, val)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 500; i++ {
+		key := fmt.Sprintf("key%d", i%keys)
+		if err := db.Put(key, fmt.Sprintf("%s-%d", key, i)); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestOpenLocked(t *testing.T) {
+	tmp := t.TempDir()
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(tmp); !errors.Is(err, ErrLocked) {
+		t.Errorf("second writer: expected ErrLocked, got %v", err)
+	}
+	if _, err := Open(tmp, ReadOnly()); !errors.Is(err, ErrLocked) {
+		t.Errorf("reader next to a writer: expected ErrLocked, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r1, err := Open(tmp, ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	r2, err := Open(tmp, ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+
+	if val, err := r2.Get("k"); err != nil || val != "v" {
+		t.Errorf("read-only Get = %q, %v", val, err)
+	}
+	if err := r1.Put("k", "v2"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("read-only Put: expected ErrReadOnly, got %v", err)
+	}
+	if _, err := Open(tmp); !errors.Is(err, ErrLocked) {
+		t.Errorf("writer next to readers: expected ErrLocked, got %v", err)
+	}
+}
+
+func TestDeleteSurvivesRecoveryAndCompaction(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("gone", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if _, err := db.Get("gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after recovery, got %v", err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after compaction, got %v", err)
+	}
+	if val, err := db.Get("kept"); err != nil || val != "v" {
+		t.Errorf("Get(kept) = %q, %v", val, err)
+	}
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithMaxRecordSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("big", strings.Repeat("x", 64)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("big", strings.Repeat("x", 64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(tmp, WithMaxRecordSize(64)); !errors.Is(err, ErrMalformedRecord) {
+		t.Errorf("expected ErrMalformedRecord for an oversized record on disk, got %v", err)
+	}
+}
+
+func FuzzRecover(f *testing.F) {
+	tmp := f.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		f.Fatal(err)
+	}
+	_ = db.Put("key", "value")
+	_ = db.PutInt64("n", 1)
+	_ = db.Delete("n")
+	var b Batch
+	b.Put("a", "1")
+	b.Put("b", "2")
+	_ = db.Write(&b)
+	_ = db.Close()
+	data, err := os.ReadFile(filepath.Join(tmp, outFileName))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add(data[headerSize:])
+	f.Add(data[:len(data)-3])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := NewMemFS()
+		file, err := fs.OpenFile(filepath.Join("db", outFileName), os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := Open("db", WithFS(fs), WithMaxRecordSize(1<<16))
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		for _, key := range []string{"key", "a", "b", "n"} {
+			_, _ = db.Get(key)
+		}
+	})
+}
+
+func TestGetWithMetaSurvivesCompaction(t *testing.T) {
+	tmp := t.TempDir()
+	clock := newTestClock()
+	db, err := Open(tmp, clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := clock.time()
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Hour)
+	if err := db.Put("other", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, meta, err := db.GetWithMeta("k"); err != nil || !meta.WrittenAt.Equal(written) {
+		t.Errorf("GetWithMeta(k) = %+v, %v; want written at %s", meta, err, written)
+	}
+}
+
+// blockWriter parks the write loop until the returned function is called.
+func blockWriter(t *testing.T, db *Db) func() {
+	t.Helper()
+	parked, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = db.runOnWriter(context.Background(), func() error {
+			close(parked)
+			<-release
+			return nil
+		})
+	}()
+	<-parked
+	return func() { close(release) }
+}
+
+func waitForQueue(t *testing.T, db *Db, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().QueueLen != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue never reached %d writes", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteQueueBusy(t *testing.T) {
+	db, err := Open(t.TempDir(), WithWriteQueue(1), NonBlocking())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	release := blockWriter(t, db)
+	queued := make(chan error, 1)
+	go func() {
+		queued <- db.Put("queued", "v")
+	}()
+	waitForQueue(t, db, 1)
+
+	if err := db.Put("k", "v"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Put on a full queue: expected ErrBusy, got %v", err)
+	}
+	var b Batch
+	b.Put("k", "v")
+	if err := db.Write(&b); !errors.Is(err, ErrBusy) {
+		t.Errorf("Write on a full queue: expected ErrBusy, got %v", err)
+	}
+	if s := db.Stats(); s.QueueLen != 1 || s.QueueCap != 1 || s.Rejected != 2 {
+		t.Errorf("unexpected queue stats %+v", s)
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Fatalf("queued write failed: %v", err)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Errorf("Put after the queue drained: %v", err)
+	}
+}
+
+func TestCloseWithQueuedWrites(t *testing.T) {
+	db, err := Open(t.TempDir(), WithWriteQueue(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := blockWriter(t, db)
+	queued := make(chan error, 3)
+	for i := 0; i < cap(queued); i++ {
+		go func() {
+			queued <- db.Put(fmt.Sprint("k", i), "v")
+		}()
+	}
+	waitForQueue(t, db, cap(queued))
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close()
+	}()
+	release()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	// Every queued write either made it before the loop stopped or failed.
+	for i := 0; i < cap(queued); i++ {
+		if err := <-queued; err != nil && !errors.Is(err, ErrClosed) {
+			t.Errorf("queued write: expected success or ErrClosed, got %v", err)
+		}
+	}
+}
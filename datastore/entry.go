@@ -2,27 +2,50 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 )
 
+const (
+	// maxRecordSize is the largest record the 4 byte size field can describe.
+	maxRecordSize = math.MaxUint32
+	// minRecordSize holds the size field and three empty length-prefixed fields.
+	minRecordSize = 4 * 4
+	// readChunk bounds the buffer allocated up front when reading a record.
+	readChunk = 1 << 20
+)
+
+var ErrMalformedRecord = errors.New("malformed record")
+
 type entry struct {
 	key      string
 	value    []byte
 	Type     string
 	Checksum []byte
+	// seq is the sequence number, 0 in formats without them.
+	seq uint64
+	// ts is the write time in Unix nanoseconds, 0 if unknown. Only records
+	// with a sequence number have one.
+	ts int64
 }
 
 // 0           4    8     kl+8  kl+12     <-- offset
 // (full size) (kl) (key) (vl)  (value)
 // 4           4    ....  4     .....     <-- length
+//
+// The value is followed by the length-prefixed type, then the sequence
+// number (8 bytes), the write time (8 bytes) and the checksum (20 bytes) if
+// the format has them. All are optional and the time never comes without the
+// sequence number, so the number of trailing bytes tells which are present.
 
 func (e *entry) Encode() []byte {
 	kl, vl, tl := len(e.key), len(e.value), len(e.Type)
-	size := 4 + 4 + kl + 4 + vl + 4 + tl + len(e.Checksum)
+	size := 4 + 4 + kl + 4 + vl + 4 + tl + e.metaSize() + len(e.Checksum)
 
 	res := make([]byte, size)
 	offset := 0
@@ -45,6 +68,7 @@ func (e *entry) Encode() []byte {
 	copy(res[offset:], e.Type)
 	offset += tl
 
+	offset += copy(res[offset:], e.appendMeta(nil))
 	if len(e.Checksum) > 0 {
 		copy(res[offset:], e.Checksum)
 	}
@@ -52,29 +76,112 @@ func (e *entry) Encode() []byte {
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
+// metaSize is the number of bytes the sequence number and write time take.
+func (e *entry) metaSize() int {
+	switch {
+	case e.seq == 0:
+		return 0
+	case e.ts == 0:
+		return 8
+	}
+	return 16
+}
+
+func (e *entry) appendMeta(b []byte) []byte {
+	if e.seq != 0 {
+		b = binary.LittleEndian.AppendUint64(b, e.seq)
+		if e.ts != 0 {
+			b = binary.LittleEndian.AppendUint64(b, uint64(e.ts))
+		}
+	}
+	return b
+}
+
+// Decode parses a single record. Every length field is checked against the
+// bytes actually present, so a malformed record is reported rather than read
+// out of bounds.
+func (e *entry) Decode(input []byte) error {
+	if len(input) < minRecordSize {
+		return fmt.Errorf("%w: %d bytes, need at least %d", ErrMalformedRecord, len(input), minRecordSize)
+	}
+	if size := binary.LittleEndian.Uint32(input); int64(size) != int64(len(input)) {
+		return fmt.Errorf("%w: size field %d does not match the %d bytes read", ErrMalformedRecord, size, len(input))
+	}
 	offset := 4
 
-	kl := binary.LittleEndian.Uint32(input[offset:])
-	offset += 4
-	e.key = string(input[offset : offset+int(kl)])
-	offset += int(kl)
+	field := func(name string) ([]byte, error) {
+		if len(input)-offset < 4 {
+			return nil, fmt.Errorf("%w: %s length at %d is cut off", ErrMalformedRecord, name, offset)
+		}
+		l := int64(binary.LittleEndian.Uint32(input[offset:]))
+		offset += 4
+		if l > int64(len(input)-offset) {
+			return nil, fmt.Errorf("%w: %s length %d exceeds the %d bytes left", ErrMalformedRecord, name, l, len(input)-offset)
+		}
+		data := input[offset : offset+int(l)]
+		offset += int(l)
+		return data, nil
+	}
 
-	vl := binary.LittleEndian.Uint32(input[offset:])
-	offset += 4
-	e.value = make([]byte, vl)
-	copy(e.value, input[offset:offset+int(vl)])
-	offset += int(vl)
+	key, err := field("key")
+	if err != nil {
+		return err
+	}
+	value, err := field("value")
+	if err != nil {
+		return err
+	}
+	typ, err := field("type")
+	if err != nil {
+		return err
+	}
 
-	tl := binary.LittleEndian.Uint32(input[offset:])
-	offset += 4
-	e.Type = string(input[offset : offset+int(tl)])
-	offset += int(tl)
+	rest := len(input) - offset
+	meta, hasChecksum, ok := trailer(int64(rest))
+	if !ok {
+		return fmt.Errorf("%w: %d trailing bytes do not match any record layout", ErrMalformedRecord, rest)
+	}
+	var (
+		seq uint64
+		ts  int64
+	)
+	if meta >= 8 {
+		if seq = binary.LittleEndian.Uint64(input[offset:]); seq == 0 {
+			return fmt.Errorf("%w: sequence number 0", ErrMalformedRecord)
+		}
+		offset += 8
+	}
+	if meta == 16 {
+		if ts = int64(binary.LittleEndian.Uint64(input[offset:])); ts == 0 {
+			return fmt.Errorf("%w: write time 0", ErrMalformedRecord)
+		}
+		offset += 8
+	}
+	var checksum []byte
+	if hasChecksum {
+		checksum = append([]byte(nil), input[offset:]...)
+	}
 
-	if offset < len(input) {
-		e.Checksum = make([]byte, sha1.Size)
-		copy(e.Checksum, input[offset:])
+	e.key = string(key)
+	e.value = append(make([]byte, 0, len(value)), value...)
+	e.Type = string(typ)
+	e.Checksum = checksum
+	e.seq = seq
+	e.ts = ts
+	return nil
+}
+
+// trailer tells which optional fields follow the type of a record, given the
+// number of bytes left after it: meta is 8 for a sequence number and 16 for a
+// sequence number and a write time.
+func trailer(rest int64) (meta int64, checksum, ok bool) {
+	switch rest {
+	case 0, 8, 16:
+		return rest, false, true
+	case sha1.Size, 8 + sha1.Size, 16 + sha1.Size:
+		return rest - sha1.Size, true, true
 	}
+	return 0, false, false
 }
 
 func decodeString(v []byte) string {
@@ -85,6 +192,13 @@ func decodeString(v []byte) string {
 }
 
 func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
+	return e.decodeFromReader(in, maxRecordSize)
+}
+
+// decodeFromReader reads one record of at most limit bytes. Memory is only
+// committed as the record's bytes actually arrive, so a corrupted size field
+// cannot make it allocate more than the input holds.
+func (e *entry) decodeFromReader(in *bufio.Reader, limit int64) (int, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
@@ -92,14 +206,29 @@ func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
 		}
 		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
-	size := int(binary.LittleEndian.Uint32(sizeBuf))
-	buf := make([]byte, size)
-	n, err := in.Read(buf[:])
+	size := int64(binary.LittleEndian.Uint32(sizeBuf))
+	if size < minRecordSize {
+		return 0, fmt.Errorf("DecodeFromReader: %w: size %d is below the minimum of %d", ErrMalformedRecord, size, minRecordSize)
+	}
+	if size > limit {
+		return 0, fmt.Errorf("DecodeFromReader: %w: size %d exceeds the limit of %d", ErrMalformedRecord, size, limit)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, min(size, readChunk)))
+	n, err := io.CopyN(buf, in, size)
 	if err != nil {
-		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return int(n), fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
 	}
-	e.Decode(buf)
-	return n, nil
+	if err := e.Decode(buf.Bytes()); err != nil {
+		return int(n), fmt.Errorf("DecodeFromReader: %w", err)
+	}
+	if !e.verify() {
+		return int(n), fmt.Errorf("DecodeFromReader, key %q: %w", e.key, ErrChecksumMismatch)
+	}
+	return int(n), nil
 }
 
 func (e *entry) CalculateChecksum() {
@@ -110,3 +239,62 @@ func (e *entry) CalculateChecksum() {
 	hash := sha1.Sum(e.value)
 	e.Checksum = hash[:]
 }
+
+// verify reports whether the stored checksum, if any, matches the value.
+func (e *entry) verify() bool {
+	if len(e.Checksum) == 0 {
+		return true
+	}
+	hash := sha1.Sum(e.value)
+	return bytes.Equal(e.Checksum, hash[:])
+}
+
+// streamedSize is the size of the record e with a vl bytes long value.
+func streamedSize(e *entry, vl int64, checksum bool) int64 {
+	size := 4 + 4 + int64(len(e.key)) + 4 + vl + 4 + int64(len(e.Type)) + int64(e.metaSize())
+	if checksum && vl > 0 {
+		size += sha1.Size
+	}
+	return size
+}
+
+// encodeStream writes the record e the same way Encode does, but reads the
+// value from value instead of holding it in memory. The checksum is computed
+// on the fly.
+func encodeStream(w io.Writer, e *entry, value io.Reader, vl int64, checksum bool) (int64, error) {
+	key, typ := e.key, e.Type
+	size := streamedSize(e, vl, checksum)
+	if size > maxRecordSize {
+		return 0, ErrTooLarge
+	}
+
+	prefix := make([]byte, 4+4+len(key)+4)
+	binary.LittleEndian.PutUint32(prefix, uint32(size))
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(key)))
+	copy(prefix[8:], key)
+	binary.LittleEndian.PutUint32(prefix[8+len(key):], uint32(vl))
+	written, err := w.Write(prefix)
+	if err != nil {
+		return int64(written), err
+	}
+
+	hash := sha1.New()
+	copied, err := io.CopyN(io.MultiWriter(w, hash), value, vl)
+	total := int64(written) + copied
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return total, err
+	}
+
+	suffix := make([]byte, 4+len(typ))
+	binary.LittleEndian.PutUint32(suffix, uint32(len(typ)))
+	copy(suffix[4:], typ)
+	suffix = e.appendMeta(suffix)
+	if checksum && vl > 0 {
+		suffix = hash.Sum(suffix)
+	}
+	written, err = w.Write(suffix)
+	return total + int64(written), err
+}
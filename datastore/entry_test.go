@@ -4,6 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
 	"testing"
 )
 
@@ -18,7 +21,9 @@ func TestEntry_EncodeDecode(t *testing.T) {
 	encoded := original.Encode()
 
 	var decoded entry
-	decoded.Decode(encoded)
+	if err := decoded.Decode(encoded); err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
 
 	if decoded.key != original.key {
 		t.Errorf("expected key %q, got %q", original.key, decoded.key)
@@ -68,3 +73,134 @@ func TestEntry_DecodeFromReader(t *testing.T) {
 		t.Errorf("checksum mismatch")
 	}
 }
+
+func TestEntry_DecodeFromReaderLargeRecord(t *testing.T) {
+	original := entry{
+		key:   "big",
+		value: bytes.Repeat([]byte{'x'}, 64*1024),
+		Type:  "string",
+	}
+	original.CalculateChecksum()
+	encoded := original.Encode()
+
+	var decoded entry
+	n, err := decoded.DecodeFromReader(bufio.NewReaderSize(bytes.NewReader(encoded), 16))
+	if err != nil {
+		t.Fatalf("DecodeFromReader error: %v", err)
+	}
+	if n != len(encoded) {
+		t.Errorf("expected to read %d bytes, got %d", len(encoded), n)
+	}
+	if !bytes.Equal(decoded.value, original.value) {
+		t.Errorf("value mismatch")
+	}
+}
+
+func TestEntry_DecodeMalformed(t *testing.T) {
+	valid := (&entry{key: "key", value: []byte("value"), Type: typeString}).Encode()
+	withSize := func(data []byte, size uint32) []byte {
+		data = bytes.Clone(data)
+		binary.LittleEndian.PutUint32(data, size)
+		return data
+	}
+	withField := func(at int, length uint32) []byte {
+		data := bytes.Clone(valid)
+		binary.LittleEndian.PutUint32(data[at:], length)
+		return data
+	}
+
+	tests := map[string][]byte{
+		"empty":           nil,
+		"too short":       valid[:8],
+		"size mismatch":   withSize(valid, uint32(len(valid)+1)),
+		"key too long":    withField(4, 1000),
+		"value too long":  withField(4+4+3, 1<<31),
+		"type too long":   withField(4+4+3+4+5, 100),
+		"trailing bytes":  withSize(append(bytes.Clone(valid), 1, 2, 3), uint32(len(valid)+3)),
+		"truncated field": withSize(valid[:len(valid)-len(typeString)-2], uint32(len(valid)-len(typeString)-2)),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			var e entry
+			if err := e.Decode(data); !errors.Is(err, ErrMalformedRecord) {
+				t.Errorf("expected ErrMalformedRecord, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEntry_DecodeFromReaderHugeSize(t *testing.T) {
+	data := make([]byte, 64)
+	binary.LittleEndian.PutUint32(data, 0xFFFFFFF0)
+
+	var e entry
+	_, err := e.decodeFromReader(bufio.NewReader(bytes.NewReader(data)), maxRecordSize)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected ErrUnexpectedEOF, got %v", err)
+	}
+	_, err = e.decodeFromReader(bufio.NewReader(bytes.NewReader(data)), 1024)
+	if !errors.Is(err, ErrMalformedRecord) {
+		t.Errorf("expected ErrMalformedRecord, got %v", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add((&entry{key: "key", value: []byte("value"), Type: typeString}).Encode())
+	withChecksum := entry{key: "k", value: []byte("v"), Type: typeInt64}
+	withChecksum.CalculateChecksum()
+	f.Add(withChecksum.Encode())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var e entry
+		if err := e.Decode(data); err != nil {
+			return
+		}
+		if encoded := e.Encode(); !bytes.Equal(encoded, data) {
+			t.Errorf("re-encoding a decoded record gave %x, want %x", encoded, data)
+		}
+	})
+}
+
+func FuzzDecodeFromReader(f *testing.F) {
+	valid := (&entry{key: "key", value: []byte("value"), Type: typeString}).Encode()
+	f.Add(valid)
+	f.Add(append(bytes.Clone(valid), valid...))
+	f.Add(valid[:len(valid)/2])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		in := bufio.NewReader(bytes.NewReader(data))
+		read := 0
+		for {
+			var e entry
+			n, err := e.decodeFromReader(in, 1<<16)
+			read += n
+			if read > len(data) {
+				t.Fatalf("read %d bytes from %d byte input", read, len(data))
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestEntry_EncodeDecodeMeta(t *testing.T) {
+	for _, original := range []entry{
+		{key: "k", value: []byte("v"), Type: typeString, seq: 7},
+		{key: "k", value: []byte("v"), Type: typeString, seq: 7, ts: 1700000000000000000},
+		{key: "k", Type: typeTombstone, seq: 8, ts: -1},
+	} {
+		original.CalculateChecksum()
+		var decoded entry
+		if err := decoded.Decode(original.Encode()); err != nil {
+			t.Fatalf("Decode error: %v", err)
+		}
+		if decoded.seq != original.seq || decoded.ts != original.ts {
+			t.Errorf("decoded seq %d, time %d; want %d, %d", decoded.seq, decoded.ts, original.seq, original.ts)
+		}
+		if !bytes.Equal(decoded.Checksum, original.Checksum) {
+			t.Errorf("checksum mismatch")
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+)
+
+const (
+	// Import writes a batch once it holds importBatchLen records or
+	// importBatchBytes bytes of values, whichever comes first.
+	importBatchLen   = 1000
+	importBatchBytes = 1 << 20
+)
+
+// ExportRecord is one line of an export. Value is a JSON string for string
+// values, a number for int64 values, the document itself for JSONCodec values
+// and base64 encoded bytes for everything else.
+type ExportRecord struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Export writes the live value of every key to w as newline-delimited JSON,
+// in file order. The export is a consistent snapshot: writes that land while
+// it runs are not included. Index definitions, queues and locks are not
+// exported.
+func (db *Db) Export(w io.Writer) error {
+	db.muIndex.RLock()
+	live, err := db.liveRecords("")
+	if err != nil {
+		db.muIndex.RUnlock()
+		return err
+	}
+	dropped := maps.Clone(db.dropped)
+	merges := make(map[string][]recordPos, len(db.merges))
+	for key := range db.merges {
+		merges[key] = db.chain(key)
+	}
+	f, err := openRead(db.fs, db.outPath)
+	db.muIndex.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out := newExporter(w)
+	err = db.readRecords(f, live, dropped, func(key string, e entry) error {
+		if reservedKey(key) {
+			return nil
+		}
+		if ops, ok := merges[key]; ok {
+			chain, err := db.readChain(f, e, ops)
+			if err != nil {
+				return err
+			}
+			if e, err = db.fold(chain); err != nil {
+				return err
+			}
+		}
+		return out.write(key, e.Type, e.value)
+	})
+	if err != nil {
+		return err
+	}
+	return out.flush()
+}
+
+// Import reads an export from r and writes it in batches, so every chunk of
+// records is applied atomically. On error the chunks written so far stay in
+// place; the returned count says how many records made it.
+func (db *Db) Import(r io.Reader) (int, error) {
+	return importRecords(r, db.Write)
+}
+
+type exporter struct {
+	out *bufio.Writer
+	enc *json.Encoder
+}
+
+func newExporter(w io.Writer) *exporter {
+	out := bufio.NewWriter(w)
+	return &exporter{out: out, enc: json.NewEncoder(out)}
+}
+
+func (x *exporter) write(key, typ string, value []byte) error {
+	data, err := exportValue(typ, value)
+	if err != nil {
+		return fmt.Errorf("export %q: %w", key, err)
+	}
+	return x.enc.Encode(ExportRecord{Key: key, Type: typ, Value: data})
+}
+
+func (x *exporter) flush() error {
+	return x.out.Flush()
+}
+
+func exportValue(typ string, value []byte) (json.RawMessage, error) {
+	switch typ {
+	case typeString:
+		return json.Marshal(string(value))
+	case typeInt64:
+		if len(value) != 8 {
+			return nil, fmt.Errorf("%w: int64 value of %d bytes", ErrTypeMismatch, len(value))
+		}
+		return strconv.AppendInt(nil, int64(binary.LittleEndian.Uint64(value)), 10), nil
+	case typeJSON:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, value); err == nil {
+			return buf.Bytes(), nil
+		}
+		return nil, fmt.Errorf("invalid JSON value")
+	default:
+		return json.Marshal(value)
+	}
+}
+
+func importValue(typ string, data json.RawMessage) ([]byte, error) {
+	switch typ {
+	case typeString:
+		var s string
+		err := json.Unmarshal(data, &s)
+		return []byte(s), err
+	case typeInt64:
+		var n int64
+		err := json.Unmarshal(data, &n)
+		return binary.LittleEndian.AppendUint64(nil, uint64(n)), err
+	case typeJSON:
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("invalid JSON value")
+		}
+		return bytes.Clone(data), nil
+	default:
+		var b []byte
+		err := json.Unmarshal(data, &b)
+		return b, err
+	}
+}
+
+// importRecords decodes an export and hands it to write in batches.
+func importRecords(r io.Reader, write func(*Batch) error) (int, error) {
+	dec := json.NewDecoder(r)
+	var (
+		b        Batch
+		size     int
+		imported int
+	)
+	flush := func() error {
+		if b.Len() == 0 {
+			return nil
+		}
+		if err := write(&b); err != nil {
+			return err
+		}
+		imported += b.Len()
+		b, size = Batch{}, 0
+		return nil
+	}
+
+	for n := 1; ; n++ {
+		var rec ExportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("import record %d: %w", n, err)
+		}
+		value, err := importValue(rec.Type, rec.Value)
+		if err == nil {
+			err = checkTyped(rec.Type, value)
+		}
+		if err == nil {
+			err = checkKey(rec.Key)
+		}
+		if err != nil {
+			return imported, fmt.Errorf("import record %d, key %q: %w", n, rec.Key, err)
+		}
+
+		b.PutTyped(rec.Key, rec.Type, value)
+		size += len(value)
+		if b.Len() >= importBatchLen || size >= importBatchBytes {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return imported, err
+	}
+	return imported, nil
+}
@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExportSkipsIndexDefinitions(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateIndex("name", "name"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", `{"name":"a"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"key":"k","type":"string","value":"{\"name\":\"a\"}"}` + "\n"; buf.String() != want {
+		t.Errorf("Export = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestImportAppliesChunksBeforeAnError(t *testing.T) {
+	var in strings.Builder
+	for i := 0; i < importBatchLen+10; i++ {
+		fmt.Fprintf(&in, `{"key":"k%d","type":"string","value":"v"}`+"\n", i)
+	}
+	in.WriteString(`{"key":"bad","type":"int64","value":"not a number"}` + "\n")
+
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n, err := db.Import(strings.NewReader(in.String()))
+	if err == nil {
+		t.Fatal("expected an error for the malformed record")
+	}
+	if n != importBatchLen {
+		t.Errorf("expected the first chunk of %d records to be imported, got %d", importBatchLen, n)
+	}
+	if _, err := db.Get("k0"); err != nil {
+		t.Errorf("Get(k0): %v", err)
+	}
+	if _, err := db.Get(fmt.Sprintf("k%d", importBatchLen)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the unfinished chunk to be dropped, got %v", err)
+	}
+}
+
+func TestImportRejectsReservedTypes(t *testing.T) {
+	s := NewMemStore()
+	_, err := s.Import(strings.NewReader(`{"key":"k","type":"tombstone","value":""}`))
+	if !errors.Is(err, ErrReservedType) {
+		t.Errorf("expected ErrReservedType, got %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Data files start with a header:
+//
+// 0       4         8       12        20   <-- offset
+// (magic) (version) (flags) (horizon)      <-- header
+// 4       4         4       8              <-- length
+//
+// The horizon only exists since formatV3. Files written before the header was
+// introduced are treated as formatV1.
+
+const (
+	formatV1 uint32 = iota + 1
+	formatV2
+	formatV3
+
+	currentFormat = formatV3
+	headerSize    = 12
+)
+
+const (
+	// flagChecksum means every non-empty value is followed by its SHA-1.
+	flagChecksum uint32 = 1 << iota
+	// flagSequence means every record carries its sequence number, see
+	// Db.ChangesSince.
+	flagSequence
+	// flagTimestamp means records written since carry their write time, see
+	// Db.History. Records numbered on an upgrade have none.
+	flagTimestamp
+)
+
+var headerMagic = []byte("KPDB")
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported data file format")
+	ErrChecksumMismatch  = errors.New("record checksum mismatch")
+)
+
+type segmentHeader struct {
+	version uint32
+	flags   uint32
+	// horizon is the last sequence number a compaction may have dropped
+	// changes up to.
+	horizon uint64
+}
+
+var currentHeader = segmentHeader{version: currentFormat, flags: flagChecksum | flagSequence | flagTimestamp}
+
+// format drops the horizon, leaving what decides the layout of records.
+func (h segmentHeader) format() segmentHeader {
+	return segmentHeader{version: h.version, flags: h.flags}
+}
+
+func (h segmentHeader) size() int64 {
+	switch h.version {
+	case formatV1:
+		return 0
+	case formatV2:
+		return headerSize
+	}
+	return headerSize + 8
+}
+
+func (h segmentHeader) Encode() []byte {
+	res := make([]byte, h.size())
+	copy(res, headerMagic)
+	binary.LittleEndian.PutUint32(res[4:], h.version)
+	binary.LittleEndian.PutUint32(res[8:], h.flags)
+	if h.version >= formatV3 {
+		binary.LittleEndian.PutUint64(res[12:], h.horizon)
+	}
+	return res
+}
+
+// readHeader consumes the header from in. A file that does not start with the
+// magic is a headerless formatV1 file and nothing is consumed. An empty file
+// reports the current format.
+func readHeader(in *bufio.Reader) (segmentHeader, error) {
+	magic, err := in.Peek(len(headerMagic))
+	if errors.Is(err, io.EOF) && len(magic) == 0 {
+		return currentHeader, nil
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return segmentHeader{}, fmt.Errorf("readHeader: %w", err)
+	}
+	if !bytes.Equal(magic, headerMagic) {
+		return segmentHeader{version: formatV1}, nil
+	}
+
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(in, buf); err != nil {
+		return segmentHeader{}, fmt.Errorf("readHeader: truncated header: %w", err)
+	}
+	h := segmentHeader{
+		version: binary.LittleEndian.Uint32(buf[4:]),
+		flags:   binary.LittleEndian.Uint32(buf[8:]),
+	}
+	if h.version < formatV2 || h.version > currentFormat {
+		return segmentHeader{}, fmt.Errorf("%w: version %d", ErrUnsupportedFormat, h.version)
+	}
+	if h.version >= formatV3 {
+		if _, err := io.ReadFull(in, buf[:8]); err != nil {
+			return segmentHeader{}, fmt.Errorf("readHeader: truncated header: %w", err)
+		}
+		h.horizon = binary.LittleEndian.Uint64(buf)
+	}
+	return h, nil
+}
+
+// prepare fills the fields that the header's flags require and clears the
+// ones the format has no room for.
+func (h segmentHeader) prepare(e *entry) {
+	if h.flags&flagChecksum != 0 {
+		e.CalculateChecksum()
+	} else {
+		e.Checksum = nil
+	}
+	if h.flags&flagSequence == 0 {
+		e.seq = 0
+	}
+	if h.flags&flagTimestamp == 0 || e.seq == 0 {
+		e.ts = 0
+	}
+}
+
+// upgrade converts a record read from an older format to the current one.
+// Formats without sequence numbers get them from next, records wrapped in a
+// batch included.
+func upgrade(e *entry, from segmentHeader, next func() uint64) error {
+	if from.flags&flagSequence == 0 {
+		if e.Type == typeBatch {
+			var value []byte
+			err := splitBatch(e.value, func(_, _ int64, inner entry) {
+				inner.seq = next()
+				currentHeader.prepare(&inner)
+				value = append(value, inner.Encode()...)
+			})
+			if err != nil {
+				return err
+			}
+			e.value = value
+		} else {
+			e.seq = next()
+		}
+	}
+	currentHeader.prepare(e)
+	return nil
+}
+
+// Migrate rewrites the data file in dir to the current format, keeping every
+// record. It takes the directory lock, so the db must not be open.
+func Migrate(dir string, opts ...Option) error {
+	o := buildOptions(opts)
+	fs := o.fs
+	lock, err := fs.Lock(dir, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	path := filepath.Join(dir, outFileName)
+	current, err := openRead(fs, path)
+	if err != nil {
+		return err
+	}
+	defer current.Close()
+
+	in := bufio.NewReader(current)
+	h, err := readHeader(in)
+	if err != nil {
+		return err
+	}
+	if h.format() == currentHeader {
+		return nil
+	}
+
+	tmpPath := path + ".migrate"
+	tmp, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	discard := func(err error) error {
+		_ = tmp.Close()
+		_ = fs.Remove(tmpPath)
+		return err
+	}
+
+	out := bufio.NewWriter(tmp)
+	header := currentHeader
+	header.horizon = h.horizon
+	if _, err := out.Write(header.Encode()); err != nil {
+		return discard(err)
+	}
+	var seq uint64
+	next := func() uint64 {
+		seq++
+		return seq
+	}
+	for {
+		var rec entry
+		_, err := rec.decodeFromReader(in, o.maxRecordSize)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return discard(fmt.Errorf("migrate: %w", err))
+		}
+		if err := upgrade(&rec, h, next); err != nil {
+			return discard(fmt.Errorf("migrate: %w", err))
+		}
+		if _, err := out.Write(rec.Encode()); err != nil {
+			return discard(err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return discard(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return discard(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return discard(err)
+	}
+	return fs.Rename(tmpPath, path)
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeLegacyFile(t *testing.T, dir string, records ...entry) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, rec := range records {
+		buf.Write(rec.Encode())
+	}
+	if err := os.WriteFile(filepath.Join(dir, outFileName), buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenLegacyFormat(t *testing.T) {
+	tmp := t.TempDir()
+	writeLegacyFile(t, tmp,
+		entry{key: "k1", value: []byte("v1"), Type: typeString},
+		entry{key: "k2", value: []byte("v2"), Type: typeString},
+	)
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.header.version != formatV1 {
+		t.Errorf("expected legacy format, got version %d", db.header.version)
+	}
+	if err := db.Put("k3", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"} {
+		if val, err := db.Get(key); err != nil || val != expected {
+			t.Errorf("Get(%q) = %q, %v; want %q", key, val, err, expected)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tmp := t.TempDir()
+	writeLegacyFile(t, tmp,
+		entry{key: "k1", value: []byte("v1"), Type: typeString},
+		entry{key: "k1", value: []byte("v1.1"), Type: typeString},
+	)
+
+	if err := Migrate(tmp); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmp, outFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, headerMagic) {
+		t.Fatalf("migrated file has no header")
+	}
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if db.header != currentHeader {
+		t.Errorf("expected current format after migration, got %+v", db.header)
+	}
+	if val, err := db.Get("k1"); err != nil || val != "v1.1" {
+		t.Errorf("Get(k1) = %q, %v; want v1.1", val, err)
+	}
+
+	if err := Migrate(tmp); !errors.Is(err, ErrLocked) {
+		t.Errorf("Migrate on an open db: expected ErrLocked, got %v", err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("value"), []byte("VALUE"), 1)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(tmp); err == nil {
+		t.Errorf("expected Open to detect the corrupted record")
+	}
+}
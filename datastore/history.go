@@ -0,0 +1,240 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HistoryPolicy controls which superseded versions of a key compaction keeps.
+// A version survives if it is one of the last Versions before the current
+// one, or if it was still current within Window of the compaction. Keeping a
+// version of a deleted key keeps the delete as well. The zero value keeps no
+// history.
+type HistoryPolicy struct {
+	Versions int
+	Window   time.Duration
+}
+
+// WithHistory makes compaction keep old versions for Db.History and
+// Db.GetAt. Keys of a dropped bucket lose their history regardless.
+func WithHistory(p HistoryPolicy) Option {
+	return func(o *options) {
+		o.history = p
+	}
+}
+
+func (p HistoryPolicy) enabled() bool {
+	return p.Versions > 0 || p.Window > 0
+}
+
+// Version is one value a key had. Deletes have the tombstone type and keys
+// removed with their bucket the dropbucket type; neither has a value.
+type Version struct {
+	Seq uint64
+	// Time is when the version was written, zero for records written before
+	// write times were recorded.
+	Time  time.Time
+	Type  string
+	Value []byte
+}
+
+func (v Version) deleted() bool {
+	return v.Type == typeTombstone || v.Type == typeDropBucket
+}
+
+// History returns the versions of key still in the data file, oldest first.
+// Versions the history policy keeps are always there; older ones show up
+// until a compaction drops them. Only the records of key are read: the db
+// keeps the offsets of replaced records in memory until compaction.
+func (db *Db) History(key string) ([]Version, error) {
+	_, versions, err := db.versions(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return versions, nil
+}
+
+// GetAt returns the value key had at t and its type. It fails with
+// ErrCompacted if the version current at t may have been dropped by a
+// compaction, and with ErrUnsupportedFormat on files without write times.
+func (db *Db) GetAt(key string, t time.Time) ([]byte, string, error) {
+	h, versions, err := db.versions(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if h.flags&flagTimestamp == 0 {
+		return nil, "", fmt.Errorf("%w: version %d has no write times", ErrUnsupportedFormat, h.version)
+	}
+
+	var (
+		at    Version
+		found bool
+	)
+	for _, v := range versions {
+		if v.Time.After(t) {
+			continue
+		}
+		at, found = v, true
+	}
+	switch {
+	case !found && len(versions) > 0 && versions[0].Seq <= h.horizon:
+		return nil, "", fmt.Errorf("%w: %q has no version before %s left", ErrCompacted, key, versions[0].Time.Format(time.RFC3339Nano))
+	case !found || at.deleted():
+		return nil, "", ErrNotFound
+	}
+	return at.Value, at.Type, nil
+}
+
+// versions reads every version of key still in the data file. Only the
+// records of key and the drops of its bucket are read, found through the
+// index and the superseded offsets kept for every key written more than once.
+func (db *Db) versions(key string) (segmentHeader, []Version, error) {
+	db.muIndex.RLock()
+	h := db.header
+	records, err := db.versionRecords(key)
+	if err != nil {
+		db.muIndex.RUnlock()
+		return h, nil, err
+	}
+	f, err := openRead(db.fs, db.outPath)
+	db.muIndex.RUnlock()
+	if err != nil {
+		return h, nil, err
+	}
+	defer f.Close()
+
+	var versions []Version
+	for _, rec := range records {
+		e, err := db.readRecordAt(f, rec.offset)
+		if err != nil {
+			return h, nil, fmt.Errorf("read record at %d: %w", rec.offset, err)
+		}
+		if !rec.drop {
+			versions = append(versions, Version{Seq: e.seq, Time: writeTime(e.ts), Type: e.Type, Value: e.value})
+		} else if len(versions) > 0 && !versions[len(versions)-1].deleted() {
+			versions = append(versions, Version{Seq: e.seq, Time: writeTime(e.ts), Type: e.Type})
+		}
+	}
+	return h, versions, nil
+}
+
+type versionRecord struct {
+	offset int64
+	drop   bool
+}
+
+// versionRecords lists the records of key and the drops of its bucket in
+// file order. Callers hold muIndex.
+func (db *Db) versionRecords(key string) ([]versionRecord, error) {
+	var records []versionRecord
+	for _, at := range db.superseded[key] {
+		records = append(records, versionRecord{offset: at})
+	}
+	// Keys of a dropped bucket stay indexed until compaction, their last
+	// version is still in the file.
+	pos, ok, err := db.index.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		records = append(records, versionRecord{offset: pos.offset})
+		for _, op := range db.merges[key] {
+			records = append(records, versionRecord{offset: op.offset})
+		}
+	}
+	if name, _, ok := strings.Cut(key, bucketSeparator); ok {
+		for _, at := range db.drops[name] {
+			records = append(records, versionRecord{offset: at, drop: true})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].offset < records[j].offset
+	})
+	return records, nil
+}
+
+// supersede remembers that the record of key at offset was replaced, so
+// History still finds it. Callers hold muIndex or have exclusive access.
+func (db *Db) supersede(key string, offset int64) {
+	db.superseded[key] = append(db.superseded[key], offset)
+}
+
+// remapVersions moves the superseded and drop offsets into the new file
+// after a compaction, forgetting the records it did not copy. Callers hold
+// muIndex.
+func remapVersions(offsets map[string][]int64, relocate func(recordPos) (recordPos, bool)) map[string][]int64 {
+	moved := make(map[string][]int64, len(offsets))
+	for key, list := range offsets {
+		var kept []int64
+		for _, at := range list {
+			if pos, ok := relocate(recordPos{offset: at}); ok {
+				kept = append(kept, pos.offset)
+			}
+		}
+		if len(kept) > 0 {
+			moved[key] = kept
+		}
+	}
+	return moved
+}
+
+func writeTime(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ts)
+}
+
+type historyRecord struct {
+	offset int64
+	size   int64
+	ts     int64
+	typ    string
+}
+
+// retained lists the superseded records of the file up to end that the
+// history policy keeps, deletes included. The current records are left to
+// liveRecords.
+func (db *Db) retained(f File, h segmentHeader, end int64, now time.Time) ([]indexedRecord, error) {
+	versions := make(map[string][]historyRecord)
+	err := db.readLog(f, h, end, func(offset, size int64, e entry) error {
+		if e.Type == typeDropBucket {
+			prefix := bucketPrefix(e.key)
+			for k := range versions {
+				if strings.HasPrefix(k, prefix) {
+					delete(versions, k)
+				}
+			}
+			return nil
+		}
+		versions[e.key] = append(versions[e.key], historyRecord{offset: offset, size: size, ts: e.ts, typ: e.Type})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := now.Add(-db.history.Window).UnixNano()
+	var kept []indexedRecord
+	for _, records := range versions {
+		last := len(records) - 1
+		var keep []indexedRecord
+		for i, rec := range records[:last] {
+			recent := last-i <= db.history.Versions
+			current := db.history.Window > 0 && records[i+1].ts >= cutoff
+			if recent || current {
+				keep = append(keep, indexedRecord{offset: rec.offset, size: rec.size, old: true})
+			}
+		}
+		if len(keep) > 0 && records[last].typ == typeTombstone {
+			keep = append(keep, indexedRecord{offset: records[last].offset, size: records[last].size, old: true})
+		}
+		kept = append(kept, keep...)
+	}
+	return kept, nil
+}
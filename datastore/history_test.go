@@ -0,0 +1,271 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock is a clock for the db that only moves when told to.
+type testClock struct {
+	now atomic.Int64
+}
+
+func newTestClock() *testClock {
+	c := &testClock{}
+	c.now.Store(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).UnixNano())
+	return c
+}
+
+func (c *testClock) option() Option {
+	return func(o *options) {
+		o.now = c.time
+	}
+}
+
+func (c *testClock) time() time.Time {
+	return time.Unix(0, c.now.Load())
+}
+
+func (c *testClock) advance(d time.Duration) time.Time {
+	return time.Unix(0, c.now.Add(int64(d)))
+}
+
+func historyValues(t *testing.T, db *Db, key string) string {
+	t.Helper()
+	versions, err := db.History(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]string, len(versions))
+	for i, v := range versions {
+		values[i] = v.Type + ":" + string(v.Value)
+	}
+	return strings.Join(values, " ")
+}
+
+func TestHistory(t *testing.T) {
+	clock := newTestClock()
+	db, err := Open(t.TempDir(), clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	start := clock.time()
+	for _, v := range []string{"1", "2"} {
+		clock.advance(time.Minute)
+		if err := db.Put("k", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(time.Minute)
+	var b Batch
+	b.Put("k", "3")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Minute)
+	if err := db.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := historyValues(t, db, "k"); got != "string:1 string:2 string:3 tombstone:" {
+		t.Fatalf("history = %q", got)
+	}
+	versions, _ := db.History("k")
+	for i, v := range versions {
+		if want := start.Add(time.Duration(i+1) * time.Minute); !v.Time.Equal(want) || v.Seq != uint64(i)+1 {
+			t.Errorf("version %d written at %s with seq %d, want %s", i, v.Time, v.Seq, want)
+		}
+	}
+	if _, err := db.History("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing key, got %v", err)
+	}
+
+	for offset, want := range map[time.Duration]string{
+		90 * time.Second:  "1",
+		2 * time.Minute:   "2",
+		3*time.Minute + 1: "3",
+		4*time.Minute - 1: "3",
+		30 * time.Second:  "",
+		4 * time.Minute:   "",
+		24 * time.Hour:    "",
+	} {
+		value, typ, err := db.GetAt("k", start.Add(offset))
+		if want == "" {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetAt(+%s): expected ErrNotFound, got %q, %v", offset, value, err)
+			}
+			continue
+		}
+		if err != nil || typ != typeString || string(value) != want {
+			t.Errorf("GetAt(+%s) = %q, %s, %v; want %q", offset, value, typ, err, want)
+		}
+	}
+}
+
+func TestHistoryKeptByCompaction(t *testing.T) {
+	tmp := t.TempDir()
+	clock := newTestClock()
+	db, err := Open(tmp, clock.option(), WithHistory(HistoryPolicy{Versions: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := clock.time()
+	for _, v := range []string{"1", "2", "3"} {
+		clock.advance(time.Minute)
+		if err := db.Put("k", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("deleted", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Bucket("b").Put("x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Bucket("b").Put("x", "z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := historyValues(t, db, "k"); got != "string:2 string:3" {
+		t.Errorf("history of k = %q", got)
+	}
+	if got := historyValues(t, db, "deleted"); got != "string:x tombstone:" {
+		t.Errorf("history of deleted = %q", got)
+	}
+	if _, err := db.History("b\x00x"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the history of a dropped bucket to be gone, got %v", err)
+	}
+	if _, _, err := db.GetAt("k", start.Add(90*time.Second)); !errors.Is(err, ErrCompacted) {
+		t.Errorf("expected ErrCompacted before the oldest kept version, got %v", err)
+	}
+	if value, _, err := db.GetAt("k", start.Add(150*time.Second)); err != nil || string(value) != "2" {
+		t.Errorf("GetAt = %q, %v; want 2", value, err)
+	}
+	if s := db.Stats(); s.HistoryBytes == 0 || s.DeadBytes != 0 {
+		t.Errorf("expected only history bytes after compaction, got %+v", s)
+	}
+
+	// Kept versions must not come back as live values on recovery.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp, clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("k"); err != nil || value != "3" {
+		t.Errorf("Get(k) = %q, %v; want 3", value, err)
+	}
+	if _, err := db.Get("deleted"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected deleted to stay deleted, got %v", err)
+	}
+	if got := historyValues(t, db, "k"); got != "string:2 string:3" {
+		t.Errorf("history of k after reopening = %q", got)
+	}
+}
+
+func TestHistoryWindow(t *testing.T) {
+	clock := newTestClock()
+	db, err := Open(t.TempDir(), clock.option(), WithHistory(HistoryPolicy{Window: 10 * time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, step := range []struct {
+		after time.Duration
+		value string
+	}{{0, "1"}, {time.Minute, "2"}, {30 * time.Minute, "3"}, {time.Minute, "4"}} {
+		clock.advance(step.after)
+		if err := db.Put("k", step.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(5 * time.Minute)
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 1 was replaced long ago, 2 and 3 were current within the window.
+	if got := historyValues(t, db, "k"); got != "string:2 string:3 string:4" {
+		t.Errorf("history = %q", got)
+	}
+}
+
+func TestGetAtLegacyFormat(t *testing.T) {
+	tmp := t.TempDir()
+	writeLegacyFile(t, tmp, entry{key: "k", value: []byte("v"), Type: typeString})
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if got := historyValues(t, db, "k"); got != "string:v" {
+		t.Errorf("history = %q", got)
+	}
+	if _, _, err := db.GetAt("k", time.Now()); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestHistoryAcrossDrops(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"1", "2", "3"} {
+		if err := db.Bucket("b").Put("x", v); err != nil {
+			t.Fatal(err)
+		}
+		if v != "3" {
+			if err := db.DropBucket("b"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	want := "string:1 dropbucket: string:2 dropbucket: string:3"
+	if got := historyValues(t, db, "b\x00x"); got != want {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := historyValues(t, db, "b\x00x"); got != want {
+		t.Errorf("history after reopening = %q, want %q", got, want)
+	}
+
+	// Without a history policy compaction leaves nothing to remember.
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := historyValues(t, db, "b\x00x"); got != "string:3" {
+		t.Errorf("history after compaction = %q", got)
+	}
+	if len(db.superseded) != 0 || len(db.drops) != 0 {
+		t.Errorf("expected no superseded records after compaction, got %v and %v", db.superseded, db.drops)
+	}
+}
@@ -0,0 +1,302 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Index definitions are stored as ordinary string records in this bucket,
+// keyed by index name with the JSON path as the value, so they survive
+// compaction and are picked up again on recovery.
+const indexBucket = "_index"
+
+var (
+	ErrIndexExists   = errors.New("index already exists")
+	ErrIndexNotFound = errors.New("index does not exist")
+)
+
+// IndexedKey is a key found by Lookup. Bucket is empty for keys of the
+// default key space.
+type IndexedKey struct {
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key"`
+}
+
+func indexedKey(key string) IndexedKey {
+	if name, rest, ok := strings.Cut(key, bucketSeparator); ok {
+		return IndexedKey{Bucket: name, Key: rest}
+	}
+	return IndexedKey{Key: key}
+}
+
+// sortIndexedKeys orders keys by bucket, the default key space first, then
+// by key.
+func sortIndexedKeys(keys []IndexedKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Bucket != keys[j].Bucket {
+			return keys[i].Bucket < keys[j].Bucket
+		}
+		return keys[i].Key < keys[j].Key
+	})
+}
+
+// secondaryIndex maps the value of a JSON document field to the keys of the
+// documents holding it. Only string and JSONCodec values that decode to a
+// JSON object are indexed, and only if the field is a scalar.
+type secondaryIndex struct {
+	path    []string
+	byValue map[string]map[string]struct{}
+	byKey   map[string]string
+}
+
+func newSecondaryIndex(path string) (*secondaryIndex, error) {
+	fields := parseJSONPath(path)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid JSON path %q", path)
+	}
+	return &secondaryIndex{
+		path:    fields,
+		byValue: make(map[string]map[string]struct{}),
+		byKey:   make(map[string]string),
+	}, nil
+}
+
+// parseJSONPath accepts dotted paths such as "user.name" or "$.user.name".
+func parseJSONPath(path string) []string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil
+	}
+	fields := strings.Split(path, ".")
+	for _, f := range fields {
+		if f == "" {
+			return nil
+		}
+	}
+	return fields
+}
+
+// fieldValue extracts the indexed field from a document. Strings are
+// returned as is, other scalars in their JSON form.
+func (idx *secondaryIndex) fieldValue(doc []byte) (string, bool) {
+	var cur any
+	if err := json.Unmarshal(doc, &cur); err != nil {
+		return "", false
+	}
+	for _, f := range idx.path {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if cur, ok = obj[f]; !ok {
+			return "", false
+		}
+	}
+	switch v := cur.(type) {
+	case string:
+		return v, true
+	case map[string]any, []any:
+		return "", false
+	default:
+		data, _ := json.Marshal(v)
+		return string(data), true
+	}
+}
+
+func (idx *secondaryIndex) remove(key string) {
+	old, ok := idx.byKey[key]
+	if !ok {
+		return
+	}
+	delete(idx.byKey, key)
+	delete(idx.byValue[old], key)
+	if len(idx.byValue[old]) == 0 {
+		delete(idx.byValue, old)
+	}
+}
+
+func (idx *secondaryIndex) add(key string, doc []byte) {
+	idx.remove(key)
+	value, ok := idx.fieldValue(doc)
+	if !ok {
+		return
+	}
+	keys := idx.byValue[value]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		idx.byValue[value] = keys
+	}
+	keys[key] = struct{}{}
+	idx.byKey[key] = value
+}
+
+func (idx *secondaryIndex) update(key, typ string, value []byte) {
+	switch typ {
+	case typeString, typeJSON:
+		idx.add(key, value)
+	case typeDropBucket:
+		prefix := bucketPrefix(key)
+		for k := range idx.byKey {
+			if strings.HasPrefix(k, prefix) {
+				idx.remove(k)
+			}
+		}
+	default:
+		idx.remove(key)
+	}
+}
+
+func (idx *secondaryIndex) lookup(value string) []IndexedKey {
+	keys := make([]IndexedKey, 0, len(idx.byValue[value]))
+	for k := range idx.byValue[value] {
+		keys = append(keys, indexedKey(k))
+	}
+	sortIndexedKeys(keys)
+	return keys
+}
+
+func isIndexDefinition(key string) bool {
+	return strings.HasPrefix(key, bucketPrefix(indexBucket))
+}
+
+// updateSecondary applies a committed record to every secondary index.
+// Callers hold muIndex.
+func (db *Db) updateSecondary(key, typ string, value []byte) {
+	if isIndexDefinition(key) {
+		return
+	}
+	for _, idx := range db.secondary {
+		idx.update(key, typ, value)
+	}
+}
+
+// CreateIndex starts indexing the field at jsonPath of every JSON document
+// stored as a string or with JSONCodec. Existing documents are indexed right
+// away.
+func (db *Db) CreateIndex(name, jsonPath string) error {
+	if name == "" {
+		return fmt.Errorf("missing index name")
+	}
+	idx, err := newSecondaryIndex(jsonPath)
+	if err != nil {
+		return err
+	}
+	return db.runOnWriter(context.Background(), func() error {
+		db.muIndex.RLock()
+		_, exists := db.secondary[name]
+		db.muIndex.RUnlock()
+		if exists {
+			return ErrIndexExists
+		}
+
+		err := db.forEachRecord("", func(key string, e entry) {
+			if !isIndexDefinition(key) {
+				idx.update(key, e.Type, e.value)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if err := db.writeEntry(bucketPrefix(indexBucket)+name, []byte(jsonPath), typeString); err != nil {
+			return err
+		}
+
+		db.muIndex.Lock()
+		db.secondary[name] = idx
+		db.muIndex.Unlock()
+		return nil
+	})
+}
+
+// Lookup returns the keys of the documents whose indexed field equals value.
+func (db *Db) Lookup(index, value string) ([]IndexedKey, error) {
+	db.muIndex.RLock()
+	defer db.muIndex.RUnlock()
+	idx, ok := db.secondary[index]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	return idx.lookup(value), nil
+}
+
+// loadSecondary rebuilds the secondary indexes from their stored definitions.
+func (db *Db) loadSecondary() error {
+	prefix := bucketPrefix(indexBucket)
+	if db.buckets[indexBucket].keys == 0 {
+		return nil
+	}
+	err := db.forEachRecord(prefix, func(key string, e entry) {
+		if name := strings.TrimPrefix(key, prefix); e.Type == typeString {
+			if idx, err := newSecondaryIndex(string(e.value)); err == nil {
+				db.secondary[name] = idx
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return db.forEachRecord("", func(key string, e entry) {
+		db.updateSecondary(key, e.Type, e.value)
+	})
+}
+
+// forEachRecord reads the live record of every key starting with prefix, in
+// file order. It must run on the write loop or before it starts, so the index
+// does not change underneath.
+func (db *Db) forEachRecord(prefix string, fn func(key string, e entry)) error {
+	f, err := openRead(db.fs, db.outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	live, err := db.liveRecords(prefix)
+	if err != nil {
+		return err
+	}
+	return db.readRecords(f, live, db.dropped, func(key string, e entry) error {
+		if ops, ok := db.merges[key]; ok {
+			chain, err := db.readChain(f, e, ops)
+			if err != nil {
+				return err
+			}
+			// A key whose operands do not fold has no value to show.
+			if e, err = db.fold(chain); err != nil {
+				return nil
+			}
+		}
+		fn(key, e)
+		return nil
+	})
+}
+
+// readRecords decodes the listed records from f, skipping the keys of
+// dropped buckets.
+func (db *Db) readRecords(f File, live []indexedRecord, dropped droppedBuckets, fn func(key string, e entry) error) error {
+	for _, rec := range live {
+		e, err := db.readRecordAt(f, rec.offset)
+		if err != nil {
+			return fmt.Errorf("read record at %d: %w", rec.offset, err)
+		}
+		if dropped.dead(e.key, rec.offset) {
+			continue
+		}
+		if err := fn(e.key, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRecordAt decodes the record at offset in f.
+func (db *Db) readRecordAt(f File, offset int64) (entry, error) {
+	var e entry
+	section := io.NewSectionReader(f, offset, db.maxRecordSize)
+	_, err := e.decodeFromReader(bufio.NewReader(section), db.maxRecordSize)
+	return e, err
+}
@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSecondaryIndexRecovery(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("by_city", "address.city"); err != nil {
+		t.Fatal(err)
+	}
+	for key, doc := range map[string]string{
+		"p1": `{"address": {"city": "Kyiv"}}`,
+		"p2": `{"address": {"city": "Lviv"}}`,
+		"p3": `{"address": {"city": "Kyiv"}}`,
+	} {
+		if err := db.Put(key, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("p3", `{"address": {"city": "Odesa"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	check := func() {
+		t.Helper()
+		for city, expected := range map[string][]IndexedKey{
+			"Kyiv":  {{Key: "p1"}},
+			"Lviv":  {{Key: "p2"}},
+			"Odesa": {{Key: "p3"}},
+		} {
+			keys, err := db.Lookup("by_city", city)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, expected) {
+				t.Errorf("Lookup(%s) = %v, want %v", city, keys, expected)
+			}
+		}
+	}
+	check()
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if _, ok := db.Buckets()[indexBucket]; ok {
+		t.Errorf("index definitions are reported as a user bucket")
+	}
+}
@@ -0,0 +1,177 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Types of the records seen by Scan that tools need to interpret. A key
+// inside a bucket is the bucket name, BucketSeparator and the key.
+const (
+	TypeString     = typeString
+	TypeInt64      = typeInt64
+	TypeTombstone  = typeTombstone
+	TypeDropBucket = typeDropBucket
+	// MergeTypePrefix starts the type of merge operands, followed by the
+	// name of the operator that wrote them.
+	MergeTypePrefix = mergeTypePrefix
+
+	BucketSeparator = bucketSeparator
+)
+
+// Record is a single record of the data file as seen by Scan.
+type Record struct {
+	Offset   int64
+	Size     int
+	Key      string
+	Type     string
+	Value    []byte
+	Checksum []byte
+	// Seq is the sequence number, 0 in formats without them.
+	Seq uint64
+	// Time is the write time, zero if the record has none.
+	Time time.Time
+}
+
+// CorruptionError reports the offset of the first record that cannot be read.
+type CorruptionError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted record at offset %d: %s", e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// FileStats summarises the data file: live bytes hold the latest record of a
+// key, dead bytes are records that a compaction would drop.
+type FileStats struct {
+	Version   uint32
+	Records   int
+	Keys      int
+	LiveBytes int64
+	DeadBytes int64
+}
+
+// Scan calls fn for every record of the data file in dir, in file order.
+// It takes a shared lock on dir, so it fails with ErrLocked while a writer
+// has the datastore open.
+func Scan(dir string, fn func(Record) error, opts ...Option) error {
+	_, err := scan(buildOptions(opts), dir, fn)
+	return err
+}
+
+func scan(o options, dir string, fn func(Record) error) (segmentHeader, error) {
+	lock, err := o.fs.Lock(dir, true)
+	if err != nil {
+		return segmentHeader{}, err
+	}
+	defer lock.Close()
+
+	f, err := openRead(o.fs, filepath.Join(dir, outFileName))
+	if err != nil {
+		return segmentHeader{}, err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	h, err := readHeader(in)
+	if err != nil {
+		return h, &CorruptionError{Offset: 0, Err: err}
+	}
+	offset := h.size()
+	for {
+		var rec entry
+		n, err := rec.decodeFromReader(in, o.maxRecordSize)
+		if errors.Is(err, io.EOF) && n == 0 {
+			return h, nil
+		}
+		if err != nil {
+			return h, &CorruptionError{Offset: offset, Err: err}
+		}
+		if rec.Type == typeBatch {
+			batchOffset := offset
+			err = splitBatch(rec.value, func(inner, size int64, e entry) {
+				if err == nil {
+					err = fn(Record{
+						Offset:   batchOffset + batchValueOffset + inner,
+						Size:     int(size),
+						Key:      e.key,
+						Type:     e.Type,
+						Value:    e.value,
+						Checksum: e.Checksum,
+						Seq:      e.seq,
+						Time:     writeTime(e.ts),
+					})
+				}
+			})
+			if err != nil {
+				return h, err
+			}
+			offset += int64(n)
+			continue
+		}
+		err = fn(Record{
+			Offset:   offset,
+			Size:     n,
+			Key:      rec.key,
+			Type:     rec.Type,
+			Value:    rec.value,
+			Checksum: rec.Checksum,
+			Seq:      rec.seq,
+			Time:     writeTime(rec.ts),
+		})
+		if err != nil {
+			return h, err
+		}
+		offset += int64(n)
+	}
+}
+
+// Stat scans the data file in dir and reports how much of it is live.
+func Stat(dir string, opts ...Option) (FileStats, error) {
+	var stats FileStats
+	latest := make(map[string]int)
+	h, err := scan(buildOptions(opts), dir, func(rec Record) error {
+		stats.Records++
+		switch rec.Type {
+		case typeTombstone:
+			stats.markDead(latest, rec.Key)
+			stats.DeadBytes += int64(rec.Size)
+		case typeDropBucket:
+			prefix := bucketPrefix(rec.Key)
+			for k := range latest {
+				if strings.HasPrefix(k, prefix) {
+					stats.markDead(latest, k)
+				}
+			}
+			stats.DeadBytes += int64(rec.Size)
+		default:
+			stats.markDead(latest, rec.Key)
+			latest[rec.Key] = rec.Size
+			stats.LiveBytes += int64(rec.Size)
+		}
+		return nil
+	})
+	stats.Version = h.version
+	stats.Keys = len(latest)
+	return stats, err
+}
+
+// markDead moves the live record of key, if any, to the dead bytes.
+func (s *FileStats) markDead(latest map[string]int, key string) {
+	if size, ok := latest[key]; ok {
+		delete(latest, key)
+		s.LiveBytes -= int64(size)
+		s.DeadBytes += int64(size)
+	}
+}
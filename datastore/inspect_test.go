@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanAndStat(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range [][]string{{"k1", "v1"}, {"k2", "v2"}, {"k1", "v1.1"}} {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Scan(tmp, func(Record) error { return nil }); !errors.Is(err, ErrLocked) {
+		t.Errorf("Scan next to a writer: expected ErrLocked, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = Scan(tmp, func(rec Record) error {
+		keys = append(keys, rec.Key)
+		if len(rec.Checksum) == 0 {
+			t.Errorf("record %q at %d has no checksum", rec.Key, rec.Offset)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] != "k1" || keys[2] != "k1" {
+		t.Errorf("unexpected scan order %v", keys)
+	}
+
+	stats, err := Stat(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Records != 3 || stats.Keys != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.DeadBytes == 0 || stats.LiveBytes == 0 {
+		t.Errorf("expected both live and dead bytes, got %+v", stats)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = Stat(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Records != 2 || stats.DeadBytes != 0 {
+		t.Errorf("unexpected stats after compaction %+v", stats)
+	}
+}
+
+func TestScanReportsCorruption(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Scan(tmp, func(Record) error { return nil })
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("expected CorruptionError, got %v", err)
+	}
+	if corruption.Offset <= headerSize {
+		t.Errorf("expected corruption in the second record, got offset %d", corruption.Offset)
+	}
+}
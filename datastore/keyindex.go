@@ -0,0 +1,324 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"strings"
+)
+
+// keyIndex maps every live key to its record. Callers hold muIndex or have
+// exclusive access to the db.
+type keyIndex interface {
+	get(key string) (recordPos, bool, error)
+	// put indexes key at pos and returns the position it replaces, if any.
+	put(key string, pos recordPos) (recordPos, bool, error)
+	// remove drops key and returns its position, if it was indexed.
+	remove(key string) (recordPos, bool, error)
+	len() int
+	// positions lists the position of every key, in no particular order.
+	positions() []recordPos
+	// scan calls fn for every key starting with prefix.
+	scan(prefix string, fn func(key string, pos recordPos)) error
+	// remap returns a copy of the index with every position passed through
+	// fn, leaving out the keys fn reports false for.
+	remap(fn func(recordPos) (recordPos, bool)) keyIndex
+}
+
+// WithCompactIndex keeps only a hash of every key in memory instead of the
+// key itself, with the record position packed next to it. Keys are read back
+// from the data file to tell colliding hashes apart, so overwrites, deletes
+// and lookups cost a read of the old record's key. It suits many long keys
+// that would not fit in memory.
+func WithCompactIndex() Option {
+	return func(o *options) {
+		o.compactIndex = true
+	}
+}
+
+// hashIndex is the default index, a map holding a copy of every key.
+type hashIndex map[string]recordPos
+
+func (m hashIndex) get(key string) (recordPos, bool, error) {
+	pos, ok := m[key]
+	return pos, ok, nil
+}
+
+func (m hashIndex) put(key string, pos recordPos) (recordPos, bool, error) {
+	old, ok := m[key]
+	m[key] = pos
+	return old, ok, nil
+}
+
+func (m hashIndex) remove(key string) (recordPos, bool, error) {
+	old, ok := m[key]
+	delete(m, key)
+	return old, ok, nil
+}
+
+func (m hashIndex) len() int {
+	return len(m)
+}
+
+func (m hashIndex) positions() []recordPos {
+	positions := make([]recordPos, 0, len(m))
+	for _, pos := range m {
+		positions = append(positions, pos)
+	}
+	return positions
+}
+
+func (m hashIndex) scan(prefix string, fn func(key string, pos recordPos)) error {
+	for k, pos := range m {
+		if strings.HasPrefix(k, prefix) {
+			fn(k, pos)
+		}
+	}
+	return nil
+}
+
+func (m hashIndex) remap(fn func(recordPos) (recordPos, bool)) keyIndex {
+	index := make(hashIndex, len(m))
+	for k, pos := range m {
+		if pos, ok := fn(pos); ok {
+			index[k] = pos
+		}
+	}
+	return index
+}
+
+const (
+	// offsetBits is the part of slot.loc holding the offset, the rest holds
+	// the segment id.
+	offsetBits = 48
+	maxOffset  = 1<<offsetBits - 1
+	// minSlots is the size of an empty compactIndex.
+	minSlots = 16
+)
+
+// slot is a packed compactIndex entry of 16 bytes. A zero size marks an
+// empty slot, no record is that short.
+type slot struct {
+	hash uint32
+	size uint32
+	// loc packs the segment id above the offset. The Db keeps a single data
+	// file, so the segment is always 0 for now.
+	loc uint64
+}
+
+func packSlot(hash uint32, pos recordPos) slot {
+	return slot{hash: hash, size: uint32(pos.size), loc: uint64(pos.offset) & maxOffset}
+}
+
+func (s slot) pos() recordPos {
+	return recordPos{offset: int64(s.loc & maxOffset), size: int64(s.size)}
+}
+
+// compactIndex is an open addressing hash table with linear probing. Its
+// slots hold a 32 bit hash of the key and the record position, keyAt reads a
+// key back from the data file to resolve collisions.
+type compactIndex struct {
+	slots []slot
+	n     int
+	seed  maphash.Seed
+	keyAt func(offset int64) (string, error)
+}
+
+func newCompactIndex(keyAt func(offset int64) (string, error)) *compactIndex {
+	return &compactIndex{
+		slots: make([]slot, minSlots),
+		seed:  maphash.MakeSeed(),
+		keyAt: keyAt,
+	}
+}
+
+func (c *compactIndex) hash(key string) uint32 {
+	h := maphash.String(c.seed, key)
+	return uint32(h) ^ uint32(h>>32)
+}
+
+func (c *compactIndex) mask() uint32 {
+	return uint32(len(c.slots) - 1)
+}
+
+// find returns the slot holding key, or the empty slot ending its probe
+// sequence and false.
+func (c *compactIndex) find(key string, h uint32) (uint32, bool, error) {
+	for i := h & c.mask(); ; i = (i + 1) & c.mask() {
+		s := c.slots[i]
+		if s.size == 0 {
+			return i, false, nil
+		}
+		if s.hash != h {
+			continue
+		}
+		k, err := c.keyAt(s.pos().offset)
+		if err != nil {
+			return 0, false, err
+		}
+		if k == key {
+			return i, true, nil
+		}
+	}
+}
+
+func (c *compactIndex) get(key string) (recordPos, bool, error) {
+	i, ok, err := c.find(key, c.hash(key))
+	if !ok || err != nil {
+		return recordPos{}, false, err
+	}
+	return c.slots[i].pos(), true, nil
+}
+
+func (c *compactIndex) put(key string, pos recordPos) (recordPos, bool, error) {
+	if pos.offset > maxOffset || pos.size > maxRecordSize {
+		return recordPos{}, false, fmt.Errorf("record at %d does not fit the compact index", pos.offset)
+	}
+	return c.set(key, c.hash(key), pos)
+}
+
+func (c *compactIndex) set(key string, h uint32, pos recordPos) (recordPos, bool, error) {
+	i, ok, err := c.find(key, h)
+	if err != nil {
+		return recordPos{}, false, err
+	}
+	if ok {
+		old := c.slots[i].pos()
+		c.slots[i] = packSlot(h, pos)
+		return old, true, nil
+	}
+	c.slots[i] = packSlot(h, pos)
+	c.n++
+	if c.n*4 > len(c.slots)*3 {
+		c.resize(len(c.slots) * 2)
+	}
+	return recordPos{}, false, nil
+}
+
+func (c *compactIndex) remove(key string) (recordPos, bool, error) {
+	return c.drop(key, c.hash(key))
+}
+
+func (c *compactIndex) drop(key string, h uint32) (recordPos, bool, error) {
+	i, ok, err := c.find(key, h)
+	if !ok || err != nil {
+		return recordPos{}, false, err
+	}
+	old := c.slots[i].pos()
+	c.clear(i)
+	return old, true, nil
+}
+
+// clear empties slot i and shifts back the slots after it that would no
+// longer be found, so probe sequences stay unbroken without tombstones.
+func (c *compactIndex) clear(i uint32) {
+	mask := c.mask()
+	for j := (i + 1) & mask; ; j = (j + 1) & mask {
+		s := c.slots[j]
+		if s.size == 0 {
+			break
+		}
+		// The slot may move to i only if i lies between its home and j.
+		home := s.hash & mask
+		if (j-home)&mask >= (j-i)&mask {
+			c.slots[i] = s
+			i = j
+		}
+	}
+	c.slots[i] = slot{}
+	c.n--
+}
+
+func (c *compactIndex) resize(size int) {
+	old := c.slots
+	c.slots = make([]slot, size)
+	mask := c.mask()
+	for _, s := range old {
+		if s.size == 0 {
+			continue
+		}
+		i := s.hash & mask
+		for c.slots[i].size != 0 {
+			i = (i + 1) & mask
+		}
+		c.slots[i] = s
+	}
+}
+
+func (c *compactIndex) len() int {
+	return c.n
+}
+
+func (c *compactIndex) positions() []recordPos {
+	positions := make([]recordPos, 0, c.n)
+	for _, s := range c.slots {
+		if s.size != 0 {
+			positions = append(positions, s.pos())
+		}
+	}
+	return positions
+}
+
+func (c *compactIndex) scan(prefix string, fn func(key string, pos recordPos)) error {
+	for _, s := range c.slots {
+		if s.size == 0 {
+			continue
+		}
+		k, err := c.keyAt(s.pos().offset)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(k, prefix) {
+			fn(k, s.pos())
+		}
+	}
+	return nil
+}
+
+func (c *compactIndex) remap(fn func(recordPos) (recordPos, bool)) keyIndex {
+	index := &compactIndex{
+		slots: make([]slot, len(c.slots)),
+		n:     c.n,
+		seed:  c.seed,
+		keyAt: c.keyAt,
+	}
+	for i, s := range c.slots {
+		if s.size == 0 {
+			continue
+		}
+		if pos, ok := fn(s.pos()); ok {
+			index.slots[i] = packSlot(s.hash, pos)
+		} else {
+			index.n--
+		}
+	}
+	if index.n < c.n {
+		// Leaving keys out breaks probe sequences, reinsert what is left.
+		index.resize(len(index.slots))
+	}
+	return index
+}
+
+// keyAt reads the key of the record at offset from the data file. It backs
+// the compact index, so callers hold muIndex like for any index access.
+func (db *Db) keyAt(offset int64) (string, error) {
+	return readKeyAt(db.keyFile, offset)
+}
+
+// readKeyAt reads the key of the record at offset in f without its value.
+func readKeyAt(f File, offset int64) (string, error) {
+	var header [8]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return "", fmt.Errorf("read key at %d: %w", offset, err)
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	kl := binary.LittleEndian.Uint32(header[4:])
+	if uint64(kl)+8 > uint64(size) {
+		return "", &CorruptionError{Offset: offset, Err: fmt.Errorf("%w: key length %d exceeds record size %d", ErrMalformedRecord, kl, size)}
+	}
+	key := make([]byte, kl)
+	if n, err := f.ReadAt(key, offset+8); n < len(key) {
+		return "", fmt.Errorf("read key at %d: %w", offset, err)
+	}
+	return string(key), nil
+}
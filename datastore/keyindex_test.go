@@ -0,0 +1,226 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestCompactIndexStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db, err := Open(t.TempDir(), WithCompactIndex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		return db
+	})
+}
+
+// memKeys stands in for the data file, mapping offsets to keys.
+type memKeys map[int64]string
+
+func (m memKeys) keyAt(offset int64) (string, error) {
+	key, ok := m[offset]
+	if !ok {
+		return "", fmt.Errorf("no record at %d", offset)
+	}
+	return key, nil
+}
+
+func TestCompactIndexCollisions(t *testing.T) {
+	keys := make(memKeys)
+	c := newCompactIndex(keys.keyAt)
+
+	// Every key lands on the same slot and has the same hash, so only the
+	// keys read back tell them apart.
+	const h = 5
+	for i := 0; i < 10; i++ {
+		offset := int64(100 * (i + 1))
+		keys[offset] = fmt.Sprintf("key%d", i)
+		if _, replaced, err := c.set(keys[offset], h, recordPos{offset: offset, size: 20}); err != nil || replaced {
+			t.Fatalf("set(%s) = %v, %v", keys[offset], replaced, err)
+		}
+	}
+	if c.len() != 10 {
+		t.Fatalf("len = %d, want 10", c.len())
+	}
+
+	if _, ok, err := c.drop("key3", h); err != nil || !ok {
+		t.Fatalf("drop(key3) = %v, %v", ok, err)
+	}
+	if _, ok, _ := c.find("key3", h); ok {
+		t.Error("key3 found after drop")
+	}
+	for i := 0; i < 10; i++ {
+		if i == 3 {
+			continue
+		}
+		key := fmt.Sprintf("key%d", i)
+		i, ok, err := c.find(key, h)
+		if err != nil || !ok {
+			t.Fatalf("find(%s) = %v, %v", key, ok, err)
+		}
+		if got := keys[c.slots[i].pos().offset]; got != key {
+			t.Errorf("find(%s) points at %s", key, got)
+		}
+	}
+
+	keys[2000] = "key5"
+	old, replaced, err := c.set("key5", h, recordPos{offset: 2000, size: 30})
+	if err != nil || !replaced || old.offset != 600 {
+		t.Errorf("set(key5) = %v, %v, %v", old, replaced, err)
+	}
+	if c.len() != 9 {
+		t.Errorf("len = %d, want 9", c.len())
+	}
+}
+
+func TestCompactIndexGrowAndShrink(t *testing.T) {
+	keys := make(memKeys)
+	c := newCompactIndex(keys.keyAt)
+	const n = 5000
+	for i := 0; i < n; i++ {
+		offset := int64(i + 1)
+		keys[offset] = fmt.Sprintf("key%d", i)
+		if _, _, err := c.put(keys[offset], recordPos{offset: offset, size: 16}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		if _, ok, err := c.remove(fmt.Sprintf("key%d", i)); err != nil || !ok {
+			t.Fatalf("remove(key%d) = %v, %v", i, ok, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		pos, ok, err := c.get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i%2 == 1; ok != want || ok && pos.offset != int64(i+1) {
+			t.Fatalf("get(key%d) = %v, %v", i, pos, ok)
+		}
+	}
+	if c.len() != n/2 {
+		t.Errorf("len = %d, want %d", c.len(), n/2)
+	}
+}
+
+func TestCompactIndexSurvivesCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, WithCompactIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, round)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+	}
+	var b Batch
+	b.Put("batch", "b")
+	b.Delete("key0")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected["batch"] = "b"
+	delete(expected, "key0")
+	if err := db.Bucket("tmp").Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		for key, want := range expected {
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, want)
+			}
+		}
+		if _, err := db.Get("key0"); err != ErrNotFound {
+			t.Errorf("Get(key0) error = %v, want ErrNotFound", err)
+		}
+		if _, err := db.Bucket("tmp").Get("k"); err != ErrNotFound {
+			t.Errorf("Get(tmp/k) error = %v, want ErrNotFound", err)
+		}
+		if keys := db.Stats().Keys; keys != len(expected) {
+			t.Errorf("Stats().Keys = %d, want %d", keys, len(expected))
+		}
+	}
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Put("key1", "after"); err != nil {
+		t.Fatal(err)
+	}
+	expected["key1"] = "after"
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, WithCompactIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+// benchmarkIndexMemory reports the heap an index of b.N keys takes per key.
+func benchmarkIndexMemory(b *testing.B, newIndex func(keys memKeys) keyIndex) {
+	keys := make(memKeys, b.N)
+	names := make([]string, b.N)
+	for i := range names {
+		names[i] = fmt.Sprintf("user:%08d:profile:settings", i)
+		keys[int64(i)*64] = names[i]
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+
+	index := newIndex(keys)
+	for i, name := range names {
+		// Keys in the index are read off the data file, so each is a new
+		// string rather than one the caller still holds.
+		key := string([]byte(name))
+		if _, _, err := index.put(key, recordPos{offset: int64(i) * 64, size: 64}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "heap-B/key")
+	runtime.KeepAlive(index)
+	runtime.KeepAlive(keys)
+	runtime.KeepAlive(names)
+}
+
+func BenchmarkIndexMemoryMap(b *testing.B) {
+	benchmarkIndexMemory(b, func(memKeys) keyIndex {
+		return make(hashIndex)
+	})
+}
+
+func BenchmarkIndexMemoryCompact(b *testing.B) {
+	benchmarkIndexMemory(b, func(keys memKeys) keyIndex {
+		return newCompactIndex(keys.keyAt)
+	})
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"errors"
+	"time"
+)
+
+// Listener is told what a Db does. Methods are called synchronously, some of
+// them on the write loop, so they should be quick and must not call back into
+// the Db. Embed NopListener to implement only some of them.
+type Listener interface {
+	RecoveryStarted(dir string)
+	RecoveryFinished(info RecoveryInfo)
+	CompactionStarted(dir string)
+	CompactionFinished(info CompactionInfo)
+	// WriteFailed reports a write that was not stored. The key is empty for
+	// batches. Deletes of missing keys are not failures.
+	WriteFailed(dir, key string, err error)
+	// CorruptionDetected reports a record that cannot be read, found either
+	// while recovering or while serving a read.
+	CorruptionDetected(dir string, err *CorruptionError)
+}
+
+// RecoveryInfo describes how a Db rebuilt its index when it was opened. An
+// LSM reports the records replayed from its log and leaves Keys at zero.
+type RecoveryInfo struct {
+	Dir      string
+	Records  int
+	Keys     int
+	Duration time.Duration
+	// Truncated is the number of bytes of a torn write cut off the file.
+	Truncated int64
+	Err       error
+}
+
+// CompactionInfo describes a finished or abandoned compaction.
+type CompactionInfo struct {
+	Dir      string
+	Duration time.Duration
+	// Size is the size of the new data file and Reclaimed the bytes it is
+	// smaller than the old one. Both are zero if Err is set.
+	Size      int64
+	Reclaimed int64
+	Err       error
+}
+
+// WithListener registers l for the events of the Db.
+func WithListener(l Listener) Option {
+	return func(o *options) {
+		o.listener = l
+	}
+}
+
+// NopListener ignores every event.
+type NopListener struct{}
+
+func (NopListener) RecoveryStarted(string)                      {}
+func (NopListener) RecoveryFinished(RecoveryInfo)               {}
+func (NopListener) CompactionStarted(string)                    {}
+func (NopListener) CompactionFinished(CompactionInfo)           {}
+func (NopListener) WriteFailed(string, string, error)           {}
+func (NopListener) CorruptionDetected(string, *CorruptionError) {}
+
+// isCorruption tells a record that cannot be decoded from a failure to read
+// it at all.
+func isCorruption(err error) bool {
+	return errors.Is(err, ErrMalformedRecord) || errors.Is(err, ErrChecksumMismatch)
+}
+
+// writeFailed reports err to the listener and returns it.
+func (db *Db) writeFailed(key string, err error) error {
+	db.listener.WriteFailed(db.dir, key, err)
+	return err
+}
@@ -0,0 +1,194 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingListener struct {
+	mu          sync.Mutex
+	events      []string
+	recovery    RecoveryInfo
+	compaction  CompactionInfo
+	writeErr    error
+	corruptions []*CorruptionError
+}
+
+func (l *recordingListener) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *recordingListener) RecoveryStarted(string) {
+	l.add("recovery started")
+}
+
+func (l *recordingListener) RecoveryFinished(info RecoveryInfo) {
+	l.add("recovery finished")
+	l.recovery = info
+}
+
+func (l *recordingListener) CompactionStarted(string) {
+	l.add("compaction started")
+}
+
+func (l *recordingListener) CompactionFinished(info CompactionInfo) {
+	l.add("compaction finished")
+	l.compaction = info
+}
+
+func (l *recordingListener) WriteFailed(_, key string, err error) {
+	l.add("write failed " + key)
+	l.writeErr = err
+}
+
+func (l *recordingListener) CorruptionDetected(_ string, err *CorruptionError) {
+	l.add("corruption")
+	l.corruptions = append(l.corruptions, err)
+}
+
+func (l *recordingListener) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.events, ", ")
+}
+
+func TestListenerRecovery(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put(fmt.Sprint("k", i%2), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A torn write at the end of the file.
+	f, err := os.OpenFile(filepath.Join(tmp, outFileName), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{100, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	l := &recordingListener{}
+	db, err = Open(tmp, WithListener(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := l.String(); got != "recovery started, recovery finished" {
+		t.Errorf("events = %q", got)
+	}
+	if r := l.recovery; r.Dir != tmp || r.Records != 3 || r.Keys != 2 || r.Truncated != 5 || r.Err != nil {
+		t.Errorf("unexpected recovery info %+v", r)
+	}
+}
+
+func TestListenerCompaction(t *testing.T) {
+	l := &recordingListener{}
+	db, err := Open(t.TempDir(), WithListener(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		if err := db.Put("k", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, _ := db.Size()
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := db.Size()
+
+	if got := l.String(); got != "recovery started, recovery finished, compaction started, compaction finished" {
+		t.Errorf("events = %q", got)
+	}
+	if c := l.compaction; c.Size != after || c.Reclaimed != before-after || c.Reclaimed <= 0 || c.Err != nil {
+		t.Errorf("unexpected compaction info %+v, file went from %d to %d bytes", c, before, after)
+	}
+
+}
+
+func TestListenerWriteFailed(t *testing.T) {
+	l := &recordingListener{}
+	db, err := Open(t.TempDir(), WithListener(l), WithMaxRecordSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Delete("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+	if err := db.Put("big", strings.Repeat("x", 100)); !errors.Is(err, ErrTooLarge) {
+		t.Fatal(err)
+	}
+	if got := l.String(); got != "recovery started, recovery finished, write failed big" || !errors.Is(l.writeErr, ErrTooLarge) {
+		t.Errorf("events = %q, error %v", got, l.writeErr)
+	}
+}
+
+func TestListenerCorruption(t *testing.T) {
+	tmp := t.TempDir()
+	l := &recordingListener{}
+	db, err := Open(tmp, WithListener(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, outFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("VALUE"), int64(bytes.Index(data, []byte("value")))); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if _, err := db.Get("key"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(tmp, WithListener(l)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected Open to fail with ErrChecksumMismatch, got %v", err)
+	}
+
+	if len(l.corruptions) != 2 {
+		t.Fatalf("expected a corruption on read and on recovery, got %q", l)
+	}
+	for _, c := range l.corruptions {
+		if c.Offset != currentHeader.size() || !errors.Is(c, ErrChecksumMismatch) {
+			t.Errorf("unexpected corruption %v", c)
+		}
+	}
+	if !errors.Is(l.recovery.Err, ErrChecksumMismatch) {
+		t.Errorf("expected the recovery to report the corruption, got %v", l.recovery.Err)
+	}
+}
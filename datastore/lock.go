@@ -0,0 +1,136 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Locks are stored in lockBucket under their name as a record of typeLock:
+//
+//	token (8) | expiresAt (8) | owner
+//
+// Releasing a lock expires its record instead of deleting it, so the token of
+// the last holder is still there to count on from. Files without sequence
+// numbers depend on that.
+const (
+	lockBucket = "_lock"
+	typeLock   = "lock"
+)
+
+var (
+	ErrLockHeld = errors.New("lock is held by another owner")
+	ErrLockLost = errors.New("lock is not held with this token")
+)
+
+// Lock is a lease on a named lock. Token is a fencing token: it grows with
+// every acquisition of the lock, so a resource can refuse requests carrying
+// a token lower than one it has already seen from a newer holder.
+type Lock struct {
+	Name      string
+	Owner     string
+	Token     uint64
+	ExpiresAt time.Time
+}
+
+func encodeLock(l Lock) []byte {
+	data := binary.LittleEndian.AppendUint64(nil, l.Token)
+	data = binary.LittleEndian.AppendUint64(data, uint64(l.ExpiresAt.UnixNano()))
+	return append(data, l.Owner...)
+}
+
+func decodeLock(name string, data []byte) (Lock, error) {
+	if len(data) < 16 {
+		return Lock{}, fmt.Errorf("%w: lock of %d bytes", ErrTypeMismatch, len(data))
+	}
+	return Lock{
+		Name:      name,
+		Token:     binary.LittleEndian.Uint64(data),
+		ExpiresAt: time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:]))),
+		Owner:     string(data[16:]),
+	}, nil
+}
+
+// onLock runs fn on the write loop with the current holder of the lock, if
+// its lease has not expired, and the last token handed out for it.
+func (db *Db) onLock(name string, fn func(held *Lock, last uint64, now time.Time) error) error {
+	if name == "" {
+		return fmt.Errorf("missing lock name")
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.send(writeRequest{op: func() error {
+		record, err := db.readEntry(bucketPrefix(lockBucket) + name)
+		if errors.Is(err, ErrNotFound) {
+			return fn(nil, 0, db.now())
+		}
+		if err != nil {
+			return err
+		}
+		if record.Type != typeLock {
+			return fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, typeLock, record.Type)
+		}
+		held, err := decodeLock(name, record.value)
+		if err != nil {
+			return err
+		}
+		now := db.now()
+		if !held.ExpiresAt.After(now) {
+			return fn(nil, held.Token, now)
+		}
+		return fn(&held, held.Token, now)
+	}})
+}
+
+// AcquireLock takes the lock called name for owner until ttl passes. A lock
+// held by another owner fails with ErrLockHeld and returns the holder; one
+// already held by owner is renewed and keeps its token.
+func (db *Db) AcquireLock(name, owner string, ttl time.Duration) (Lock, error) {
+	var l Lock
+	err := db.onLock(name, func(held *Lock, last uint64, now time.Time) error {
+		switch {
+		case held == nil:
+			// Sequence numbers only grow, restarts included, but stay zero
+			// on files without them; the last token of the lock covers
+			// those.
+			l = Lock{Name: name, Owner: owner, Token: max(db.seq, last) + 1}
+		case held.Owner == owner:
+			l = *held
+		default:
+			l = *held
+			return ErrLockHeld
+		}
+		l.ExpiresAt = now.Add(ttl)
+		return db.writeEntry(bucketPrefix(lockBucket)+name, encodeLock(l), typeLock)
+	})
+	return l, err
+}
+
+// RenewLock extends a lock held by owner with token until ttl passes. A lock
+// whose lease expired fails with ErrLockLost even if nobody took it since.
+func (db *Db) RenewLock(name, owner string, token uint64, ttl time.Duration) (Lock, error) {
+	var l Lock
+	err := db.onLock(name, func(held *Lock, _ uint64, now time.Time) error {
+		if held == nil || held.Owner != owner || held.Token != token {
+			return ErrLockLost
+		}
+		l = *held
+		l.ExpiresAt = now.Add(ttl)
+		return db.writeEntry(bucketPrefix(lockBucket)+name, encodeLock(l), typeLock)
+	})
+	return l, err
+}
+
+// ReleaseLock gives up a lock held by owner with token.
+func (db *Db) ReleaseLock(name, owner string, token uint64) error {
+	return db.onLock(name, func(held *Lock, _ uint64, now time.Time) error {
+		if held == nil || held.Owner != owner || held.Token != token {
+			return ErrLockLost
+		}
+		released := *held
+		released.ExpiresAt = now
+		return db.writeEntry(bucketPrefix(lockBucket)+name, encodeLock(released), typeLock)
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir only creates the LOCK file: advisory locking is not available on
+// this platform, so concurrent openers are not detected.
+func lockDir(dir string, _ bool) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0o600)
+}
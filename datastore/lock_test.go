@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLocks(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	db, err := Open(dir, clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.AcquireLock("seed", "server1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held, err := db.AcquireLock("seed", "server2", time.Minute); !errors.Is(err, ErrLockHeld) || held.Owner != "server1" {
+		t.Errorf("AcquireLock of a held lock = %+v, %v, want ErrLockHeld", held, err)
+	}
+	again, err := db.AcquireLock("seed", "server1", time.Minute)
+	if err != nil || again.Token != a.Token {
+		t.Errorf("AcquireLock by the holder = %+v, %v, want token %d", again, err, a.Token)
+	}
+
+	clock.advance(30 * time.Second)
+	renewed, err := db.RenewLock("seed", "server1", a.Token, time.Minute)
+	if err != nil || !renewed.ExpiresAt.After(a.ExpiresAt) {
+		t.Errorf("RenewLock = %+v, %v", renewed, err)
+	}
+	if _, err := db.RenewLock("seed", "server2", a.Token, time.Minute); !errors.Is(err, ErrLockLost) {
+		t.Errorf("RenewLock by another owner error = %v, want ErrLockLost", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.AcquireLock("seed", "server2", time.Minute); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("AcquireLock after reopen error = %v, want ErrLockHeld", err)
+	}
+
+	// Once the lease runs out the lock goes to the next owner with a higher
+	// token, and the old holder can no longer release it.
+	clock.advance(2 * time.Minute)
+	b, err := db.AcquireLock("seed", "server2", time.Minute)
+	if err != nil || b.Token <= a.Token {
+		t.Fatalf("AcquireLock after expiry = %+v, %v, want a token above %d", b, err, a.Token)
+	}
+	if err := db.ReleaseLock("seed", "server1", a.Token); !errors.Is(err, ErrLockLost) {
+		t.Errorf("ReleaseLock with a stale token error = %v, want ErrLockLost", err)
+	}
+	if err := db.ReleaseLock("seed", "server2", b.Token); err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.AcquireLock("seed", "server1", time.Minute)
+	if err != nil || c.Token <= b.Token {
+		t.Errorf("AcquireLock after release = %+v, %v, want a token above %d", c, err, b.Token)
+	}
+}
+
+func TestLockTokensOnLegacyFormat(t *testing.T) {
+	tmp := t.TempDir()
+	writeLegacyFile(t, tmp, entry{key: "k", value: []byte("v"), Type: typeString})
+	clock := newTestClock()
+	db, err := Open(tmp, clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.header.flags&flagSequence != 0 {
+		t.Fatal("expected a file without sequence numbers")
+	}
+
+	a, err := db.AcquireLock("seed", "server1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReleaseLock("seed", "server1", a.Token); err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.AcquireLock("seed", "server2", time.Minute)
+	if err != nil || b.Token <= a.Token {
+		t.Fatalf("AcquireLock after release = %+v, %v, want a token above %d", b, err, a.Token)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp, clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	clock.advance(2 * time.Minute)
+	c, err := db.AcquireLock("seed", "server1", time.Minute)
+	if err != nil || c.Token <= b.Token {
+		t.Errorf("AcquireLock after expiry = %+v, %v, want a token above %d", c, err, b.Token)
+	}
+}
@@ -0,0 +1,944 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemtableSize = 4 << 20
+	// lsmLevels is the number of levels below the memtable. Level 0 holds
+	// flushed memtables that may overlap, the tables of every other level
+	// have disjoint key ranges.
+	lsmLevels = 7
+	// l0CompactionTrigger is how many level 0 tables are merged into level 1
+	// at once.
+	l0CompactionTrigger = 4
+	// levelSizeMultiplier is how much larger every level is than the one
+	// above it, level 1 holding this many memtables.
+	levelSizeMultiplier = 10
+
+	lsmManifest = "MANIFEST"
+)
+
+// WithMemtableSize sets how many bytes of writes an LSM buffers in memory
+// before flushing them to a table. Compaction cuts tables at the same size.
+// Db ignores it.
+func WithMemtableSize(size int64) Option {
+	return func(o *options) {
+		o.memtableSize = size
+	}
+}
+
+// LSM is a log-structured merge tree with the API of Db. Writes go to a
+// write-ahead log and a memtable, which is flushed to a sorted table once it
+// grows past the memtable size. Tables are merged level by level in the
+// background, so unlike Db it needs no memory per key and reads keys in
+// order, see Scan. Every read may have to look at several tables though.
+//
+// History, time travel, change feeds, merge operators, collections, queues
+// and locks are built on the single data file of Db, the LSM does not have
+// them. Streamed values are buffered in memory like any other.
+type LSM struct {
+	fs            FS
+	dir           string
+	lock          io.Closer
+	now           func() time.Time
+	listener      Listener
+	maxRecordSize int64
+	memtableSize  int64
+
+	// writeMu serializes writes and memtable flushes.
+	writeMu sync.Mutex
+	closed  bool
+	wal     File
+	walSize int64
+
+	// mu guards the memtables, the tables and the secondary indexes. Readers
+	// hold it while they read tables, so a compaction closes the tables it
+	// replaced only once no reader uses them.
+	mu        sync.RWMutex
+	mem       *memtable
+	imm       *memtable
+	levels    [][]*sstable
+	walNum    uint64
+	logNum    uint64
+	nextFile  uint64
+	seq       uint64
+	secondary map[string]*secondaryIndex
+
+	compactMu  sync.Mutex
+	compactAt  []string
+	wake       chan struct{}
+	closeChan  chan struct{}
+	background sync.WaitGroup
+}
+
+// memtable holds the latest record of every key written since the last
+// flush, deletes included.
+type memtable struct {
+	entries map[string]entry
+	size    int64
+}
+
+func newMemtable() *memtable {
+	return &memtable{entries: make(map[string]entry)}
+}
+
+func (m *memtable) put(e entry) {
+	if old, ok := m.entries[e.key]; ok {
+		m.size -= memtableSize(old)
+	}
+	m.entries[e.key] = e
+	m.size += memtableSize(e)
+}
+
+func memtableSize(e entry) int64 {
+	return int64(len(e.key) + len(e.value) + len(e.Type) + len(e.Checksum) + 64)
+}
+
+// sorted returns the records of keys not below start in key order.
+func (m *memtable) sorted(start string) []entry {
+	entries := make([]entry, 0, len(m.entries))
+	for k, e := range m.entries {
+		if k >= start {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
+
+// OpenLSM opens or creates an LSM in dir. It takes the same options as Open,
+// those that only make sense for the single data file of Db are ignored.
+func OpenLSM(dir string, opts ...Option) (*LSM, error) {
+	o := buildOptions(opts)
+	if o.readOnly {
+		return nil, fmt.Errorf("%w: the LSM engine cannot be opened read-only", ErrUnsupportedFormat)
+	}
+	if err := o.fs.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	lock, err := o.fs.Lock(dir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LSM{
+		fs:            o.fs,
+		dir:           dir,
+		lock:          lock,
+		now:           o.now,
+		listener:      o.listener,
+		maxRecordSize: o.maxRecordSize,
+		memtableSize:  o.memtableSize,
+		mem:           newMemtable(),
+		levels:        make([][]*sstable, lsmLevels),
+		nextFile:      1,
+		secondary:     make(map[string]*secondaryIndex),
+		compactAt:     make([]string, lsmLevels),
+		wake:          make(chan struct{}, 1),
+		closeChan:     make(chan struct{}),
+	}
+	if l.memtableSize <= 0 {
+		l.memtableSize = defaultMemtableSize
+	}
+	if err := l.recover(); err != nil {
+		_ = l.closeFiles()
+		_ = lock.Close()
+		return nil, err
+	}
+
+	l.background.Add(1)
+	go l.compactionLoop()
+	l.scheduleCompaction()
+	return l, nil
+}
+
+func (l *LSM) path(num uint64, ext string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d%s", num, ext))
+}
+
+// fileNum parses the number of a table or log file name.
+func fileNum(name string) (uint64, bool) {
+	n, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)), 10, 64)
+	return n, err == nil
+}
+
+// recover loads the tables listed in the manifest and replays the logs of
+// the memtables that were not flushed yet.
+func (l *LSM) recover() (err error) {
+	l.listener.RecoveryStarted(l.dir)
+	report := RecoveryInfo{Dir: l.dir}
+	start := time.Now()
+	defer func() {
+		report.Duration = time.Since(start)
+		report.Err = err
+		l.listener.RecoveryFinished(report)
+	}()
+
+	live, err := l.readManifest()
+	if err != nil {
+		return err
+	}
+	tables, err := l.fs.Glob(filepath.Join(l.dir, "*.sst"))
+	if err != nil {
+		return err
+	}
+	for _, path := range tables {
+		if !live[filepath.Base(path)] {
+			_ = l.fs.Remove(path)
+		}
+	}
+
+	logs, err := l.fs.Glob(filepath.Join(l.dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	var replay []uint64
+	for _, path := range logs {
+		num, ok := fileNum(path)
+		switch {
+		case !ok:
+		case num < l.logNum:
+			_ = l.fs.Remove(path)
+		default:
+			replay = append(replay, num)
+		}
+	}
+	sort.Slice(replay, func(i, j int) bool { return replay[i] < replay[j] })
+
+	for i, num := range replay {
+		records, size, err := l.replay(l.path(num, ".log"))
+		report.Records += records
+		if err != nil {
+			return err
+		}
+		if i < len(replay)-1 {
+			continue
+		}
+		// Appending goes on in the last log, without the tail torn by a
+		// crash.
+		if l.wal, err = l.fs.OpenFile(l.path(num, ".log"), os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+			return err
+		}
+		info, err := l.wal.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() > size {
+			if err := l.wal.Truncate(size); err != nil {
+				return err
+			}
+			report.Truncated = info.Size() - size
+		}
+		l.walNum, l.walSize = num, size
+		l.nextFile = max(l.nextFile, num+1)
+	}
+	if l.wal == nil {
+		l.walNum = l.nextFile
+		l.nextFile++
+		if l.wal, err = l.fs.OpenFile(l.path(l.walNum, ".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+			return err
+		}
+	}
+	return l.loadSecondary()
+}
+
+// readManifest opens the tables the manifest lists and returns their names.
+// A missing manifest is a new LSM.
+func (l *LSM) readManifest() (map[string]bool, error) {
+	live := make(map[string]bool)
+	f, err := openRead(l.fs, filepath.Join(l.dir, lsmManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return live, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		invalid := fmt.Errorf("manifest line %d: invalid entry %q", line, scanner.Text())
+		if len(fields) < 2 {
+			return nil, invalid
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, invalid
+		}
+		switch {
+		case fields[0] == "next" && len(fields) == 2:
+			l.nextFile = max(l.nextFile, n)
+		case fields[0] == "log" && len(fields) == 2:
+			l.logNum = n
+		case fields[0] == "table" && len(fields) == 3 && n < lsmLevels:
+			t, err := openTable(l.fs, filepath.Join(l.dir, fields[2]))
+			if err != nil {
+				return nil, err
+			}
+			l.levels[n] = append(l.levels[n], t)
+			l.seq = max(l.seq, t.maxSeq)
+			live[fields[2]] = true
+		default:
+			return nil, invalid
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, level := range l.levels[1:] {
+		sortTables(level)
+	}
+	return live, nil
+}
+
+// writeManifest records the current tables. Callers hold mu for writing.
+func (l *LSM) writeManifest() error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "next %d\nlog %d\n", l.nextFile, l.logNum)
+	for i, level := range l.levels {
+		for _, t := range level {
+			fmt.Fprintf(&buf, "table %d %s\n", i, t.name)
+		}
+	}
+
+	path := filepath.Join(l.dir, lsmManifest)
+	f, err := l.fs.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return l.fs.Rename(path+".tmp", path)
+}
+
+// replay applies the records of a log to the memtable. It returns the size
+// of the intact part of the log.
+func (l *LSM) replay(path string) (int, int64, error) {
+	f, err := openRead(l.fs, path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	var (
+		records int
+		offset  int64
+	)
+	for {
+		var e entry
+		n, err := e.decodeFromReader(in, l.maxRecordSize)
+		if errors.Is(err, io.EOF) && n == 0 || errors.Is(err, io.ErrUnexpectedEOF) {
+			return records, offset, nil
+		}
+		if err != nil {
+			if isCorruption(err) {
+				l.listener.CorruptionDetected(l.dir, &CorruptionError{Offset: offset, Err: err})
+			}
+			return records, offset, fmt.Errorf("replay %s: %w", path, err)
+		}
+		if e.Type == typeBatch {
+			err = splitBatch(e.value, func(_, _ int64, inner entry) {
+				l.apply(inner)
+			})
+			if err != nil {
+				return records, offset, fmt.Errorf("replay %s: %w", path, err)
+			}
+		} else {
+			l.apply(e)
+		}
+		records++
+		offset += int64(n)
+	}
+}
+
+// apply adds a logged record to the memtable. Callers hold mu for writing or
+// have exclusive access.
+func (l *LSM) apply(e entry) {
+	l.mem.put(e)
+	l.seq = max(l.seq, e.seq)
+	if !isIndexDefinition(e.key) {
+		for _, idx := range l.secondary {
+			idx.update(e.key, e.Type, e.value)
+		}
+	}
+}
+
+func (l *LSM) write(entries []entry) error {
+	for _, e := range entries {
+		if err := checkKey(e.key); err != nil {
+			return err
+		}
+	}
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	return l.writeLocked(entries)
+}
+
+// writeLocked logs entries as one record, so they are recovered all or not
+// at all, and applies them to the memtable. Callers hold writeMu.
+func (l *LSM) writeLocked(entries []entry) error {
+	if l.closed {
+		return ErrClosed
+	}
+	key := ""
+	if len(entries) == 1 {
+		key = entries[0].key
+	}
+
+	now := l.now().UnixNano()
+	for i := range entries {
+		entries[i].value = bytes.Clone(entries[i].value)
+		entries[i].seq = l.seq + uint64(i) + 1
+		entries[i].ts = now
+		currentHeader.prepare(&entries[i])
+	}
+	var data []byte
+	if len(entries) == 1 {
+		data = entries[0].Encode()
+	} else {
+		var value []byte
+		for i := range entries {
+			value = append(value, entries[i].Encode()...)
+		}
+		batch := entry{value: value, Type: typeBatch}
+		currentHeader.prepare(&batch)
+		data = batch.Encode()
+	}
+	if int64(len(data)) > l.maxRecordSize {
+		return l.writeFailed(key, ErrTooLarge)
+	}
+
+	if _, err := l.wal.Write(data); err != nil {
+		if truncErr := l.wal.Truncate(l.walSize); truncErr != nil {
+			err = fmt.Errorf("%w (truncate failed: %s)", err, truncErr)
+		}
+		return l.writeFailed(key, err)
+	}
+	l.walSize += int64(len(data))
+
+	l.mu.Lock()
+	for _, e := range entries {
+		l.apply(e)
+	}
+	full := l.mem.size >= l.memtableSize
+	l.mu.Unlock()
+
+	if full {
+		// The write is in the log either way, a failed flush is retried with
+		// the next one.
+		if err := l.flush(); err != nil {
+			return fmt.Errorf("flush memtable: %w", err)
+		}
+	}
+	return nil
+}
+
+func (l *LSM) writeFailed(key string, err error) error {
+	l.listener.WriteFailed(l.dir, key, err)
+	return err
+}
+
+// flush writes the memtable to a new level 0 table. Writes go to a fresh
+// memtable and log meanwhile, reads see the old memtable until the table is
+// in place. Callers hold writeMu.
+func (l *LSM) flush() error {
+	l.mu.Lock()
+	if len(l.mem.entries) == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	walNum := l.nextFile
+	wal, err := l.fs.OpenFile(l.path(walNum, ".log"), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	l.nextFile++
+	oldWal, oldWalNum := l.wal, l.walNum
+	imm := l.mem
+	l.imm, l.mem = imm, newMemtable()
+	l.wal, l.walNum, l.walSize = wal, walNum, 0
+	l.mu.Unlock()
+
+	entries := sliceIter(imm.sorted(""))
+	tables, err := l.writeTables(&entries, 0, false)
+	if err != nil {
+		// Both logs are replayed on recovery, and the records stay readable
+		// until the next flush tries again.
+		l.mu.Lock()
+		for _, e := range l.mem.entries {
+			imm.put(e)
+		}
+		l.mem, l.imm = imm, nil
+		l.mu.Unlock()
+		_ = oldWal.Close()
+		return err
+	}
+
+	l.mu.Lock()
+	l.levels[0] = append(tables, l.levels[0]...)
+	l.imm = nil
+	l.logNum = walNum
+	err = l.writeManifest()
+	l.mu.Unlock()
+	_ = oldWal.Close()
+	if err != nil {
+		return err
+	}
+	_ = l.fs.Remove(l.path(oldWalNum, ".log"))
+	l.scheduleCompaction()
+	return nil
+}
+
+// lookup returns the latest record of key, ErrNotFound if it is deleted.
+func (l *LSM) lookup(key string) (entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	e, ok, err := l.find(key)
+	if err != nil {
+		var corruption *CorruptionError
+		if errors.As(err, &corruption) {
+			l.listener.CorruptionDetected(l.dir, corruption)
+		}
+		return entry{}, err
+	}
+	if !ok || e.Type == typeTombstone {
+		return entry{}, ErrNotFound
+	}
+	return e, nil
+}
+
+// find looks key up from the newest records to the oldest. Callers hold mu.
+func (l *LSM) find(key string) (entry, bool, error) {
+	if e, ok := l.mem.entries[key]; ok {
+		return e, true, nil
+	}
+	if l.imm != nil {
+		if e, ok := l.imm.entries[key]; ok {
+			return e, true, nil
+		}
+	}
+	for _, t := range l.levels[0] {
+		if e, ok, err := t.get(key); ok || err != nil {
+			return e, ok, err
+		}
+	}
+	for _, level := range l.levels[1:] {
+		i := sort.Search(len(level), func(i int) bool {
+			return level[i].last >= key
+		})
+		if i < len(level) {
+			if e, ok, err := level[i].get(key); ok || err != nil {
+				return e, ok, err
+			}
+		}
+	}
+	return entry{}, false, nil
+}
+
+// Scan calls fn for every key in [start, end) in key order, or up to the last
+// key if end is empty. It reads the keys as they were when it started: writes
+// that land meanwhile are not seen, and fn may write to the LSM.
+func (l *LSM) Scan(start, end string, fn func(key, typ string, value []byte) error) error {
+	it, release, err := l.snapshot(start, end)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for {
+		e, ok, err := it.next()
+		if err != nil || !ok {
+			return err
+		}
+		if end != "" && e.key >= end {
+			return nil
+		}
+		if e.Type == typeTombstone {
+			continue
+		}
+		if err := fn(e.key, e.Type, e.value); err != nil {
+			return err
+		}
+	}
+}
+
+// snapshot merges the memtables and the tables that may hold keys in
+// [start, end). The tables stay open until release is called, so the caller
+// does not need mu while it reads them.
+func (l *LSM) snapshot(start, end string) (iterator, func(), error) {
+	l.mu.RLock()
+	sources := []iterator{newSliceIter(l.mem.sorted(start))}
+	if l.imm != nil {
+		sources = append(sources, newSliceIter(l.imm.sorted(start)))
+	}
+	var tables []*sstable
+	for _, level := range l.levels {
+		for _, t := range level {
+			if t.last >= start && (end == "" || t.first() < end) {
+				t.ref()
+				tables = append(tables, t)
+				sources = append(sources, t.iter(start))
+			}
+		}
+	}
+	l.mu.RUnlock()
+
+	release := func() {
+		for _, t := range tables {
+			_ = t.unref()
+		}
+	}
+	it, err := newMergeIter(sources)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return it, release, nil
+}
+
+// prefixEnd is the first key after every key starting with prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+func (l *LSM) getWithType(key string) ([]byte, string, error) {
+	e, err := l.lookup(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return e.value, e.Type, nil
+}
+
+func (l *LSM) Get(key string) (string, error) {
+	data, typ, err := l.getWithType(key)
+	if err != nil {
+		return "", err
+	}
+	if typ != typeString {
+		return "", fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, typeString, typ)
+	}
+	return string(data), nil
+}
+
+func (l *LSM) GetInt64(key string) (int64, error) {
+	data, typ, err := l.getWithType(key)
+	if err != nil {
+		return 0, err
+	}
+	if typ != typeInt64 {
+		return 0, fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, typeInt64, typ)
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
+
+func (l *LSM) GetTyped(key string) ([]byte, string, error) {
+	return l.getWithType(key)
+}
+
+func (l *LSM) GetWithMeta(key string) ([]byte, Meta, error) {
+	e, err := l.lookup(key)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	return e.value, Meta{Type: e.Type, WrittenAt: writeTime(e.ts), Size: int64(len(e.value))}, nil
+}
+
+func (l *LSM) GetStream(key string) (io.ReadCloser, error) {
+	data, _, err := l.getWithType(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (l *LSM) Put(key, value string) error {
+	return l.write([]entry{{key: key, value: []byte(value), Type: typeString}})
+}
+
+func (l *LSM) PutInt64(key string, value int64) error {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(value))
+	return l.write([]entry{{key: key, value: data, Type: typeInt64}})
+}
+
+func (l *LSM) PutTyped(key, typ string, value []byte) error {
+	if err := checkTyped(typ, value); err != nil {
+		return err
+	}
+	return l.write([]entry{{key: key, value: value, Type: typ}})
+}
+
+// PutStream stores exactly size bytes read from r under key. The value is
+// read into memory first.
+func (l *LSM) PutStream(key string, r io.Reader, size int64) error {
+	if size < 0 || streamedSize(&entry{key: key, Type: typeBytes, seq: 1, ts: 1}, size, true) > l.maxRecordSize {
+		return ErrTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("PutStream: got %d of %d bytes: %w", len(data), size, io.ErrUnexpectedEOF)
+	}
+	return l.write([]entry{{key: key, value: data, Type: typeBytes}})
+}
+
+func (l *LSM) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	if _, err := l.lookup(key); err != nil {
+		return err
+	}
+	return l.writeLocked([]entry{{key: key, Type: typeTombstone}})
+}
+
+// Write applies every write of the batch atomically, see Db.Write.
+func (l *LSM) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	return l.write(append([]entry(nil), b.entries...))
+}
+
+func (l *LSM) Bucket(name string) *Bucket {
+	return newBucket(l, name)
+}
+
+// Buckets returns the number of keys in every non-empty bucket. It reads
+// every key.
+func (l *LSM) Buckets() map[string]int {
+	res := make(map[string]int)
+	_ = l.Scan("", "", func(key, _ string, _ []byte) error {
+		if name, ok := bucketOf(key); ok && !reservedBucket(name) {
+			res[name]++
+		}
+		return nil
+	})
+	return res
+}
+
+// DropBucket removes every key of the bucket with a batch of deletes.
+func (l *LSM) DropBucket(name string) error {
+	if !userBucket(name) {
+		return ErrInvalidBucket
+	}
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	prefix := bucketPrefix(name)
+	var deletes []entry
+	err := l.Scan(prefix, prefixEnd(prefix), func(key, _ string, _ []byte) error {
+		deletes = append(deletes, entry{key: key, Type: typeTombstone})
+		return nil
+	})
+	if err != nil || len(deletes) == 0 {
+		return err
+	}
+	return l.writeLocked(deletes)
+}
+
+// CreateIndex starts indexing the field at jsonPath of every JSON document,
+// see Db.CreateIndex.
+func (l *LSM) CreateIndex(name, jsonPath string) error {
+	if name == "" {
+		return fmt.Errorf("missing index name")
+	}
+	idx, err := newSecondaryIndex(jsonPath)
+	if err != nil {
+		return err
+	}
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	l.mu.RLock()
+	_, exists := l.secondary[name]
+	l.mu.RUnlock()
+	if exists {
+		return ErrIndexExists
+	}
+	err = l.Scan("", "", func(key, typ string, value []byte) error {
+		if !isIndexDefinition(key) {
+			idx.update(key, typ, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = l.writeLocked([]entry{{key: bucketPrefix(indexBucket) + name, value: []byte(jsonPath), Type: typeString}})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.secondary[name] = idx
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *LSM) Lookup(index, value string) ([]IndexedKey, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	idx, ok := l.secondary[index]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	return idx.lookup(value), nil
+}
+
+// loadSecondary rebuilds the secondary indexes from their stored definitions.
+func (l *LSM) loadSecondary() error {
+	prefix := bucketPrefix(indexBucket)
+	err := l.Scan(prefix, prefixEnd(prefix), func(key, typ string, value []byte) error {
+		if typ == typeString {
+			if idx, err := newSecondaryIndex(string(value)); err == nil {
+				l.secondary[strings.TrimPrefix(key, prefix)] = idx
+			}
+		}
+		return nil
+	})
+	if err != nil || len(l.secondary) == 0 {
+		return err
+	}
+	return l.Scan("", "", func(key, typ string, value []byte) error {
+		if !isIndexDefinition(key) {
+			for _, idx := range l.secondary {
+				idx.update(key, typ, value)
+			}
+		}
+		return nil
+	})
+}
+
+// Export writes the live value of every key to w in key order, see
+// Db.Export. Writes go on while it runs, the export is a snapshot either
+// way.
+func (l *LSM) Export(w io.Writer) error {
+	out := newExporter(w)
+	err := l.Scan("", "", func(key, typ string, value []byte) error {
+		if reservedKey(key) {
+			return nil
+		}
+		return out.write(key, typ, value)
+	})
+	if err != nil {
+		return err
+	}
+	return out.flush()
+}
+
+// Stats reports the size of the tables and the log as live bytes. Keys counts
+// the records of the memtables and tables without reading them, so deletes
+// and keys written again since they were last merged are counted too. The
+// LSM has no write queue and does not track dead bytes.
+func (l *LSM) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	s := Stats{Keys: len(l.mem.entries)}
+	if l.imm != nil {
+		s.Keys += len(l.imm.entries)
+	}
+	for _, level := range l.levels {
+		for _, t := range level {
+			s.Keys += int(t.count)
+			s.LiveBytes += t.size
+		}
+	}
+	if info, err := l.wal.Stat(); err == nil {
+		s.LiveBytes += info.Size()
+	}
+	return s
+}
+
+// Size returns the bytes of the tables and the current log.
+func (l *LSM) Size() (int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	info, err := l.wal.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	for _, level := range l.levels {
+		size += levelSize(level)
+	}
+	return size, nil
+}
+
+func (l *LSM) Import(r io.Reader) (int, error) {
+	return importRecords(r, l.Write)
+}
+
+func (l *LSM) Close() error {
+	l.writeMu.Lock()
+	if l.closed {
+		l.writeMu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.writeMu.Unlock()
+
+	close(l.closeChan)
+	l.background.Wait()
+
+	l.mu.Lock()
+	err := l.closeFiles()
+	l.mu.Unlock()
+	if lockErr := l.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+func (l *LSM) closeFiles() error {
+	var err error
+	if l.wal != nil {
+		err = l.wal.Close()
+	}
+	for _, level := range l.levels {
+		for _, t := range level {
+			if closeErr := t.unref(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,408 @@
+package datastore
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// iterator yields records in key order.
+type iterator interface {
+	next() (entry, bool, error)
+}
+
+type sliceIter []entry
+
+func newSliceIter(entries []entry) *sliceIter {
+	it := sliceIter(entries)
+	return &it
+}
+
+func (it *sliceIter) next() (entry, bool, error) {
+	if len(*it) == 0 {
+		return entry{}, false, nil
+	}
+	e := (*it)[0]
+	*it = (*it)[1:]
+	return e, true, nil
+}
+
+// mergeIter merges sources that may hold the same key, yielding only the
+// record with the highest sequence number of every key.
+type mergeIter struct {
+	heap mergeHeap
+}
+
+type mergeSource struct {
+	it  iterator
+	cur entry
+}
+
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].cur.key != h[j].cur.key {
+		return h[i].cur.key < h[j].cur.key
+	}
+	return h[i].cur.seq > h[j].cur.seq
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+func newMergeIter(sources []iterator) (*mergeIter, error) {
+	m := &mergeIter{}
+	for _, it := range sources {
+		e, ok, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.heap = append(m.heap, &mergeSource{it: it, cur: e})
+		}
+	}
+	heap.Init(&m.heap)
+	return m, nil
+}
+
+func (m *mergeIter) next() (entry, bool, error) {
+	if len(m.heap) == 0 {
+		return entry{}, false, nil
+	}
+	top := m.heap[0].cur
+	for len(m.heap) > 0 && m.heap[0].cur.key == top.key {
+		s := m.heap[0]
+		e, ok, err := s.it.next()
+		if err != nil {
+			return entry{}, false, err
+		}
+		if ok {
+			s.cur = e
+			heap.Fix(&m.heap, 0)
+		} else {
+			heap.Pop(&m.heap)
+		}
+	}
+	return top, true, nil
+}
+
+func sortTables(tables []*sstable) {
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].first() < tables[j].first()
+	})
+}
+
+// writeTables writes the records of it into new tables of about limit bytes
+// each, or a single table if limit is 0.
+func (l *LSM) writeTables(it iterator, limit int64, dropTombstones bool) ([]*sstable, error) {
+	var (
+		tables []*sstable
+		w      *tableWriter
+		path   string
+	)
+	fail := func(err error) ([]*sstable, error) {
+		if w != nil {
+			w.abort()
+			_ = l.fs.Remove(path)
+		}
+		l.removeTables(tables)
+		return nil, err
+	}
+	finish := func() error {
+		if err := w.finish(); err != nil {
+			return err
+		}
+		w = nil
+		t, err := openTable(l.fs, path)
+		if err != nil {
+			_ = l.fs.Remove(path)
+			return err
+		}
+		tables = append(tables, t)
+		return nil
+	}
+
+	for {
+		e, ok, err := it.next()
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			break
+		}
+		if dropTombstones && e.Type == typeTombstone {
+			continue
+		}
+		if w == nil {
+			l.mu.Lock()
+			path = l.path(l.nextFile, ".sst")
+			l.nextFile++
+			l.mu.Unlock()
+			if w, err = createTable(l.fs, path); err != nil {
+				return fail(err)
+			}
+		}
+		if err := w.add(e); err != nil {
+			return fail(err)
+		}
+		if limit > 0 && w.offset >= limit {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	return tables, nil
+}
+
+// removeTables deletes the files of tables no longer in use. Scans still
+// reading one keep it open until they are done.
+func (l *LSM) removeTables(tables []*sstable) {
+	for _, t := range tables {
+		_ = l.fs.Remove(filepath.Join(l.dir, t.name))
+		_ = t.unref()
+	}
+}
+
+// levelLimit is the number of bytes level i may hold before it is compacted
+// into the next one.
+func (l *LSM) levelLimit(i int) int64 {
+	limit := l.memtableSize
+	for ; i > 0; i-- {
+		limit *= levelSizeMultiplier
+	}
+	return limit
+}
+
+func levelSize(tables []*sstable) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+// tableCompaction merges its inputs into new tables of level.
+type tableCompaction struct {
+	inputs []*sstable
+	level  int
+}
+
+func keyRange(tables []*sstable) (string, string) {
+	from, to := tables[0].first(), tables[0].last
+	for _, t := range tables[1:] {
+		from, to = min(from, t.first()), max(to, t.last)
+	}
+	return from, to
+}
+
+func overlapping(tables []*sstable, from, to string) []*sstable {
+	var res []*sstable
+	for _, t := range tables {
+		if t.overlaps(from, to) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// pickCompaction returns the most urgent compaction or nil. Level 0 goes
+// first, as every read checks all of its tables. Callers hold compactMu.
+func (l *LSM) pickCompaction() *tableCompaction {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.levels[0]) >= l0CompactionTrigger {
+		inputs := append([]*sstable(nil), l.levels[0]...)
+		from, to := keyRange(inputs)
+		return &tableCompaction{inputs: append(inputs, overlapping(l.levels[1], from, to)...), level: 1}
+	}
+	for i := 1; i < lsmLevels-1; i++ {
+		if levelSize(l.levels[i]) <= l.levelLimit(i) {
+			continue
+		}
+		// Tables are picked round-robin through the key space, so every
+		// part of the level is merged down in turn.
+		t := l.levels[i][0]
+		for _, candidate := range l.levels[i] {
+			if candidate.first() > l.compactAt[i] {
+				t = candidate
+				break
+			}
+		}
+		l.compactAt[i] = t.last
+		inputs := append([]*sstable{t}, overlapping(l.levels[i+1], t.first(), t.last)...)
+		return &tableCompaction{inputs: inputs, level: i + 1}
+	}
+	return nil
+}
+
+// run merges the inputs and swaps the new tables in. Callers hold compactMu.
+func (l *LSM) run(ctx context.Context, c *tableCompaction) (err error) {
+	l.listener.CompactionStarted(l.dir)
+	start := time.Now()
+	var size, reclaimed int64
+	defer func() {
+		info := CompactionInfo{Dir: l.dir, Duration: time.Since(start), Err: err}
+		if err == nil {
+			info.Size, info.Reclaimed = size, reclaimed
+		}
+		l.listener.CompactionFinished(info)
+	}()
+
+	from, to := keyRange(c.inputs)
+	l.mu.RLock()
+	// Deletes must stay as long as an older value may lie below them.
+	dropTombstones := true
+	for _, level := range l.levels[c.level+1:] {
+		if len(overlapping(level, from, to)) > 0 {
+			dropTombstones = false
+		}
+	}
+	sources := make([]iterator, len(c.inputs))
+	for i, t := range c.inputs {
+		sources[i] = t.iter("")
+	}
+	l.mu.RUnlock()
+
+	merged, err := newMergeIter(sources)
+	if err != nil {
+		return err
+	}
+	it := &cancelIter{ctx: ctx, it: merged}
+	outputs, err := l.writeTables(it, l.memtableSize, dropTombstones)
+	if err != nil {
+		return fmt.Errorf("compact level %d: %w", c.level, err)
+	}
+
+	l.mu.Lock()
+	replaced := make(map[*sstable]bool, len(c.inputs))
+	for _, t := range c.inputs {
+		replaced[t] = true
+	}
+	for i, level := range l.levels {
+		kept := level[:0:0]
+		for _, t := range level {
+			if !replaced[t] {
+				kept = append(kept, t)
+			}
+		}
+		l.levels[i] = kept
+	}
+	l.levels[c.level] = append(l.levels[c.level], outputs...)
+	sortTables(l.levels[c.level])
+	err = l.writeManifest()
+	l.mu.Unlock()
+	if err != nil {
+		// The old tables stay on disk for the manifest that still lists
+		// them.
+		return err
+	}
+
+	for _, t := range c.inputs {
+		reclaimed += t.size
+	}
+	for _, t := range outputs {
+		size += t.size
+	}
+	reclaimed -= size
+	l.removeTables(c.inputs)
+	return nil
+}
+
+// cancelIter stops a merge once ctx is done.
+type cancelIter struct {
+	ctx context.Context
+	it  iterator
+}
+
+func (it *cancelIter) next() (entry, bool, error) {
+	if err := it.ctx.Err(); err != nil {
+		return entry{}, false, err
+	}
+	return it.it.next()
+}
+
+func (l *LSM) scheduleCompaction() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *LSM) compactionLoop() {
+	defer l.background.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-l.closeChan
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-l.wake:
+			l.compactMu.Lock()
+			for c := l.pickCompaction(); c != nil; c = l.pickCompaction() {
+				if err := l.run(ctx, c); err != nil {
+					break
+				}
+			}
+			l.compactMu.Unlock()
+		case <-l.closeChan:
+			return
+		}
+	}
+}
+
+// Compact flushes the memtable and merges every table into the last level
+// that holds any, dropping deleted and overwritten records.
+func (l *LSM) Compact(ctx context.Context) error {
+	l.writeMu.Lock()
+	if l.closed {
+		l.writeMu.Unlock()
+		return ErrClosed
+	}
+	err := l.flush()
+	l.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.RLock()
+	var (
+		inputs []*sstable
+		level  = 1
+	)
+	for i, tables := range l.levels {
+		inputs = append(inputs, tables...)
+		if len(tables) > 0 {
+			level = max(level, i)
+		}
+	}
+	l.mu.RUnlock()
+	if len(inputs) == 0 {
+		return ctx.Err()
+	}
+	return l.run(ctx, &tableCompaction{inputs: inputs, level: level})
+}
@@ -0,0 +1,342 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLSMStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		l, err := OpenLSM(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = l.Close()
+		})
+		return l
+	})
+}
+
+func TestLSMStoreSmallMemtable(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		l, err := OpenLSM("db", WithFS(NewMemFS()), WithMemtableSize(256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = l.Close()
+		})
+		return l
+	})
+}
+
+func TestLSMFlushCompactAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLSM(dir, WithMemtableSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 200; i++ {
+			key, value := fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d-%d", i, round)
+			if err := l.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+	}
+	for i := 0; i < 200; i += 3 {
+		key := fmt.Sprintf("key%03d", i)
+		if err := l.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+
+	check := func(l *LSM) {
+		t.Helper()
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			got, err := l.Get(key)
+			want, ok := expected[key]
+			switch {
+			case !ok && !errors.Is(err, ErrNotFound):
+				t.Errorf("Get(%s) = %q, %v, want ErrNotFound", key, got, err)
+			case ok && (err != nil || got != want):
+				t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, want)
+			}
+		}
+	}
+	check(l)
+
+	l.mu.RLock()
+	tables := 0
+	for _, level := range l.levels {
+		tables += len(level)
+	}
+	l.mu.RUnlock()
+	if tables == 0 {
+		t.Fatal("no table was flushed")
+	}
+
+	if err := l.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(l)
+	l.mu.RLock()
+	levels := 0
+	for _, level := range l.levels {
+		if len(level) > 0 {
+			levels++
+		}
+	}
+	l.mu.RUnlock()
+	if levels != 1 {
+		t.Errorf("tables spread over %d levels after Compact, want 1", levels)
+	}
+
+	if err := l.Put("key001", "after"); err != nil {
+		t.Fatal(err)
+	}
+	expected["key001"] = "after"
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenLSM(dir, WithMemtableSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	check(l)
+
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(logs) != 1 {
+		t.Errorf("found logs %v, want one", logs)
+	}
+}
+
+func TestLSMScan(t *testing.T) {
+	l, err := OpenLSM(t.TempDir(), WithMemtableSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := l.Put(fmt.Sprintf("k%03d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Delete("k012"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("k011", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = l.Scan("k010", "k015", func(key, typ string, value []byte) error {
+		keys = append(keys, key+"="+string(value))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"k010=10", "k011=new", "k013=13", "k014=14"}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("Scan = %v, want %v", keys, want)
+	}
+
+	n := 0
+	if err := l.Scan("", "", func(string, string, []byte) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 99 {
+		t.Errorf("Scan of everything found %d keys, want 99", n)
+	}
+}
+
+func TestLSMScanWhileWriting(t *testing.T) {
+	l, err := OpenLSM(t.TempDir(), WithMemtableSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := l.Put(fmt.Sprintf("k%03d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The scan sees the keys as they were when it started, even once the
+	// tables it reads are compacted away.
+	n := 0
+	err = l.Scan("", "", func(key, _ string, value []byte) error {
+		if string(value) != "old" {
+			t.Errorf("Scan saw %s=%s written after it started", key, value)
+		}
+		if n++; n == 50 {
+			if err := l.Compact(context.Background()); err != nil {
+				return err
+			}
+		}
+		return l.Put(key, "new")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 {
+		t.Errorf("Scan found %d keys, want 100", n)
+	}
+	if value, err := l.Get("k099"); err != nil || value != "new" {
+		t.Errorf("Get(k099) = %q, %v; want new", value, err)
+	}
+
+	size, err := l.Size()
+	if err != nil || size == 0 {
+		t.Errorf("Size() = %d, %v", size, err)
+	}
+	if s := l.Stats(); s.Keys < 100 || s.LiveBytes == 0 {
+		t.Errorf("Stats() = %+v, want at least 100 keys", s)
+	}
+}
+
+func TestLSMRecoverTornLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLSM(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("logs = %v, %v", logs, err)
+	}
+	f, err := os.OpenFile(logs[0], os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The start of a record whose size promises more than was written.
+	if _, err := f.Write([]byte{100, 0, 0, 0, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	rec := &recordingListener{}
+	l, err = OpenLSM(dir, WithListener(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if v, err := l.Get("k"); err != nil || v != "v" {
+		t.Errorf("Get(k) = %q, %v", v, err)
+	}
+	if err := l.Put("k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := l.Get("k2"); err != nil || v != "v2" {
+		t.Errorf("Get(k2) = %q, %v", v, err)
+	}
+	if rec.recovery.Truncated != 6 || rec.recovery.Records != 1 {
+		t.Errorf("recovery = %+v, want one record and 6 bytes truncated", rec.recovery)
+	}
+}
+
+func TestTableGetAndBloom(t *testing.T) {
+	fs := NewMemFS()
+	w, err := createTable(fs, "t.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i += 2 {
+		e := entry{key: fmt.Sprintf("key%05d", i), value: []byte(fmt.Sprint(i)), Type: typeString, seq: uint64(i + 1)}
+		currentHeader.prepare(&e)
+		if err := w.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := openTable(fs, "t.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	if len(table.index) < 2 {
+		t.Errorf("index has %d blocks, want several", len(table.index))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		e, ok, err := table.get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i%2 == 0; ok != want || ok && string(e.value) != fmt.Sprint(i) {
+			t.Errorf("get(%s) = %q, %v", key, e.value, ok)
+		}
+		if i%2 == 1 && table.filter.mayContain(key) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("bloom filter let %d of 1000 missing keys through", falsePositives)
+	}
+}
+
+func TestLSMConcurrentReadsAndWrites(t *testing.T) {
+	l, err := OpenLSM("db", WithFS(NewMemFS()), WithMemtableSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			if err := l.Put(fmt.Sprintf("k%d", i%100), fmt.Sprint(i)); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			select {
+			case err := <-errs:
+				t.Fatal(err)
+			default:
+			}
+			for i := 0; i < 100; i++ {
+				if v, err := l.Get(fmt.Sprintf("k%d", i)); err != nil || v != fmt.Sprint(1900+i) {
+					t.Errorf("Get(k%d) = %q, %v", i, v, err)
+				}
+			}
+			return
+		default:
+		}
+		if _, err := l.Get("k0"); err != nil && !errors.Is(err, ErrNotFound) {
+			t.Fatal(err)
+		}
+	}
+}
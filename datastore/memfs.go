@@ -0,0 +1,358 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+// MemFS is an in-memory FS for tests. It counts the operations that change
+// the filesystem (creating, writing, truncating, syncing, renaming and
+// removing files) and can be told to fail one of them. The failing operation
+// simulates a process crash: from then on every operation fails, until
+// Restart hands out the files as a new process would find them.
+//
+// Data written before the crash survives it, as the OS keeps it even if the
+// process dies before a sync. Power loss is not simulated.
+type MemFS struct {
+	mu      sync.Mutex
+	files   map[string]*memData
+	locks   map[string]int
+	ops     int
+	failAt  int
+	short   bool
+	crashed bool
+	temp    int
+}
+
+type memData struct {
+	data []byte
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		locks: make(map[string]int),
+	}
+}
+
+// FailAt makes the n-th change to the filesystem, counted from 1, fail and
+// crash the filesystem. With short set a failing write still lands half of
+// its bytes, like a write torn by the crash.
+func (m *MemFS) FailAt(n int, short bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failAt, m.short = n, short
+}
+
+// Ops returns how many changes were made to the filesystem so far.
+func (m *MemFS) Ops() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ops
+}
+
+func (m *MemFS) Crashed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.crashed
+}
+
+// Restart returns a filesystem holding the files of m as they are now, with
+// no locks held and no fault scheduled.
+func (m *MemFS) Restart() *MemFS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := NewMemFS()
+	for name, d := range m.files {
+		r.files[name] = &memData{data: append([]byte(nil), d.data...)}
+	}
+	return r
+}
+
+// change accounts for an operation that modifies the filesystem. It returns
+// ErrInjected if the operation must fail. Callers hold mu.
+func (m *MemFS) change() error {
+	if m.crashed {
+		return ErrInjected
+	}
+	m.ops++
+	if m.ops == m.failAt {
+		m.crashed = true
+		return ErrInjected
+	}
+	return nil
+}
+
+func (m *MemFS) OpenFile(name string, flag int, _ os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.crashed {
+		return nil, ErrInjected
+	}
+	name = filepath.Clean(name)
+	d, ok := m.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok || flag&os.O_TRUNC != 0:
+		if err := m.change(); err != nil {
+			return nil, err
+		}
+		d = &memData{}
+		m.files[name] = d
+	}
+	return &memFile{fs: m, name: name, data: d, flag: flag}, nil
+}
+
+func (m *MemFS) CreateTemp(dir, pattern string) (File, error) {
+	m.mu.Lock()
+	m.temp++
+	name := strings.Replace(pattern, "*", fmt.Sprint(m.temp), 1)
+	if !strings.Contains(pattern, "*") {
+		name += fmt.Sprint(m.temp)
+	}
+	m.mu.Unlock()
+	return m.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	d, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if err := m.change(); err != nil {
+		return err
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = d
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if err := m.change(); err != nil {
+		return err
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// MkdirAll succeeds without doing anything: MemFS has no directories.
+func (m *MemFS) MkdirAll(string, os.FileMode) error {
+	return nil
+}
+
+// Glob matches pattern against the files and the directories holding them.
+func (m *MemFS) Glob(pattern string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.crashed {
+		return nil, ErrInjected
+	}
+	seen := make(map[string]bool)
+	var matches []string
+	for name := range m.files {
+		for ; name != "." && name != string(filepath.Separator) && !seen[name]; name = filepath.Dir(name) {
+			seen[name] = true
+			ok, err := filepath.Match(pattern, name)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matches = append(matches, name)
+			}
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (m *MemFS) Lock(dir string, shared bool) (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	held := m.locks[dir]
+	if held < 0 || (held > 0 && !shared) {
+		return nil, ErrLocked
+	}
+	if shared {
+		m.locks[dir]++
+	} else {
+		m.locks[dir] = -1
+	}
+	return &memLock{fs: m, dir: dir, shared: shared}, nil
+}
+
+type memLock struct {
+	fs     *MemFS
+	dir    string
+	shared bool
+	once   sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		defer l.fs.mu.Unlock()
+		if l.shared {
+			l.fs.locks[l.dir]--
+		} else {
+			l.fs.locks[l.dir] = 0
+		}
+	})
+	return nil
+}
+
+type memFile struct {
+	fs     *MemFS
+	name   string
+	data   *memData
+	flag   int
+	offset int64
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) readable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.crashed {
+		return 0, ErrInjected
+	}
+	if !f.readable() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+	}
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if !f.writable() {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.data.data))
+	}
+	torn := f.fs.short && !f.fs.crashed && f.fs.ops+1 == f.fs.failAt
+	err := f.fs.change()
+	if err != nil {
+		if !torn {
+			return 0, err
+		}
+		p = p[:len(p)/2]
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	n := copy(f.data.data[f.offset:], p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.data.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.crashed {
+		return nil, ErrInjected
+	}
+	return memInfo{name: filepath.Base(f.name), size: int64(len(f.data.data))}, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.fs.change()
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.change(); err != nil {
+		return err
+	}
+	if size < int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size]
+	} else {
+		f.data.data = append(f.data.data, make([]byte, size-int64(len(f.data.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memInfo struct {
+	name string
+	size int64
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return 0o600 }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return false }
+func (i memInfo) Sys() any           { return nil }
@@ -0,0 +1,331 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memValue struct {
+	value   any
+	typ     string
+	written time.Time
+}
+
+func memValueOf(typ string, data []byte) memValue {
+	switch typ {
+	case typeString:
+		return memValue{value: string(data), typ: typ}
+	case typeInt64:
+		return memValue{value: int64(binary.LittleEndian.Uint64(data)), typ: typ}
+	default:
+		return memValue{value: bytes.Clone(data), typ: typ}
+	}
+}
+
+// bytes returns the value the way Db stores it.
+func (v memValue) bytes() []byte {
+	switch value := v.value.(type) {
+	case []byte:
+		return value
+	case string:
+		return []byte(value)
+	case int64:
+		return binary.LittleEndian.AppendUint64(nil, uint64(value))
+	}
+	return nil
+}
+
+// MemStore keeps everything in memory. It is meant for tests of code that
+// depends on a Store.
+type MemStore struct {
+	mu      sync.RWMutex
+	data    map[string]memValue
+	indexes map[string]*secondaryIndex
+	changes []Change
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		data:    make(map[string]memValue),
+		indexes: make(map[string]*secondaryIndex),
+	}
+}
+
+func (s *MemStore) Get(key string) (string, error) {
+	v, err := s.get(key, typeString)
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+func (s *MemStore) GetInt64(key string) (int64, error) {
+	v, err := s.get(key, typeInt64)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+func (s *MemStore) get(key, typ string) (any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if v.typ != typ {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, typ, v.typ)
+	}
+	return v.value, nil
+}
+
+func (s *MemStore) Put(key, value string) error {
+	return s.put(key, memValue{value: value, typ: typeString})
+}
+
+func (s *MemStore) PutInt64(key string, value int64) error {
+	return s.put(key, memValue{value: value, typ: typeInt64})
+}
+
+func (s *MemStore) PutStream(key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	return s.put(key, memValue{value: data, typ: typeBytes})
+}
+
+func (s *MemStore) GetStream(key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(v.bytes())), nil
+}
+
+func (s *MemStore) GetTyped(key string) ([]byte, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return bytes.Clone(v.bytes()), v.typ, nil
+}
+
+func (s *MemStore) GetWithMeta(key string) ([]byte, Meta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	if !ok {
+		return nil, Meta{}, ErrNotFound
+	}
+	data := bytes.Clone(v.bytes())
+	return data, Meta{Type: v.typ, WrittenAt: v.written, Size: int64(len(data))}, nil
+}
+
+func (s *MemStore) PutTyped(key, typ string, value []byte) error {
+	if err := checkTyped(typ, value); err != nil {
+		return err
+	}
+	return s.put(key, memValueOf(typ, value))
+}
+
+func (s *MemStore) Write(b *Batch) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range b.entries {
+		if e.Type == typeTombstone {
+			s.delete(e.key)
+		} else {
+			s.set(e.key, memValueOf(e.Type, e.value))
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) put(key string, v memValue) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, v)
+	return nil
+}
+
+// record keeps every change for ChangesSince. Callers hold mu.
+func (s *MemStore) record(key, typ string, value []byte) {
+	s.changes = append(s.changes, Change{
+		Seq:   uint64(len(s.changes)) + 1,
+		Key:   key,
+		Type:  typ,
+		Value: bytes.Clone(value),
+	})
+}
+
+// ChangesSince replays every change after since, see Db.ChangesSince. Nothing
+// is ever compacted away.
+func (s *MemStore) ChangesSince(since uint64, fn func(Change) error) error {
+	s.mu.RLock()
+	changes := s.changes[min(since, uint64(len(s.changes))):]
+	s.mu.RUnlock()
+	for _, c := range changes {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) set(key string, v memValue) {
+	v.written = time.Now()
+	s.data[key] = v
+	s.record(key, v.typ, v.bytes())
+	for _, idx := range s.indexes {
+		idx.update(key, v.typ, v.bytes())
+	}
+}
+
+func (s *MemStore) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return ErrNotFound
+	}
+	s.delete(key)
+	return nil
+}
+
+func (s *MemStore) delete(key string) {
+	delete(s.data, key)
+	s.record(key, typeTombstone, nil)
+	for _, idx := range s.indexes {
+		idx.update(key, typeTombstone, nil)
+	}
+}
+
+func (s *MemStore) CreateIndex(name, jsonPath string) error {
+	if name == "" {
+		return fmt.Errorf("missing index name")
+	}
+	idx, err := newSecondaryIndex(jsonPath)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.indexes[name]; ok {
+		return ErrIndexExists
+	}
+	for key, v := range s.data {
+		idx.update(key, v.typ, v.bytes())
+	}
+	s.indexes[name] = idx
+	return nil
+}
+
+func (s *MemStore) Lookup(index, value string) ([]IndexedKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	idx, ok := s.indexes[index]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	return idx.lookup(value), nil
+}
+
+func (s *MemStore) Bucket(name string) *Bucket {
+	return newBucket(s, name)
+}
+
+func (s *MemStore) Buckets() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make(map[string]int)
+	for key := range s.data {
+		if name, ok := bucketOf(key); ok {
+			res[name]++
+		}
+	}
+	return res
+}
+
+func (s *MemStore) DropBucket(name string) error {
+	if !userBucket(name) {
+		return ErrInvalidBucket
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := bucketPrefix(name)
+	dropped := false
+	for key := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.data, key)
+			dropped = true
+		}
+	}
+	if dropped {
+		s.record(name, typeDropBucket, nil)
+	}
+	for _, idx := range s.indexes {
+		idx.update(name, typeDropBucket, nil)
+	}
+	return nil
+}
+
+// Export writes every value in key order, see Db.Export.
+func (s *MemStore) Export(w io.Writer) error {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.data))
+	values := make(map[string]memValue, len(s.data))
+	for key, v := range s.data {
+		keys = append(keys, key)
+		values[key] = v
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+
+	out := newExporter(w)
+	for _, key := range keys {
+		if err := out.write(key, values[key].typ, values[key].bytes()); err != nil {
+			return err
+		}
+	}
+	return out.flush()
+}
+
+func (s *MemStore) Import(r io.Reader) (int, error) {
+	return importRecords(r, s.Write)
+}
+
+// Compact has nothing to reclaim in memory.
+func (s *MemStore) Compact(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
@@ -0,0 +1,285 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// mergeTypePrefix starts the record type of merge operands, followed by the
+// name of the operator that wrote them.
+const mergeTypePrefix = "merge:"
+
+var ErrNoMergeOperator = errors.New("no merge operator registered")
+
+// MergeOperator folds operands written with Db.Merge into the value of a key.
+// Operands are appended without reading the current value; Get folds them on
+// read and compaction replaces them with the result.
+type MergeOperator interface {
+	// Name is stored with every operand, so operands are never folded by an
+	// operator they were not written for.
+	Name() string
+	// Type is the record type of the folded value. An existing value of
+	// another type fails the fold with ErrTypeMismatch.
+	Type() string
+	// Merge applies operands, oldest first, to existing, which is nil if the
+	// key had no value.
+	Merge(key string, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// WithMergeOperator registers op for Db.Merge. A db holds a single operator;
+// reopening it with another name makes the stored operands unreadable.
+func WithMergeOperator(op MergeOperator) Option {
+	return func(o *options) {
+		o.mergeOperator = op
+	}
+}
+
+func mergeType(op MergeOperator) string {
+	return mergeTypePrefix + op.Name()
+}
+
+func isMergeType(typ string) bool {
+	return strings.HasPrefix(typ, mergeTypePrefix)
+}
+
+// Merge appends operand to key. The operand is checked by folding it alone,
+// so one the operator rejects is never stored.
+func (db *Db) Merge(key string, operand []byte) error {
+	if db.mergeOp == nil {
+		return ErrNoMergeOperator
+	}
+	if _, err := db.mergeOp.Merge(key, nil, [][]byte{operand}); err != nil {
+		return fmt.Errorf("merge %q: %w", key, err)
+	}
+	return db.write(key, operand, mergeType(db.mergeOp))
+}
+
+// applyMerge indexes an operand. The first operand of a key without a value
+// takes its place in the index, later ones are chained in merges. Callers
+// must hold muIndex or have exclusive access to the db.
+func (db *Db) applyMerge(key string, pos recordPos) error {
+	_, ok, err := db.indexGet(key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		db.merges[key] = append(db.merges[key], pos)
+		db.countKey(key, 0, pos.size)
+	} else {
+		if _, _, err := db.indexPut(key, pos); err != nil {
+			return err
+		}
+		db.countKey(key, 1, pos.size)
+		db.merges[key] = []recordPos{}
+	}
+	return nil
+}
+
+// dropMerges forgets the operands of key once its value is replaced.
+func (db *Db) dropMerges(key string) {
+	for _, pos := range db.merges[key] {
+		db.countKey(key, 0, -pos.size)
+		db.supersede(key, pos.offset)
+	}
+	delete(db.merges, key)
+}
+
+// chain returns a copy of the operands following the indexed record of key,
+// or nil if the record is a plain value. Callers hold muIndex.
+func (db *Db) chain(key string) []recordPos {
+	ops, ok := db.merges[key]
+	if !ok {
+		return nil
+	}
+	return append(make([]recordPos, 0, len(ops)), ops...)
+}
+
+// readChain reads the operands at ops from f and returns them after first,
+// the indexed record of the key.
+func (db *Db) readChain(f File, first entry, ops []recordPos) ([]entry, error) {
+	chain := []entry{first}
+	for _, pos := range ops {
+		e, err := db.readRecordAt(f, pos.offset)
+		if isCorruption(err) {
+			db.listener.CorruptionDetected(db.dir, &CorruptionError{Offset: pos.offset, Err: err})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read operand at %d: %w", pos.offset, err)
+		}
+		chain = append(chain, e)
+	}
+	return chain, nil
+}
+
+// foldForIndex returns the folded value of key for the secondary indexes.
+// A value that does not fold is taken out of them. Callers hold muIndex.
+func (db *Db) foldForIndex(key string) ([]byte, string, error) {
+	pos, _, err := db.indexGet(key)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := openRead(db.fs, db.outPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	first, err := db.readRecordAt(f, pos.offset)
+	if err != nil {
+		return nil, "", err
+	}
+	chain, err := db.readChain(f, first, db.merges[key])
+	if err != nil {
+		return nil, "", err
+	}
+	e, err := db.fold(chain)
+	if err != nil {
+		return nil, typeTombstone, nil
+	}
+	return e.value, e.Type, nil
+}
+
+// fold applies the operands of chain to its leading value, if there is one.
+// The result carries the sequence number and write time of the last operand.
+func (db *Db) fold(chain []entry) (entry, error) {
+	op := db.mergeOp
+	if op == nil {
+		return entry{}, ErrNoMergeOperator
+	}
+	var existing []byte
+	operands := chain
+	if !isMergeType(chain[0].Type) {
+		if chain[0].Type != op.Type() {
+			return entry{}, fmt.Errorf("%w: expected %s, got %s", ErrTypeMismatch, op.Type(), chain[0].Type)
+		}
+		existing, operands = chain[0].value, chain[1:]
+	}
+	values := make([][]byte, len(operands))
+	for i, e := range operands {
+		if e.Type != mergeType(op) {
+			return entry{}, fmt.Errorf("%w: operand of %s, operator %s", ErrTypeMismatch, strings.TrimPrefix(e.Type, mergeTypePrefix), op.Name())
+		}
+		values[i] = e.value
+	}
+	last := chain[len(chain)-1]
+	value, err := op.Merge(last.key, existing, values)
+	if err != nil {
+		return entry{}, fmt.Errorf("merge %q: %w", last.key, err)
+	}
+	return entry{key: last.key, value: value, Type: op.Type(), seq: last.seq, ts: last.ts}, nil
+}
+
+// Int64Add sums 8 byte little-endian operands into an int64 value, as
+// written by PutInt64. A missing value counts as 0.
+func Int64Add() MergeOperator {
+	return int64Add{}
+}
+
+type int64Add struct{}
+
+func (int64Add) Name() string { return "int64add" }
+
+func (int64Add) Type() string { return typeInt64 }
+
+func (int64Add) Merge(_ string, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+	for _, v := range append([][]byte{existing}, operands...) {
+		switch len(v) {
+		case 0:
+		case 8:
+			sum += int64(binary.LittleEndian.Uint64(v))
+		default:
+			return nil, fmt.Errorf("%w: int64 operand of %d bytes", ErrTypeMismatch, len(v))
+		}
+	}
+	return binary.LittleEndian.AppendUint64(nil, uint64(sum)), nil
+}
+
+// StringAppend appends operands to a string value, separated by sep.
+func StringAppend(sep string) MergeOperator {
+	return stringAppend{sep: sep}
+}
+
+type stringAppend struct {
+	sep string
+}
+
+func (stringAppend) Name() string { return "append" }
+
+func (stringAppend) Type() string { return typeString }
+
+func (a stringAppend) Merge(_ string, existing []byte, operands [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(existing)
+	for i, v := range operands {
+		if i > 0 || existing != nil {
+			buf.WriteString(a.sep)
+		}
+		buf.Write(v)
+	}
+	return buf.Bytes(), nil
+}
+
+// JSONMergePatch applies operands to a JSON document stored as a string as
+// RFC 7386 merge patches: objects are merged key by key, null removes a key
+// and anything else replaces the target.
+func JSONMergePatch() MergeOperator {
+	return jsonMergePatch{}
+}
+
+type jsonMergePatch struct{}
+
+func (jsonMergePatch) Name() string { return "jsonpatch" }
+
+func (jsonMergePatch) Type() string { return typeString }
+
+func (jsonMergePatch) Merge(_ string, existing []byte, operands [][]byte) ([]byte, error) {
+	var doc any
+	if existing != nil {
+		if err := decodeJSONNumber(existing, &doc); err != nil {
+			return nil, fmt.Errorf("existing document: %w", err)
+		}
+	}
+	for _, v := range operands {
+		var patch any
+		if err := decodeJSONNumber(v, &patch); err != nil {
+			return nil, fmt.Errorf("patch: %w", err)
+		}
+		doc = mergePatch(doc, patch)
+	}
+	return json.Marshal(doc)
+}
+
+func decodeJSONNumber(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("trailing data after JSON value")
+	}
+	return nil
+}
+
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
@@ -0,0 +1,247 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func int64Operand(v int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(v))
+}
+
+func TestMergeInt64Add(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, WithMergeOperator(Int64Add()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 10; i++ {
+		if err := db.Merge("counter", int64Operand(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutInt64("base", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("base", int64Operand(-1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("reset", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("reset", int64Operand(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("reset", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("deleted", int64Operand(7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		for key, want := range map[string]int64{"counter": 55, "base": 99, "reset": 1} {
+			if got, err := db.GetInt64(key); err != nil || got != want {
+				t.Errorf("GetInt64(%s) = %d, %v, want %d", key, got, err, want)
+			}
+		}
+		if _, err := db.GetInt64("deleted"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetInt64(deleted) error = %v, want ErrNotFound", err)
+		}
+		if keys := db.Stats().Keys; keys != 3 {
+			t.Errorf("Stats().Keys = %d, want 3", keys)
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, WithMergeOperator(Int64Add()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestMergeCompaction(t *testing.T) {
+	db, err := Open(t.TempDir(), WithMergeOperator(StringAppend(",")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	want := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("list%d", i%4)
+		if err := db.Merge(key, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		if want[key] != "" {
+			want[key] += ","
+		}
+		want[key] += fmt.Sprint(i)
+	}
+	if err := db.Put("list0", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("list0", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	want["list0"] = "x,y"
+
+	before, _ := db.Size()
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := db.Size()
+	if after >= before {
+		t.Errorf("size after compaction = %d, want below %d", after, before)
+	}
+	db.muIndex.RLock()
+	chained := len(db.merges)
+	db.muIndex.RUnlock()
+	if chained != 0 {
+		t.Errorf("%d keys still have operands after compaction", chained)
+	}
+	if s := db.Stats(); s.DeadBytes != 0 {
+		t.Errorf("Stats() = %+v, want no dead bytes", s)
+	}
+
+	if err := db.Merge("list1", []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	want["list1"] += ",z"
+	for key, value := range want {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, value)
+		}
+	}
+}
+
+func TestMergeCompactionWithHistory(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithMergeOperator(StringAppend(",")), WithHistory(HistoryPolicy{Versions: 2})}
+	db, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a", "b"} {
+		if err := db.Put("k", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Merge("k", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The folded value shares its first offset with the history copy of
+	// "b", the index must point at the former.
+	check := func(stage string) {
+		t.Helper()
+		if got, err := db.Get("k"); err != nil || got != "b,c" {
+			t.Errorf("Get(k) %s = %q, %v; want b,c", stage, got, err)
+		}
+		if got := historyValues(t, db, "k"); got != "string:a string:b string:b,c" {
+			t.Errorf("history of k %s = %q", stage, got)
+		}
+	}
+	check("after compaction")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("after reopening")
+}
+
+func TestMergeErrors(t *testing.T) {
+	plain, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err := plain.Merge("k", []byte("v")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Errorf("Merge without operator error = %v, want ErrNoMergeOperator", err)
+	}
+	if err := plain.PutTyped("k", "merge:append", []byte("v")); !errors.Is(err, ErrReservedType) {
+		t.Errorf("PutTyped of an operand error = %v, want ErrReservedType", err)
+	}
+
+	db, err := Open(t.TempDir(), WithMergeOperator(Int64Add()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Merge("k", []byte("short")); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Merge of a bad operand error = %v, want ErrTypeMismatch", err)
+	}
+	if err := db.Put("name", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("name", int64Operand(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetInt64("name"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("GetInt64 of a string with operands error = %v, want ErrTypeMismatch", err)
+	}
+	// A chain that does not fold survives compaction as it is.
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("name", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("name"); err != nil || v != "other" {
+		t.Errorf("Get(name) = %q, %v", v, err)
+	}
+}
+
+func TestJSONMergePatch(t *testing.T) {
+	db, err := Open(t.TempDir(), WithMergeOperator(JSONMergePatch()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateIndex("by_city", "city"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("p", `{"name": "Ann", "city": "Kyiv", "tags": {"a": 1, "b": 2}}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, patch := range []string{`{"city": "Lviv"}`, `{"tags": {"a": null, "c": 3}}`, `{"name": null}`} {
+		if err := db.Merge("p", []byte(patch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Merge("p", []byte(`{"broken`)); err == nil {
+		t.Error("Merge accepted a patch that is not JSON")
+	}
+
+	want := `{"city":"Lviv","tags":{"b":2,"c":3}}`
+	if got, err := db.Get("p"); err != nil || got != want {
+		t.Errorf("Get(p) = %s, %v, want %s", got, err, want)
+	}
+	if keys, err := db.Lookup("by_city", "Lviv"); err != nil || len(keys) != 1 {
+		t.Errorf("Lookup(Lviv) = %v, %v", keys, err)
+	}
+	if keys, _ := db.Lookup("by_city", "Kyiv"); len(keys) != 0 {
+		t.Errorf("Lookup(Kyiv) = %v, want none", keys)
+	}
+}
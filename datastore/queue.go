@@ -0,0 +1,274 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Messages of queue q are stored in the bucket queueBucketPrefix + q, keyed by
+// their zero-padded id, as a record of typeQueueMessage:
+//
+//	visibleAt (8) | attempts (4) | leased (1) | body
+//
+// visibleAt is when the message can be leased again, zero for one that was
+// never leased. leased is 1 while a lease is out; a nack clears it, so the
+// message cannot be settled before it is leased again even while its delay
+// keeps it hidden. Acking a message deletes its record.
+const (
+	queueBucketPrefix = "_queue:"
+	typeQueueMessage  = "queuemsg"
+	queueHeaderSize   = 13
+)
+
+var (
+	ErrQueueEmpty = errors.New("no message is ready")
+	ErrNotLeased  = errors.New("message is not leased or its lease expired")
+)
+
+// Message is a message handed out by Lease.
+type Message struct {
+	ID   uint64
+	Body []byte
+	// Attempts counts the leases of the message, this one included.
+	Attempts int
+	// Receipt identifies this lease to Ack and Nack, so a worker whose lease
+	// ran out cannot settle a message that was handed out again.
+	Receipt uint64
+	// LeasedUntil is when the message becomes visible to Lease again unless
+	// it is acked first.
+	LeasedUntil time.Time
+}
+
+// queue is the in-memory view of a queue. Only the write loop touches it.
+type queue struct {
+	// ids lists the pending messages, oldest first.
+	ids       []uint64
+	visibleAt map[uint64]int64
+	next      uint64
+}
+
+func newQueue() *queue {
+	return &queue{visibleAt: make(map[uint64]int64)}
+}
+
+func (q *queue) remove(id uint64) {
+	i := sort.Search(len(q.ids), func(i int) bool { return q.ids[i] >= id })
+	if i < len(q.ids) && q.ids[i] == id {
+		q.ids = append(q.ids[:i], q.ids[i+1:]...)
+	}
+	delete(q.visibleAt, id)
+}
+
+func messageKey(name string, id uint64) string {
+	return bucketPrefix(queueBucketPrefix+name) + fmt.Sprintf("%020d", id)
+}
+
+// storedMessage is the record of a message.
+type storedMessage struct {
+	visibleAt int64
+	attempts  uint32
+	leased    bool
+	body      []byte
+}
+
+func encodeMessage(m storedMessage) []byte {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(m.visibleAt))
+	data = binary.LittleEndian.AppendUint32(data, m.attempts)
+	if m.leased {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	return append(data, m.body...)
+}
+
+func decodeMessage(data []byte) (storedMessage, error) {
+	if len(data) < queueHeaderSize || data[12] > 1 {
+		return storedMessage{}, fmt.Errorf("%w: invalid queue message of %d bytes", ErrTypeMismatch, len(data))
+	}
+	return storedMessage{
+		visibleAt: int64(binary.LittleEndian.Uint64(data)),
+		attempts:  binary.LittleEndian.Uint32(data[8:]),
+		leased:    data[12] == 1,
+		body:      data[queueHeaderSize:],
+	}, nil
+}
+
+// loadQueues rebuilds the queues from their messages. It runs before the
+// write loop starts.
+func (db *Db) loadQueues() error {
+	err := db.forEachRecord(queueBucketPrefix, func(key string, e entry) {
+		bucket, rest, _ := strings.Cut(key, bucketSeparator)
+		id, err := strconv.ParseUint(rest, 10, 64)
+		if err != nil || e.Type != typeQueueMessage {
+			return
+		}
+		m, err := decodeMessage(e.value)
+		if err != nil {
+			return
+		}
+		name := strings.TrimPrefix(bucket, queueBucketPrefix)
+		q, ok := db.queues[name]
+		if !ok {
+			q = newQueue()
+			db.queues[name] = q
+		}
+		q.ids = append(q.ids, id)
+		q.visibleAt[id] = m.visibleAt
+		q.next = max(q.next, id+1)
+	})
+	for _, q := range db.queues {
+		sort.Slice(q.ids, func(i, j int) bool { return q.ids[i] < q.ids[j] })
+	}
+	return err
+}
+
+// onQueue runs fn on the write loop with the queue called name, creating
+// it if asked to.
+func (db *Db) onQueue(name string, create bool, fn func(q *queue) error) error {
+	if !validBucket(queueBucketPrefix + name) {
+		return ErrInvalidBucket
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.send(writeRequest{op: func() error {
+		q, ok := db.queues[name]
+		if !ok {
+			if !create {
+				return ErrNotFound
+			}
+			q = newQueue()
+			db.queues[name] = q
+		}
+		return fn(q)
+	}})
+}
+
+// Enqueue appends a message to the queue called name and returns its id.
+// Ids grow over the lifetime of the db, restarts included.
+func (db *Db) Enqueue(name string, body []byte) (uint64, error) {
+	var id uint64
+	err := db.onQueue(name, true, func(q *queue) error {
+		// Every id is at most the sequence number of its record, so a later
+		// sequence number has never been used.
+		id = max(db.seq+1, q.next)
+		if err := db.writeEntry(messageKey(name, id), encodeMessage(storedMessage{body: body}), typeQueueMessage); err != nil {
+			return err
+		}
+		q.ids = append(q.ids, id)
+		q.visibleAt[id] = 0
+		q.next = id + 1
+		return nil
+	})
+	return id, err
+}
+
+// Lease hands out the oldest message of the queue that is not leased and
+// hides it from other leases for visibility. A message that is neither acked
+// nor nacked in time is handed out again. An empty queue fails with
+// ErrQueueEmpty.
+func (db *Db) Lease(name string, visibility time.Duration) (Message, error) {
+	if visibility <= 0 {
+		return Message{}, fmt.Errorf("invalid visibility %s", visibility)
+	}
+	var msg Message
+	err := db.onQueue(name, false, func(q *queue) error {
+		now := db.now()
+		for _, id := range append([]uint64(nil), q.ids...) {
+			if q.visibleAt[id] > now.UnixNano() {
+				continue
+			}
+			key := messageKey(name, id)
+			record, err := db.readEntry(key)
+			if errors.Is(err, ErrNotFound) {
+				// Deleted behind the queue's back, through its bucket.
+				q.remove(id)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			m, err := decodeMessage(record.value)
+			if err != nil {
+				return err
+			}
+			until := now.Add(visibility)
+			m = storedMessage{visibleAt: until.UnixNano(), attempts: m.attempts + 1, leased: true, body: m.body}
+			if err := db.writeEntry(key, encodeMessage(m), typeQueueMessage); err != nil {
+				return err
+			}
+			q.visibleAt[id] = until.UnixNano()
+			msg = Message{ID: id, Body: m.body, Attempts: int(m.attempts), Receipt: uint64(m.attempts), LeasedUntil: until}
+			return nil
+		}
+		return ErrQueueEmpty
+	})
+	if errors.Is(err, ErrNotFound) {
+		err = ErrQueueEmpty
+	}
+	return msg, err
+}
+
+// leased runs fn with the record of a message whose lease with receipt has
+// not expired. An unknown message fails with ErrNotFound, one that is not
+// leased, was nacked or leased again since with ErrNotLeased.
+func (db *Db) leased(name string, id, receipt uint64, fn func(q *queue, key string, m storedMessage) error) error {
+	return db.onQueue(name, false, func(q *queue) error {
+		visibleAt, ok := q.visibleAt[id]
+		if !ok {
+			return ErrNotFound
+		}
+		if visibleAt <= db.now().UnixNano() {
+			return ErrNotLeased
+		}
+		key := messageKey(name, id)
+		record, err := db.readEntry(key)
+		if errors.Is(err, ErrNotFound) {
+			q.remove(id)
+		}
+		if err != nil {
+			return err
+		}
+		m, err := decodeMessage(record.value)
+		if err != nil {
+			return err
+		}
+		// Every lease counts an attempt, the count tells them apart.
+		if !m.leased || uint64(m.attempts) != receipt {
+			return ErrNotLeased
+		}
+		return fn(q, key, m)
+	})
+}
+
+// Ack removes a leased message from the queue for good. receipt is the one
+// Lease returned with the message.
+func (db *Db) Ack(name string, id, receipt uint64) error {
+	return db.leased(name, id, receipt, func(q *queue, key string, _ storedMessage) error {
+		if err := db.writeEntry(key, nil, typeTombstone); err != nil {
+			return err
+		}
+		q.remove(id)
+		return nil
+	})
+}
+
+// Nack gives up the lease of a message, making it visible again after delay.
+// receipt is the one Lease returned with the message.
+func (db *Db) Nack(name string, id, receipt uint64, delay time.Duration) error {
+	return db.leased(name, id, receipt, func(q *queue, key string, m storedMessage) error {
+		m.visibleAt = db.now().Add(delay).UnixNano()
+		m.leased = false
+		if err := db.writeEntry(key, encodeMessage(m), typeQueueMessage); err != nil {
+			return err
+		}
+		q.visibleAt[id] = m.visibleAt
+		return nil
+	})
+}
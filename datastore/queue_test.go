@@ -0,0 +1,167 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueueLeaseAckNack(t *testing.T) {
+	clock := newTestClock()
+	db, err := Open(t.TempDir(), clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Lease("jobs", time.Minute); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("Lease of an unknown queue error = %v, want ErrQueueEmpty", err)
+	}
+	var ids []uint64
+	for _, body := range []string{"a", "b", "c"} {
+		id, err := db.Enqueue("jobs", []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Fatalf("ids %v do not grow", ids)
+	}
+
+	lease := func(want string, attempts int) Message {
+		t.Helper()
+		msg, err := db.Lease("jobs", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Body) != want || msg.Attempts != attempts {
+			t.Fatalf("Lease = %q after %d attempts, want %q after %d", msg.Body, msg.Attempts, want, attempts)
+		}
+		return msg
+	}
+	a := lease("a", 1)
+	b := lease("b", 1)
+	if err := db.Ack("jobs", a.ID, a.Receipt); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ack("jobs", a.ID, a.Receipt); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Ack error = %v, want ErrNotFound", err)
+	}
+	if err := db.Nack("jobs", b.ID, b.Receipt, 0); err != nil {
+		t.Fatal(err)
+	}
+	b = lease("b", 2)
+	c := lease("c", 1)
+	if _, err := db.Lease("jobs", time.Minute); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("Lease with every message leased error = %v, want ErrQueueEmpty", err)
+	}
+
+	// An expired lease hands the message out again and can no longer be acked.
+	clock.advance(2 * time.Minute)
+	if err := db.Ack("jobs", c.ID, c.Receipt); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("Ack after the lease expired error = %v, want ErrNotLeased", err)
+	}
+	lease("b", 3)
+	again := lease("c", 2)
+	// The first worker's receipt does not settle the second lease.
+	if err := db.Ack("jobs", c.ID, c.Receipt); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("Ack with a stale receipt error = %v, want ErrNotLeased", err)
+	}
+	if err := db.Nack("jobs", c.ID, c.Receipt, 0); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("Nack with a stale receipt error = %v, want ErrNotLeased", err)
+	}
+	if err := db.Ack("jobs", again.ID, again.Receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Lease("jobs", 0); err == nil {
+		t.Error("expected Lease without a visibility timeout to fail")
+	}
+}
+
+func TestQueueNackEndsLease(t *testing.T) {
+	clock := newTestClock()
+	db, err := Open(t.TempDir(), clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Enqueue("jobs", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := db.Lease("jobs", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The delay hides the message, but it is no longer leased.
+	if err := db.Nack("jobs", msg.ID, msg.Receipt, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ack("jobs", msg.ID, msg.Receipt); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("Ack after Nack error = %v, want ErrNotLeased", err)
+	}
+	if err := db.Nack("jobs", msg.ID, msg.Receipt, 0); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("second Nack error = %v, want ErrNotLeased", err)
+	}
+	if _, err := db.Lease("jobs", time.Minute); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("Lease during the delay error = %v, want ErrQueueEmpty", err)
+	}
+
+	clock.advance(2 * time.Hour)
+	again, err := db.Lease("jobs", time.Minute)
+	if err != nil || again.Attempts != 2 {
+		t.Fatalf("Lease after the delay = %+v, %v", again, err)
+	}
+	if err := db.Ack("jobs", again.ID, again.Receipt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	db, err := Open(dir, clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.Enqueue("jobs", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Enqueue("jobs", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := db.Lease("jobs", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ack("jobs", msg.ID, msg.Receipt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Lease("jobs", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, clock.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Lease("jobs", time.Minute); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("Lease of a still leased message error = %v, want ErrQueueEmpty", err)
+	}
+	clock.advance(2 * time.Minute)
+	msg, err = db.Lease("jobs", time.Minute)
+	if err != nil || string(msg.Body) != "b" || msg.Attempts != 2 {
+		t.Errorf("Lease after reopen = %+v, %v", msg, err)
+	}
+	id, err := db.Enqueue("jobs", []byte("c"))
+	if err != nil || id <= first {
+		t.Errorf("Enqueue after reopen = %d, %v, want an id above %d", id, err, first)
+	}
+}
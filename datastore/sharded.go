@@ -0,0 +1,366 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrPartitionMismatch = errors.New("partition count does not match the data directory")
+
+// Sharded spreads keys over several Db partitions by key hash, so writes to
+// different partitions go through separate write loops and files.
+type Sharded struct {
+	parts []*Db
+}
+
+func partitionDir(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("part-%03d", i))
+}
+
+// OpenSharded opens n partitions in subdirectories of dir. Keys are not
+// rehashed, so a directory can only be reopened with the same n, and a
+// directory holding a single Db cannot be opened partitioned.
+func OpenSharded(dir string, n int, opts ...Option) (*Sharded, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid partition count %d", n)
+	}
+	fs := buildOptions(opts).fs
+	existing, err := fs.Glob(filepath.Join(dir, "part-*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 && len(existing) != n {
+		return nil, fmt.Errorf("%w: found %d, requested %d", ErrPartitionMismatch, len(existing), n)
+	}
+	single, err := fs.Glob(filepath.Join(dir, outFileName))
+	if err != nil {
+		return nil, err
+	}
+	if len(single) > 0 {
+		return nil, fmt.Errorf("%w: found an unpartitioned db, requested %d partitions", ErrPartitionMismatch, n)
+	}
+
+	s := &Sharded{parts: make([]*Db, n)}
+	for i := range s.parts {
+		partDir := partitionDir(dir, i)
+		if err := fs.MkdirAll(partDir, 0o700); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		if s.parts[i], err = Open(partDir, opts...); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Sharded) partition(key string) *Db {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return s.parts[h.Sum32()%uint32(len(s.parts))]
+}
+
+func (s *Sharded) Partitions() int {
+	return len(s.parts)
+}
+
+func (s *Sharded) Get(key string) (string, error) {
+	return s.partition(key).Get(key)
+}
+
+func (s *Sharded) Put(key, value string) error {
+	return s.partition(key).Put(key, value)
+}
+
+func (s *Sharded) GetInt64(key string) (int64, error) {
+	return s.partition(key).GetInt64(key)
+}
+
+func (s *Sharded) PutInt64(key string, value int64) error {
+	return s.partition(key).PutInt64(key, value)
+}
+
+func (s *Sharded) PutStream(key string, r io.Reader, size int64) error {
+	return s.partition(key).PutStream(key, r, size)
+}
+
+func (s *Sharded) GetStream(key string) (io.ReadCloser, error) {
+	return s.partition(key).GetStream(key)
+}
+
+func (s *Sharded) GetTyped(key string) ([]byte, string, error) {
+	return s.partition(key).GetTyped(key)
+}
+
+func (s *Sharded) PutTyped(key, typ string, value []byte) error {
+	return s.partition(key).PutTyped(key, typ, value)
+}
+
+func (s *Sharded) Merge(key string, operand []byte) error {
+	return s.partition(key).Merge(key, operand)
+}
+
+func (s *Sharded) LPush(key string, values ...string) (int, error) {
+	return s.partition(key).LPush(key, values...)
+}
+
+func (s *Sharded) RPush(key string, values ...string) (int, error) {
+	return s.partition(key).RPush(key, values...)
+}
+
+func (s *Sharded) LPop(key string) (string, error) {
+	return s.partition(key).LPop(key)
+}
+
+func (s *Sharded) RPop(key string) (string, error) {
+	return s.partition(key).RPop(key)
+}
+
+func (s *Sharded) LRange(key string, start, stop int) ([]string, error) {
+	return s.partition(key).LRange(key, start, stop)
+}
+
+func (s *Sharded) SAdd(key string, members ...string) (int, error) {
+	return s.partition(key).SAdd(key, members...)
+}
+
+func (s *Sharded) SRem(key string, members ...string) (int, error) {
+	return s.partition(key).SRem(key, members...)
+}
+
+func (s *Sharded) SMembers(key string) ([]string, error) {
+	return s.partition(key).SMembers(key)
+}
+
+func (s *Sharded) SIsMember(key, member string) (bool, error) {
+	return s.partition(key).SIsMember(key, member)
+}
+
+func (s *Sharded) HSet(key, field, value string) (bool, error) {
+	return s.partition(key).HSet(key, field, value)
+}
+
+func (s *Sharded) HGet(key, field string) (string, error) {
+	return s.partition(key).HGet(key, field)
+}
+
+func (s *Sharded) HGetAll(key string) (map[string]string, error) {
+	return s.partition(key).HGetAll(key)
+}
+
+func (s *Sharded) HDel(key string, fields ...string) (int, error) {
+	return s.partition(key).HDel(key, fields...)
+}
+
+func (s *Sharded) Enqueue(name string, body []byte) (uint64, error) {
+	return s.partition(name).Enqueue(name, body)
+}
+
+func (s *Sharded) Lease(name string, visibility time.Duration) (Message, error) {
+	return s.partition(name).Lease(name, visibility)
+}
+
+func (s *Sharded) Ack(name string, id, receipt uint64) error {
+	return s.partition(name).Ack(name, id, receipt)
+}
+
+func (s *Sharded) Nack(name string, id, receipt uint64, delay time.Duration) error {
+	return s.partition(name).Nack(name, id, receipt, delay)
+}
+
+func (s *Sharded) AcquireLock(name, owner string, ttl time.Duration) (Lock, error) {
+	return s.partition(name).AcquireLock(name, owner, ttl)
+}
+
+func (s *Sharded) RenewLock(name, owner string, token uint64, ttl time.Duration) (Lock, error) {
+	return s.partition(name).RenewLock(name, owner, token, ttl)
+}
+
+func (s *Sharded) ReleaseLock(name, owner string, token uint64) error {
+	return s.partition(name).ReleaseLock(name, owner, token)
+}
+
+func (s *Sharded) GetWithMeta(key string) ([]byte, Meta, error) {
+	return s.partition(key).GetWithMeta(key)
+}
+
+func (s *Sharded) History(key string) ([]Version, error) {
+	return s.partition(key).History(key)
+}
+
+func (s *Sharded) GetAt(key string, t time.Time) ([]byte, string, error) {
+	return s.partition(key).GetAt(key, t)
+}
+
+func (s *Sharded) Delete(key string) error {
+	return s.partition(key).Delete(key)
+}
+
+// Write splits the batch per partition and writes the parts concurrently.
+// The whole batch is validated first, so an invalid key or value rejects it
+// before any partition is written. Each part is atomic on its own partition,
+// but the batch as a whole is not: an I/O error on one partition leaves the
+// parts already written to the others in place.
+func (s *Sharded) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	if err := b.check(); err != nil {
+		return err
+	}
+	split := make(map[*Db]*Batch)
+	for _, e := range b.entries {
+		p := s.partition(e.key)
+		if split[p] == nil {
+			split[p] = new(Batch)
+		}
+		split[p].entries = append(split[p].entries, e)
+	}
+	return s.each(func(p *Db) error {
+		if part, ok := split[p]; ok {
+			return p.Write(part)
+		}
+		return nil
+	})
+}
+
+func (s *Sharded) Bucket(name string) *Bucket {
+	return newBucket(s, name)
+}
+
+func (s *Sharded) Buckets() map[string]int {
+	res := make(map[string]int)
+	for _, p := range s.parts {
+		for name, n := range p.Buckets() {
+			res[name] += n
+		}
+	}
+	return res
+}
+
+func (s *Sharded) DropBucket(name string) error {
+	return s.each(func(p *Db) error {
+		return p.DropBucket(name)
+	})
+}
+
+// CreateIndex creates the index on every partition. A partition that already
+// has it is not an error unless all of them do.
+func (s *Sharded) CreateIndex(name, jsonPath string) error {
+	var (
+		mu      sync.Mutex
+		existed int
+	)
+	err := s.each(func(p *Db) error {
+		err := p.CreateIndex(name, jsonPath)
+		if errors.Is(err, ErrIndexExists) {
+			mu.Lock()
+			existed++
+			mu.Unlock()
+			return nil
+		}
+		return err
+	})
+	if err == nil && existed == len(s.parts) {
+		return ErrIndexExists
+	}
+	return err
+}
+
+func (s *Sharded) Lookup(index, value string) ([]IndexedKey, error) {
+	var keys []IndexedKey
+	for _, p := range s.parts {
+		found, err := p.Lookup(index, value)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+	}
+	sortIndexedKeys(keys)
+	return keys, nil
+}
+
+// Export writes the partitions one after another. Each partition is a
+// consistent snapshot on its own.
+func (s *Sharded) Export(w io.Writer) error {
+	for _, p := range s.parts {
+		if err := p.Export(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import writes the chunks through Write, so a chunk is only atomic per
+// partition.
+func (s *Sharded) Import(r io.Reader) (int, error) {
+	return importRecords(r, s.Write)
+}
+
+func (s *Sharded) Compact(ctx context.Context) error {
+	return s.each(func(p *Db) error {
+		return p.Compact(ctx)
+	})
+}
+
+// Stats adds up the stats of all partitions.
+func (s *Sharded) Stats() Stats {
+	var total Stats
+	for _, p := range s.parts {
+		st := p.Stats()
+		total.Keys += st.Keys
+		total.LiveBytes += st.LiveBytes
+		total.DeadBytes += st.DeadBytes
+		total.HistoryBytes += st.HistoryBytes
+		total.QueueLen += st.QueueLen
+		total.QueueCap += st.QueueCap
+		total.Rejected += st.Rejected
+	}
+	return total
+}
+
+func (s *Sharded) Size() (int64, error) {
+	var total int64
+	for _, p := range s.parts {
+		size, err := p.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func (s *Sharded) Close() error {
+	var errs []error
+	for _, p := range s.parts {
+		if p != nil {
+			errs = append(errs, p.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// each runs fn on every partition concurrently and joins the errors.
+func (s *Sharded) each(fn func(p *Db) error) error {
+	errs := make([]error, len(s.parts))
+	var wg sync.WaitGroup
+	for i, p := range s.parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(p); err != nil {
+				errs[i] = fmt.Errorf("partition %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,155 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		s, err := OpenSharded(t.TempDir(), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = s.Close()
+		})
+		return s
+	})
+}
+
+func TestShardedReopen(t *testing.T) {
+	tmp := t.TempDir()
+	s, err := OpenSharded(tmp, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	for i := 0; i < 100; i++ {
+		b.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	if err := s.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		info, err := os.Stat(filepath.Join(partitionDir(tmp, i), outFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() <= headerSize {
+			t.Errorf("partition %d received no keys", i)
+		}
+	}
+
+	if _, err := OpenSharded(tmp, 2); !errors.Is(err, ErrPartitionMismatch) {
+		t.Errorf("expected ErrPartitionMismatch, got %v", err)
+	}
+	if _, err := Open(tmp); !errors.Is(err, ErrPartitionMismatch) {
+		t.Errorf("expected Open of a partitioned dir to fail with ErrPartitionMismatch, got %v", err)
+	}
+
+	s, err = OpenSharded(tmp, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if val, err := s.Get(key); err != nil || val != fmt.Sprintf("value%d", i) {
+			t.Errorf("Get(%s) = %q, %v", key, val, err)
+		}
+	}
+}
+
+func benchmarkParallelPut(b *testing.B, partitions int) {
+	s, err := OpenSharded(b.TempDir(), partitions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	var n atomic.Int64
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := n.Add(1)
+			if err := s.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkShardedPut1(b *testing.B) {
+	benchmarkParallelPut(b, 1)
+}
+
+func BenchmarkShardedPut4(b *testing.B) {
+	benchmarkParallelPut(b, 4)
+}
+
+func BenchmarkShardedPut8(b *testing.B) {
+	benchmarkParallelPut(b, 8)
+}
+
+func TestShardedRejectsSingleDb(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSharded(tmp, 2); !errors.Is(err, ErrPartitionMismatch) {
+		t.Errorf("expected ErrPartitionMismatch, got %v", err)
+	}
+}
+
+func TestShardedWriteRejectsWholeBatch(t *testing.T) {
+	s, err := OpenSharded(t.TempDir(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	bad := map[string]func(b *Batch){
+		"reserved key":  func(b *Batch) { b.Put(lockBucket+"\x00x", "v") },
+		"reserved type": func(b *Batch) { b.PutTyped("typed", typeBatch, nil) },
+		"short int64":   func(b *Batch) { b.PutTyped("typed", typeInt64, []byte{1}) },
+	}
+	for name, add := range bad {
+		t.Run(name, func(t *testing.T) {
+			var b Batch
+			for i := 0; i < 20; i++ {
+				b.Put(fmt.Sprintf("key%d", i), "value")
+			}
+			add(&b)
+			if err := s.Write(&b); err == nil {
+				t.Fatal("expected Write to fail")
+			}
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("key%d", i)
+				if _, err := s.Get(key); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Get(%s) error = %v, want ErrNotFound", key, err)
+				}
+			}
+		})
+	}
+}
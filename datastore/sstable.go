@@ -0,0 +1,333 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// A table holds records sorted by key, each key at most once, in the record
+// layout of the data file:
+//
+//	records | index | bloom filter | footer
+//
+// The index is sparse, it lists the first key and offset of every block of
+// about tableBlockSize bytes, followed by the last key of the table. Both the
+// index and the filter are loaded when the table is opened, so a lookup reads
+// a single block at most.
+const (
+	tableBlockSize  = 4 << 10
+	tableFooterSize = 5 * 8
+	tableMagic      = 0x4c534d5441424c31 // "LSMTABL1"
+)
+
+var errTableFooter = errors.New("invalid table footer")
+
+type tableBlock struct {
+	key    string
+	offset int64
+}
+
+// sstable is an open table. It is immutable, only compaction removes it.
+type sstable struct {
+	f      File
+	name   string
+	index  []tableBlock
+	last   string
+	filter bloom
+	// dataEnd is where the records end and the index starts.
+	dataEnd int64
+	size    int64
+	count   int64
+	maxSeq  uint64
+	// refs counts the LSM and every scan still reading the table.
+	refs atomic.Int32
+}
+
+func (t *sstable) first() string {
+	return t.index[0].key
+}
+
+// overlaps reports whether the table may hold keys in [from, to].
+func (t *sstable) overlaps(from, to string) bool {
+	return t.first() <= to && t.last >= from
+}
+
+func openTable(fs FS, path string) (*sstable, error) {
+	f, err := openRead(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("open table %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func readTable(f File) (*sstable, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < tableFooterSize {
+		return nil, errTableFooter
+	}
+	footer := make([]byte, tableFooterSize)
+	if _, err := f.ReadAt(footer, size-tableFooterSize); err != nil {
+		return nil, err
+	}
+	indexAt := int64(binary.LittleEndian.Uint64(footer))
+	bloomAt := int64(binary.LittleEndian.Uint64(footer[8:]))
+	count := int64(binary.LittleEndian.Uint64(footer[16:]))
+	maxSeq := binary.LittleEndian.Uint64(footer[24:])
+	if binary.LittleEndian.Uint64(footer[32:]) != tableMagic || indexAt < 0 || indexAt > bloomAt || bloomAt > size-tableFooterSize {
+		return nil, errTableFooter
+	}
+
+	meta := make([]byte, size-tableFooterSize-indexAt)
+	if _, err := f.ReadAt(meta, indexAt); err != nil {
+		return nil, err
+	}
+	index, last, err := decodeTableIndex(meta[:bloomAt-indexAt])
+	if err != nil {
+		return nil, err
+	}
+	filter, ok := decodeBloom(meta[bloomAt-indexAt:])
+	if !ok {
+		return nil, fmt.Errorf("%w: bloom filter", ErrMalformedRecord)
+	}
+	t := &sstable{
+		f:       f,
+		name:    info.Name(),
+		index:   index,
+		last:    last,
+		filter:  filter,
+		dataEnd: indexAt,
+		size:    size,
+		count:   count,
+		maxSeq:  maxSeq,
+	}
+	t.refs.Store(1)
+	return t, nil
+}
+
+func decodeTableIndex(data []byte) ([]tableBlock, string, error) {
+	str := func() (string, bool) {
+		if len(data) < 4 {
+			return "", false
+		}
+		l := int(binary.LittleEndian.Uint32(data))
+		if l > len(data)-4 {
+			return "", false
+		}
+		s := string(data[4 : 4+l])
+		data = data[4+l:]
+		return s, true
+	}
+	if len(data) < 4 {
+		return nil, "", fmt.Errorf("%w: table index", ErrMalformedRecord)
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if n == 0 || n > len(data)/12 {
+		return nil, "", fmt.Errorf("%w: table index of %d blocks", ErrMalformedRecord, n)
+	}
+	index := make([]tableBlock, n)
+	for i := range index {
+		key, ok := str()
+		if !ok || len(data) < 8 {
+			return nil, "", fmt.Errorf("%w: table index block %d", ErrMalformedRecord, i)
+		}
+		index[i] = tableBlock{key: key, offset: int64(binary.LittleEndian.Uint64(data))}
+		data = data[8:]
+	}
+	last, ok := str()
+	if !ok {
+		return nil, "", fmt.Errorf("%w: table last key", ErrMalformedRecord)
+	}
+	return index, last, nil
+}
+
+// get returns the record of key, tombstones included.
+func (t *sstable) get(key string) (entry, bool, error) {
+	if key < t.first() || key > t.last || !t.filter.mayContain(key) {
+		return entry{}, false, nil
+	}
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	}) - 1
+	end := t.dataEnd
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+	block := make([]byte, end-t.index[i].offset)
+	if _, err := t.f.ReadAt(block, t.index[i].offset); err != nil {
+		return entry{}, false, err
+	}
+	for offset := 0; offset < len(block); {
+		if len(block)-offset < 4 {
+			return entry{}, false, t.corrupt(t.index[i].offset+int64(offset), fmt.Errorf("%w: record cut off", ErrMalformedRecord))
+		}
+		size := int(binary.LittleEndian.Uint32(block[offset:]))
+		if size < minRecordSize || size > len(block)-offset {
+			return entry{}, false, t.corrupt(t.index[i].offset+int64(offset), fmt.Errorf("%w: size %d", ErrMalformedRecord, size))
+		}
+		var e entry
+		if err := e.Decode(block[offset : offset+size]); err != nil {
+			return entry{}, false, t.corrupt(t.index[i].offset+int64(offset), err)
+		}
+		switch {
+		case e.key == key:
+			if !e.verify() {
+				return entry{}, false, t.corrupt(t.index[i].offset+int64(offset), ErrChecksumMismatch)
+			}
+			return e, true, nil
+		case e.key > key:
+			return entry{}, false, nil
+		}
+		offset += size
+	}
+	return entry{}, false, nil
+}
+
+func (t *sstable) corrupt(offset int64, err error) error {
+	return fmt.Errorf("table %s: %w", t.name, &CorruptionError{Offset: offset, Err: err})
+}
+
+// iter returns the records of the table from the first key not below start.
+func (t *sstable) iter(start string) *tableIter {
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > start
+	}) - 1
+	from := int64(0)
+	if i >= 0 {
+		from = t.index[i].offset
+	}
+	section := io.NewSectionReader(t.f, from, t.dataEnd-from)
+	return &tableIter{in: bufio.NewReader(section), start: start}
+}
+
+type tableIter struct {
+	in    *bufio.Reader
+	start string
+}
+
+func (it *tableIter) next() (entry, bool, error) {
+	for {
+		var e entry
+		_, err := e.decodeFromReader(it.in, maxRecordSize)
+		if errors.Is(err, io.EOF) {
+			return entry{}, false, nil
+		}
+		if err != nil {
+			return entry{}, false, err
+		}
+		if e.key >= it.start {
+			return e, true, nil
+		}
+	}
+}
+
+func (t *sstable) close() error {
+	return t.f.Close()
+}
+
+// ref keeps the table open for a scan that reads it without holding mu.
+func (t *sstable) ref() {
+	t.refs.Add(1)
+}
+
+// unref closes the table once neither the LSM nor any scan uses it.
+func (t *sstable) unref() error {
+	if t.refs.Add(-1) > 0 {
+		return nil
+	}
+	return t.close()
+}
+
+// tableWriter writes records given in key order into a new table.
+type tableWriter struct {
+	f      File
+	out    *bufio.Writer
+	offset int64
+	index  []tableBlock
+	keys   []string
+	last   string
+	maxSeq uint64
+}
+
+func createTable(fs FS, path string) (*tableWriter, error) {
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{f: f, out: bufio.NewWriter(f)}, nil
+}
+
+func (w *tableWriter) add(e entry) error {
+	data := e.Encode()
+	if len(w.index) == 0 || w.offset-w.index[len(w.index)-1].offset >= tableBlockSize {
+		w.index = append(w.index, tableBlock{key: e.key, offset: w.offset})
+	}
+	if _, err := w.out.Write(data); err != nil {
+		return err
+	}
+	w.offset += int64(len(data))
+	w.keys = append(w.keys, e.key)
+	w.last = e.key
+	w.maxSeq = max(w.maxSeq, e.seq)
+	return nil
+}
+
+func (w *tableWriter) empty() bool {
+	return len(w.keys) == 0
+}
+
+// finish writes the index, the filter and the footer and syncs the table.
+func (w *tableWriter) finish() error {
+	filter := newBloom(len(w.keys))
+	for _, k := range w.keys {
+		filter.add(k)
+	}
+
+	meta := binary.LittleEndian.AppendUint32(nil, uint32(len(w.index)))
+	for _, b := range w.index {
+		meta = binary.LittleEndian.AppendUint32(meta, uint32(len(b.key)))
+		meta = append(meta, b.key...)
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(b.offset))
+	}
+	meta = binary.LittleEndian.AppendUint32(meta, uint32(len(w.last)))
+	meta = append(meta, w.last...)
+	bloomAt := w.offset + int64(len(meta))
+	meta = append(meta, filter.encode()...)
+
+	footer := binary.LittleEndian.AppendUint64(nil, uint64(w.offset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(bloomAt))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(w.keys)))
+	footer = binary.LittleEndian.AppendUint64(footer, w.maxSeq)
+	footer = binary.LittleEndian.AppendUint64(footer, tableMagic)
+
+	if _, err := w.out.Write(append(meta, footer...)); err != nil {
+		return err
+	}
+	if err := w.out.Flush(); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
+
+// abort closes the table, the caller removes the file.
+func (w *tableWriter) abort() {
+	_ = w.f.Close()
+}
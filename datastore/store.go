@@ -0,0 +1,38 @@
+package datastore
+
+import (
+	"context"
+	"io"
+)
+
+// Store is the key-value API shared by the on-disk Db, LSM and MemStore.
+type Store interface {
+	TypedStore
+	Get(key string) (string, error)
+	Put(key, value string) error
+	GetInt64(key string) (int64, error)
+	PutInt64(key string, value int64) error
+	PutStream(key string, r io.Reader, size int64) error
+	GetStream(key string) (io.ReadCloser, error)
+	GetWithMeta(key string) ([]byte, Meta, error)
+	Delete(key string) error
+	Write(b *Batch) error
+	Bucket(name string) *Bucket
+	Buckets() map[string]int
+	DropBucket(name string) error
+	CreateIndex(name, jsonPath string) error
+	Lookup(index, value string) ([]IndexedKey, error)
+	Compact(ctx context.Context) error
+	Export(w io.Writer) error
+	Import(r io.Reader) (int, error)
+	Close() error
+}
+
+var (
+	_ Store = (*Db)(nil)
+	_ Store = (*MemStore)(nil)
+	_ Store = (*Sharded)(nil)
+	_ Store = (*LSM)(nil)
+
+	_ TypedStore = (*Bucket)(nil)
+)
@@ -0,0 +1,370 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore is the conformance suite every Store implementation must pass.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("put/get", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put("k1", "v1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("k1", "v1.1"); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := s.Get("k1"); err != nil || val != "v1.1" {
+			t.Errorf("Get(k1) = %q, %v; want v1.1", val, err)
+		}
+	})
+
+	t.Run("put/get int64", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.PutInt64("n", -42); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := s.GetInt64("n"); err != nil || val != -42 {
+			t.Errorf("GetInt64(n) = %d, %v; want -42", val, err)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Get("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+		if err := s.Delete("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound on delete, got %v", err)
+		}
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put("k", "string"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetInt64("k"); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expected ErrTypeMismatch, got %v", err)
+		}
+		if err := s.PutInt64("k", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("k"); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expected ErrTypeMismatch, got %v", err)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		s := newStore(t)
+		value := bytes.Repeat([]byte("blob"), 1000)
+		if err := s.PutStream("blob", bytes.NewReader(value), int64(len(value))); err != nil {
+			t.Fatal(err)
+		}
+		r, err := s.GetStream("blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("GetStream returned %d bytes, want %d", len(got), len(value))
+		}
+		if _, err := s.Get("blob"); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expected ErrTypeMismatch, got %v", err)
+		}
+		if err := s.PutStream("short", strings.NewReader("abc"), 10); err == nil {
+			t.Errorf("expected an error for a short stream")
+		}
+		if _, err := s.GetStream("short"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound for a failed stream, got %v", err)
+		}
+	})
+
+	t.Run("buckets", func(t *testing.T) {
+		s := newStore(t)
+		a, b := s.Bucket("a"), s.Bucket("b")
+		if err := s.Put("k", "root"); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Put("k", "in a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.PutInt64("n", 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put("k", "in b"); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := s.Get("k"); err != nil || val != "root" {
+			t.Errorf("Get(k) = %q, %v; want root", val, err)
+		}
+		if val, err := a.Get("k"); err != nil || val != "in a" {
+			t.Errorf("Get(k) in a = %q, %v; want in a", val, err)
+		}
+		if counts := s.Buckets(); counts["a"] != 2 || counts["b"] != 1 || len(counts) != 2 {
+			t.Errorf("unexpected bucket counts %v", counts)
+		}
+
+		if err := s.DropBucket("a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Get("k"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound in a dropped bucket, got %v", err)
+		}
+		if a.Len() != 0 || b.Len() != 1 {
+			t.Errorf("unexpected bucket sizes a=%d b=%d", a.Len(), b.Len())
+		}
+		if val, err := b.Get("k"); err != nil || val != "in b" {
+			t.Errorf("Get(k) in b = %q, %v", val, err)
+		}
+		if err := s.Bucket("").Put("k", "v"); !errors.Is(err, ErrInvalidBucket) {
+			t.Errorf("expected ErrInvalidBucket, got %v", err)
+		}
+	})
+
+	t.Run("secondary index", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put("u1", `{"name": "ann", "team": {"id": 7}}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("u2", `{"name": "bob", "team": {"id": 7}}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("plain", "not a document"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateIndex("by_team", "$.team.id"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateIndex("by_team", "team.id"); !errors.Is(err, ErrIndexExists) {
+			t.Errorf("expected ErrIndexExists, got %v", err)
+		}
+		if err := s.Bucket("b").Put("u3", `{"team": {"id": 7}}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("u2", `{"name": "bob", "team": {"id": 8}}`); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := s.Lookup("by_team", "7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 || keys[0] != (IndexedKey{Key: "u1"}) || keys[1] != (IndexedKey{Bucket: "b", Key: "u3"}) {
+			t.Errorf("Lookup(7) = %v", keys)
+		}
+		if err := s.Delete("u1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DropBucket("b"); err != nil {
+			t.Fatal(err)
+		}
+		if keys, _ := s.Lookup("by_team", "7"); len(keys) != 0 {
+			t.Errorf("Lookup(7) after delete = %v", keys)
+		}
+		if keys, _ := s.Lookup("by_team", "8"); len(keys) != 1 || keys[0] != (IndexedKey{Key: "u2"}) {
+			t.Errorf("Lookup(8) = %v", keys)
+		}
+		if _, err := s.Lookup("missing", "7"); !errors.Is(err, ErrIndexNotFound) {
+			t.Errorf("expected ErrIndexNotFound, got %v", err)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put("old", "v"); err != nil {
+			t.Fatal(err)
+		}
+		var b Batch
+		b.Put("k1", "v1")
+		b.PutInt64("n", 5)
+		b.Delete("old")
+		b.Delete("never existed")
+		b.Put("k1", "v1.1")
+		if err := s.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := s.Get("k1"); err != nil || val != "v1.1" {
+			t.Errorf("Get(k1) = %q, %v; want v1.1", val, err)
+		}
+		if val, err := s.GetInt64("n"); err != nil || val != 5 {
+			t.Errorf("GetInt64(n) = %d, %v; want 5", val, err)
+		}
+		if _, err := s.Get("old"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("reserved key", func(t *testing.T) {
+		s := newStore(t)
+		key := lockBucket + "\x00x"
+		var b Batch
+		b.Put("k", "v")
+		b.Put(key, "v")
+		writes := map[string]error{
+			"Put":       s.Put(key, "v"),
+			"PutInt64":  s.PutInt64(key, 1),
+			"PutStream": s.PutStream(key, strings.NewReader("v"), 1),
+			"PutTyped":  s.PutTyped(key, typeString, []byte("v")),
+			"Delete":    s.Delete(key),
+			"Write":     s.Write(&b),
+		}
+		for name, err := range writes {
+			if !errors.Is(err, ErrInvalidBucket) {
+				t.Errorf("%s error = %v, want ErrInvalidBucket", name, err)
+			}
+		}
+		if _, err := s.Get("k"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(k) after a rejected batch error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("k"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("k"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound after delete, got %v", err)
+		}
+		if err := s.Put("k", "again"); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := s.Get("k"); err != nil || val != "again" {
+			t.Errorf("Get(k) = %q, %v; want again", val, err)
+		}
+	})
+
+	t.Run("typed values", func(t *testing.T) {
+		s := newStore(t)
+		type doc struct {
+			Name string
+			Tags []string
+		}
+		want := doc{Name: "a", Tags: []string{"x", "y"}}
+		if err := PutAs(s, "json", want, JSONCodec[doc]()); err != nil {
+			t.Fatal(err)
+		}
+		if err := PutAs(s.Bucket("b"), "gob", want, GobCodec[doc]()); err != nil {
+			t.Fatal(err)
+		}
+		if err := PutAs(s, "n", 7, Int64Codec); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := GetAs(s, "json", JSONCodec[doc]()); err != nil || got.Name != want.Name || len(got.Tags) != 2 {
+			t.Errorf("GetAs(json) = %+v, %v", got, err)
+		}
+		if got, err := GetAs(s.Bucket("b"), "gob", GobCodec[doc]()); err != nil || got.Name != want.Name || len(got.Tags) != 2 {
+			t.Errorf("GetAs(gob) = %+v, %v", got, err)
+		}
+		if got, err := s.GetInt64("n"); err != nil || got != 7 {
+			t.Errorf("GetInt64(n) = %d, %v; want 7", got, err)
+		}
+		if _, err := GetAs(s, "json", GobCodec[doc]()); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expected ErrTypeMismatch, got %v", err)
+		}
+		if _, err := s.Get("json"); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expected ErrTypeMismatch, got %v", err)
+		}
+		if err := s.PutTyped("k", typeTombstone, nil); !errors.Is(err, ErrReservedType) {
+			t.Errorf("expected ErrReservedType, got %v", err)
+		}
+	})
+
+	t.Run("meta", func(t *testing.T) {
+		s := newStore(t)
+		before := time.Now()
+		if err := s.Put("k", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Bucket("b").PutInt64("n", 1); err != nil {
+			t.Fatal(err)
+		}
+
+		value, meta, err := s.GetWithMeta("k")
+		if err != nil || string(value) != "value" || meta.Type != typeString || meta.Size != 5 {
+			t.Errorf("GetWithMeta(k) = %q, %+v, %v", value, meta, err)
+		}
+		if meta.WrittenAt.Before(before.Add(-time.Second)) || meta.WrittenAt.After(time.Now()) {
+			t.Errorf("written at %s, expected around %s", meta.WrittenAt, before)
+		}
+		if _, meta, err := s.Bucket("b").GetWithMeta("n"); err != nil || meta.Type != typeInt64 || meta.Size != 8 {
+			t.Errorf("GetWithMeta(b/n) = %+v, %v", meta, err)
+		}
+		if _, _, err := s.GetWithMeta("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("export/import", func(t *testing.T) {
+		src := newStore(t)
+		if err := src.Put("s", "line\nbreak"); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.PutInt64("n", -3); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.PutStream("blob", strings.NewReader("\x00\xff"), 2); err != nil {
+			t.Fatal(err)
+		}
+		if err := PutAs(src.Bucket("b"), "doc", map[string]int{"a": 1}, JSONCodec[map[string]int]()); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := src.Export(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(buf.String(), "\n"); lines != 4 {
+			t.Errorf("expected 4 lines, got %d:\n%s", lines, buf.String())
+		}
+
+		dst := newStore(t)
+		if n, err := dst.Import(&buf); err != nil || n != 4 {
+			t.Fatalf("Import = %d, %v; want 4", n, err)
+		}
+		if val, err := dst.Get("s"); err != nil || val != "line\nbreak" {
+			t.Errorf("Get(s) = %q, %v", val, err)
+		}
+		if val, err := dst.GetInt64("n"); err != nil || val != -3 {
+			t.Errorf("GetInt64(n) = %d, %v", val, err)
+		}
+		if data, typ, err := dst.GetTyped("blob"); err != nil || typ != typeBytes || string(data) != "\x00\xff" {
+			t.Errorf("GetTyped(blob) = %q, %s, %v", data, typ, err)
+		}
+		if doc, err := GetAs(dst.Bucket("b"), "doc", JSONCodec[map[string]int]()); err != nil || doc["a"] != 1 {
+			t.Errorf("GetAs(b/doc) = %v, %v", doc, err)
+		}
+	})
+}
+
+func TestDbStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db, err := Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		return db
+	})
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemStore()
+	})
+}
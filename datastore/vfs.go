@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FS is the filesystem the datastore keeps its files on. All file access of
+// the package goes through it, so tests can swap in a MemFS that injects
+// faults.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	CreateTemp(dir, pattern string) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Glob(pattern string) ([]string, error)
+	// Lock takes the directory lock, shared for read-only openers. The lock
+	// is held until the returned closer is closed.
+	Lock(dir string, shared bool) (io.Closer, error)
+}
+
+// File is the subset of *os.File the datastore uses.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OSFS is the default FS backed by the os package.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) CreateTemp(dir, pattern string) (File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (osFS) Lock(dir string, shared bool) (io.Closer, error) {
+	f, err := lockDir(dir, shared)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WithFS makes the db keep its files on fs instead of the OS filesystem.
+func WithFS(fs FS) Option {
+	return func(o *options) {
+		o.fs = fs
+	}
+}
+
+func buildOptions(opts []Option) options {
+	o := options{fs: OSFS, maxRecordSize: maxRecordSize, now: time.Now, listener: NopListener{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func openRead(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
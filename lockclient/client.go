@@ -0,0 +1,128 @@
+// Package lockclient takes named locks from the db service, so that only one
+// of several servers runs a task at a time.
+package lockclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// ErrHeld means another owner holds the lock.
+	ErrHeld = errors.New("lock is held by another owner")
+	// ErrLost means the lock expired or went to another owner, and work
+	// guarded by it must stop.
+	ErrLost = errors.New("lock was lost")
+)
+
+// Client talks to the lock endpoints of the db service at BaseURL, such as
+// http://db:8081, on behalf of Owner.
+type Client struct {
+	BaseURL string
+	Owner   string
+	HTTP    *http.Client
+}
+
+func New(baseURL, owner string) *Client {
+	return &Client{BaseURL: baseURL, Owner: owner, HTTP: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Lock is a held lock. Token is its fencing token: pass it along with writes
+// guarded by the lock, so they can be refused once a newer holder shows up.
+type Lock struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	client *Client
+	ttl    time.Duration
+}
+
+// Acquire takes the lock called name for ttl. It fails with ErrHeld while
+// another owner holds it.
+func (c *Client) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	l := &Lock{client: c, ttl: ttl}
+	err := c.call(ctx, name, "acquire", map[string]interface{}{"owner": c.Owner, "ttl": ttl.String()}, l, ErrHeld)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Renew extends the lock by the ttl it was acquired with. It fails with
+// ErrLost once the lock expired.
+func (l *Lock) Renew(ctx context.Context) error {
+	return l.client.call(ctx, l.Name, "renew", map[string]interface{}{
+		"owner": l.Owner,
+		"token": l.Token,
+		"ttl":   l.ttl.String(),
+	}, l, ErrLost)
+}
+
+// Release gives the lock up before it expires.
+func (l *Lock) Release(ctx context.Context) error {
+	return l.client.call(ctx, l.Name, "release", map[string]interface{}{
+		"owner": l.Owner,
+		"token": l.Token,
+	}, nil, ErrLost)
+}
+
+// minRenewInterval keeps KeepAlive from spinning on, or panicking over, a ttl
+// of a few nanoseconds. Such a lock expires before the first renewal.
+const minRenewInterval = time.Millisecond
+
+// KeepAlive renews the lock every third of its ttl until ctx is done or the
+// lock is lost. It returns ctx.Err() or the error of the failed renewal.
+func (l *Lock) KeepAlive(ctx context.Context) error {
+	ticker := time.NewTicker(max(l.ttl/3, minRenewInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := l.Renew(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// call posts body to /lock/{name}/{op} and decodes the response into out. A
+// 409 Conflict is reported as conflict.
+func (c *Client) call(ctx context.Context, name, op string, body, out interface{}, conflict error) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	target := fmt.Sprintf("%s/lock/%s/%s", c.BaseURL, url.PathEscape(name), op)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return conflict
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s lock %q: %s: %s", op, name, resp.Status, bytes.TrimSpace(msg))
+	case out != nil:
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package lockclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLocks serves a single lock the way the db service does.
+type fakeLocks struct {
+	owner string
+	token uint64
+	calls []string
+}
+
+func (f *fakeLocks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Owner string `json:"owner"`
+		Token uint64 `json:"token"`
+		TTL   string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	name, op, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/lock/"), "/")
+	f.calls = append(f.calls, op+" "+req.Owner+" "+req.TTL)
+
+	switch op {
+	case "acquire":
+		if f.owner != "" && f.owner != req.Owner {
+			http.Error(w, "held", http.StatusConflict)
+			return
+		}
+		if f.owner == "" {
+			f.owner = req.Owner
+			f.token++
+		}
+	case "renew", "release":
+		if f.owner != req.Owner || f.token != req.Token {
+			http.Error(w, "lost", http.StatusConflict)
+			return
+		}
+		if op == "release" {
+			f.owner = ""
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":      name,
+		"owner":     f.owner,
+		"token":     f.token,
+		"expiresAt": time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+}
+
+func TestAcquireRenewRelease(t *testing.T) {
+	locks := &fakeLocks{}
+	srv := httptest.NewServer(locks)
+	defer srv.Close()
+	ctx := context.Background()
+
+	a := New(srv.URL, "server1")
+	l, err := a.Acquire(ctx, "seed", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Name != "seed" || l.Owner != "server1" || l.Token != 1 || l.ExpiresAt.IsZero() {
+		t.Errorf("Acquire = %+v", l)
+	}
+	if _, err := New(srv.URL, "server2").Acquire(ctx, "seed", time.Minute); !errors.Is(err, ErrHeld) {
+		t.Errorf("Acquire of a held lock error = %v, want ErrHeld", err)
+	}
+
+	if err := l.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Renew(ctx); !errors.Is(err, ErrLost) {
+		t.Errorf("Renew after release error = %v, want ErrLost", err)
+	}
+	if err := l.Release(ctx); !errors.Is(err, ErrLost) {
+		t.Errorf("second Release error = %v, want ErrLost", err)
+	}
+
+	want := []string{
+		"acquire server1 1m0s",
+		"acquire server2 1m0s",
+		"renew server1 1m0s",
+		"release server1 ",
+		"renew server1 1m0s",
+		"release server1 ",
+	}
+	if strings.Join(locks.calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls = %q, want %q", locks.calls, want)
+	}
+}
+
+func TestCallError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "db is closed", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, "server1").Acquire(context.Background(), "seed", time.Minute)
+	if err == nil || errors.Is(err, ErrHeld) || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "db is closed") {
+		t.Errorf("Acquire error = %v, want the status and message", err)
+	}
+}
+
+func TestKeepAliveTinyTTL(t *testing.T) {
+	locks := &fakeLocks{}
+	srv := httptest.NewServer(locks)
+	defer srv.Close()
+	ctx := context.Background()
+
+	l, err := New(srv.URL, "server1").Acquire(ctx, "seed", time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks.owner = ""
+	if err := l.KeepAlive(ctx); !errors.Is(err, ErrLost) {
+		t.Errorf("KeepAlive error = %v, want ErrLost", err)
+	}
+}